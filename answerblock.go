@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
+
+// parseAnswerIPBlocklist compiles answer_ip_blocklist into prefixes.
+func parseAnswerIPBlocklist(ranges []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(ranges))
+	for _, r := range ranges {
+		ipNet, err := parseSubnet(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %s: %w", r, err)
+		}
+		addr, _ := netip.AddrFromSlice(ipNet.IP)
+		ones, _ := ipNet.Mask.Size()
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), ones))
+	}
+	return prefixes, nil
+}
+
+// blockedAnswerIP returns the first A/AAAA address in a response that falls in
+// answer_ip_blocklist, and the range it matched.
+func (s *DNSServer) blockedAnswerIP(resp *dns.Msg) (net.IP, netip.Prefix, bool) {
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rec := rr.(type) {
+		case *dns.A:
+			ip = rec.A
+		case *dns.AAAA:
+			ip = rec.AAAA
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		for _, prefix := range s.answerIPBlocklist {
+			if prefix.Contains(addr) {
+				return ip, prefix, true
+			}
+		}
+	}
+	return nil, netip.Prefix{}, false
+}
@@ -0,0 +1,29 @@
+package main
+
+import "github.com/miekg/dns"
+
+// anyResponse answers an ANY query according to the listener's any_mode: REFUSED, or a single
+// synthesized HINFO record "RFC8482" owned by the queried name (RFC 8482 section 4.2).
+// Returns nil if the query is not ANY or mode is "forward".
+func (s *DNSServer) anyResponse(r *dns.Msg, mode string) *dns.Msg {
+	if len(r.Question) == 0 || r.Question[0].Qtype != dns.TypeANY {
+		return nil
+	}
+	switch mode {
+	case anyModeRefuse:
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeRefused)
+		msg.RecursionAvailable = true
+		return msg
+	case anyModeMinimal:
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.RecursionAvailable = true
+		msg.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeHINFO, Class: r.Question[0].Qclass, Ttl: anyHINFOTTL},
+			Cpu: "RFC8482",
+		}}
+		return msg
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnyModeMinimal(t *testing.T) {
+	s := newTestServer(t, &Config{AnyMode: anyModeMinimal})
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.test.lan.", dns.TypeANY)
+	resp, err := s.Query(testClient, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mismatch := responseMismatch(msg, resp); mismatch != "" {
+		t.Errorf("response does not match the question: %s", mismatch)
+	}
+	if resp.Rcode != dns.RcodeSuccess || !resp.Response || !resp.RecursionAvailable || len(resp.Answer) != 1 {
+		t.Fatalf("response = %v, want NOERROR with RA set and one record", resp)
+	}
+	hinfo, ok := resp.Answer[0].(*dns.HINFO)
+	if !ok {
+		t.Fatalf("answer = %v, want HINFO", resp.Answer[0])
+	}
+	if hinfo.Hdr.Name != "www.test.lan." || hinfo.Hdr.Class != dns.ClassINET || hinfo.Hdr.Ttl != anyHINFOTTL || hinfo.Cpu != "RFC8482" {
+		t.Errorf("HINFO = %v, want owner www.test.lan., class IN, TTL %d and CPU RFC8482", hinfo, anyHINFOTTL)
+	}
+	if _, err := resp.Pack(); err != nil {
+		t.Errorf("response does not pack: %v", err)
+	}
+	if forwarded := atomic.LoadUint64(&s.stats.upstreams[0].succeeded); forwarded != 0 {
+		t.Errorf("forwarded %d queries, want the ANY query answered locally", forwarded)
+	}
+}
+
+func TestAnyModeRefuse(t *testing.T) {
+	s := newTestServer(t, &Config{AnyMode: anyModeRefuse})
+	resp := testQuery(t, s, "www.test.lan", dns.TypeANY)
+	if resp.Rcode != dns.RcodeRefused || len(resp.Answer) != 0 {
+		t.Errorf("rcode = %s, %d answers, want REFUSED", dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+}
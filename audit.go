@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Audit sink tuning
+const (
+	auditQueueSize    = 4096             // Events buffered while the collector is slow or unreachable
+	auditDialTimeout  = 5 * time.Second  // Timeout of each connection attempt
+	auditWriteTimeout = 5 * time.Second  // A collector that accepts no data for this long is reconnected
+	auditMinBackoff   = time.Second      // First reconnect delay
+	auditMaxBackoff   = 60 * time.Second // Reconnect delays double up to this
+)
+
+// auditEvent is a block or overwrite decision, sent to audit_sink as one JSON line.
+type auditEvent struct {
+	Time     string `json:"time"`
+	Seq      uint64 `json:"seq"`              // Increases by one per event; a gap means events were dropped
+	Action   string `json:"action"`           // "block" or "overwrite"
+	Client   string `json:"client,omitempty"` // Empty for decisions on upstream answers shared by clients
+	Domain   string `json:"domain"`
+	QType    string `json:"qtype"`
+	Matched  string `json:"matched,omitempty"` // Blocked name, suffix or address range that matched
+	Source   string `json:"source,omitempty"`  // Block list, database or setting of the rule
+	Category string `json:"category,omitempty"`
+	Answer   string `json:"answer,omitempty"` // Overwrite address
+}
+
+// auditSink streams decision events to a collector over TCP or a Unix socket.
+// Recording never blocks: events are queued and dropped (and counted) when the queue is full.
+type auditSink struct {
+	network string
+	address string
+	events  chan []byte
+	seq     uint64
+	dropped uint64
+}
+
+// parseAuditSink parses audit_sink, "tcp://host:port" or "unix:///path/to/socket".
+func parseAuditSink(value string) (network, address string, err error) {
+	scheme, rest, ok := strings.Cut(value, "://")
+	if !ok || rest == "" {
+		return "", "", fmt.Errorf("invalid audit_sink %q (expected tcp://host:port or unix:///path)", value)
+	}
+	switch scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(rest); err != nil {
+			return "", "", fmt.Errorf("invalid audit_sink %q: %w", value, err)
+		}
+	case "unix":
+	default:
+		return "", "", fmt.Errorf("unsupported audit_sink scheme %q (expected tcp or unix)", scheme)
+	}
+	return scheme, rest, nil
+}
+
+// newAuditSink creates the sink for audit_sink (nil when not configured).
+func newAuditSink(value string) (*auditSink, error) {
+	if value == "" {
+		return nil, nil
+	}
+	network, address, err := parseAuditSink(value)
+	if err != nil {
+		return nil, err
+	}
+	return &auditSink{network: network, address: address, events: make(chan []byte, auditQueueSize)}, nil
+}
+
+// record queues an event for the collector, or counts it as dropped if the queue is full.
+func (a *auditSink) record(event auditEvent) {
+	if a == nil {
+		return
+	}
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	event.Seq = atomic.AddUint64(&a.seq, 1)
+	line, err := json.Marshal(event)
+	if err != nil {
+		atomic.AddUint64(&a.dropped, 1)
+		return
+	}
+	select {
+	case a.events <- append(line, '\n'):
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// droppedEvents returns the number of events that never reached the collector.
+func (a *auditSink) droppedEvents() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// start connects to the collector and sends queued events until done is closed,
+// reconnecting with exponential backoff. An event whose write fails is dropped.
+func (a *auditSink) start(done <-chan struct{}) {
+	go func() {
+		var conn net.Conn
+		defer func() {
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}()
+		backoff := auditMinBackoff
+		connected := true // Only the first failure of an outage is logged
+		for {
+			var line []byte
+			select {
+			case <-done:
+				return
+			case line = <-a.events:
+			}
+			for conn == nil {
+				var err error
+				conn, err = net.DialTimeout(a.network, a.address, auditDialTimeout)
+				if err == nil {
+					log.Printf("Audit sink connected to %s://%s", a.network, a.address)
+					backoff, connected = auditMinBackoff, true
+					break
+				}
+				if connected {
+					log.Printf("Warning: audit sink %s://%s unreachable, retrying: %v", a.network, a.address, err)
+					connected = false
+				}
+				select {
+				case <-done:
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, auditMaxBackoff)
+			}
+
+			if err := conn.SetWriteDeadline(time.Now().Add(auditWriteTimeout)); err == nil {
+				_, err = conn.Write(line)
+				if err == nil {
+					continue
+				}
+			}
+			atomic.AddUint64(&a.dropped, 1)
+			_ = conn.Close()
+			conn = nil
+		}
+	}()
+}
+
+// auditBlock records a block decision with audit_sink (if configured).
+func (s *DNSServer) auditBlock(r *dns.Msg, clientIP net.IP, matched string, entry *BlockEntry) {
+	if s.auditSink == nil {
+		return
+	}
+	s.auditSink.record(auditEvent{
+		Action:   "block",
+		Client:   auditClient(clientIP),
+		Domain:   normalizeDomain(r.Question[0].Name),
+		QType:    dns.TypeToString[r.Question[0].Qtype],
+		Matched:  matched,
+		Source:   entry.Source,
+		Category: entry.Category,
+	})
+}
+
+// auditOverwrite records an overwrite decision with audit_sink (if configured).
+func (s *DNSServer) auditOverwrite(r *dns.Msg, clientIP net.IP, answer string) {
+	if s.auditSink == nil {
+		return
+	}
+	s.auditSink.record(auditEvent{
+		Action: "overwrite",
+		Client: auditClient(clientIP),
+		Domain: normalizeDomain(r.Question[0].Name),
+		QType:  dns.TypeToString[r.Question[0].Qtype],
+		Answer: answer,
+	})
+}
+
+// auditClient formats a client address for audit events ("" when unknown).
+func auditClient(clientIP net.IP) string {
+	if clientIP == nil {
+		return ""
+	}
+	return clientIP.String()
+}
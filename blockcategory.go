@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// uncategorizedCategory labels blocks from lists without a category.
+const uncategorizedCategory = "uncategorized"
+
+// blockCategoryReportInterval is how often block counts per category are logged.
+const blockCategoryReportInterval = time.Hour
+
+// blockCategories interns block list category labels and counts blocks per category.
+type blockCategories struct {
+	mu     sync.Mutex
+	names  map[string]string // Interned category names, so entries share one string
+	counts sync.Map          // Category -> *uint64 blocks since startup
+}
+
+// blockCategoryCount is the number of blocks in one category.
+type blockCategoryCount struct {
+	category string
+	count    uint64
+}
+
+// intern returns the shared copy of a category name, defaulting to "uncategorized".
+func (c *blockCategories) intern(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return uncategorizedCategory
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.names == nil {
+		c.names = make(map[string]string)
+	}
+	if interned, ok := c.names[name]; ok {
+		return interned
+	}
+	c.names[name] = name
+	return name
+}
+
+// record counts a block in the given category.
+func (c *blockCategories) record(category string) {
+	if category == "" {
+		category = uncategorizedCategory
+	}
+	counter, ok := c.counts.Load(category)
+	if !ok {
+		counter, _ = c.counts.LoadOrStore(category, new(uint64))
+	}
+	atomic.AddUint64(counter.(*uint64), 1)
+}
+
+// snapshot returns the block counts since startup, sorted by category.
+func (c *blockCategories) snapshot() []blockCategoryCount {
+	var counts []blockCategoryCount
+	c.counts.Range(func(key, value interface{}) bool {
+		counts = append(counts, blockCategoryCount{category: key.(string), count: atomic.LoadUint64(value.(*uint64))})
+		return true
+	})
+	sort.Slice(counts, func(i, j int) bool { return counts[i].category < counts[j].category })
+	return counts
+}
+
+// summary returns "category=count" pairs for the block counts since startup.
+func (c *blockCategories) summary() string {
+	return formatBlockCategoryCounts(c.snapshot(), nil)
+}
+
+// formatBlockCategoryCounts returns "category=count" pairs for the categories with blocks,
+// less the counts in previous (nil for none).
+func formatBlockCategoryCounts(counts []blockCategoryCount, previous map[string]uint64) string {
+	var parts []string
+	for _, c := range counts {
+		if n := c.count - previous[c.category]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", c.category, n))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// startBlockCategoryReporter periodically logs block counts per category when log_blocks is enabled.
+// The counts themselves are kept regardless, for the stats and metrics.
+func (s *DNSServer) startBlockCategoryReporter() {
+	if !s.config.LogBlocks || s.config.Mode == modeResolver {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(blockCategoryReportInterval)
+		defer ticker.Stop()
+
+		reported := make(map[string]uint64)
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			counts := s.blockCategories.snapshot()
+			if summary := formatBlockCategoryCounts(counts, reported); summary != "" {
+				log.Printf("Blocks by category in the last hour: %s", summary)
+			}
+			for _, c := range counts {
+				reported[c.category] = c.count
+			}
+		}
+	}()
+}
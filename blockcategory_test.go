@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockCategoriesCounted(t *testing.T) {
+	s := newTestServer(t, &Config{
+		BlockLists: []interface{}{map[string]interface{}{
+			"file":     writeTestFile(t, "hosts.txt", "0.0.0.0 ads.test.lan\n"),
+			"category": "ads",
+		}},
+	})
+	testQuery(t, s, "ads.test.lan", dns.TypeA)
+	testQuery(t, s, "ads.test.lan", dns.TypeAAAA)
+
+	// Counts are cumulative: reading them does not reset them
+	for i := 0; i < 2; i++ {
+		if summary := strings.Join(s.statsSummary(), "\n"); !strings.Contains(summary, "blocks by category: ads=2") {
+			t.Errorf("stats summary does not count the blocks:\n%s", summary)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `godns_blocked_total{category="ads"} 2`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics do not contain %s", want)
+	}
+}
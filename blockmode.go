@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// blockModes selects how blocked queries are answered, per query type.
+type blockModes struct {
+	byQtype  map[uint16]string
+	fallback string // Mode for query types not listed
+}
+
+// modeFor returns the block mode for a query type.
+func (b blockModes) modeFor(qtype uint16) string {
+	if mode, ok := b.byQtype[qtype]; ok {
+		return mode
+	}
+	if b.fallback == "" {
+		return blockModeNXDOMAIN
+	}
+	return b.fallback
+}
+
+// parseBlockModes parses block_mode: either a single mode for all query types,
+// or a map from query type (or "*" for all others) to mode.
+func parseBlockModes(value interface{}) (blockModes, error) {
+	modes := blockModes{byQtype: make(map[uint16]string), fallback: blockModeNXDOMAIN}
+
+	switch v := value.(type) {
+	case nil:
+		return modes, nil
+	case string:
+		mode, err := parseBlockMode(v)
+		if err != nil {
+			return modes, err
+		}
+		modes.fallback = mode
+	case map[string]interface{}:
+		for qtypeName, modeValue := range v {
+			modeName, ok := modeValue.(string)
+			if !ok {
+				return modes, fmt.Errorf("invalid mode for %s: expected a string", qtypeName)
+			}
+			mode, err := parseBlockMode(modeName)
+			if err != nil {
+				return modes, err
+			}
+			if qtypeName == "*" {
+				modes.fallback = mode
+				continue
+			}
+			qtype, ok := dns.StringToType[strings.ToUpper(qtypeName)]
+			if !ok {
+				return modes, fmt.Errorf("unknown query type %q", qtypeName)
+			}
+			modes.byQtype[qtype] = mode
+		}
+	default:
+		return modes, fmt.Errorf("expected a mode or a map of query type to mode")
+	}
+	return modes, nil
+}
+
+// parseBlockMode validates a single block mode name or sinkhole IP address.
+func parseBlockMode(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case blockModeNXDOMAIN, blockModeNODATA, blockModeRefused, blockModeZeroIP:
+		return mode, nil
+	}
+	if ip := net.ParseIP(mode); ip != nil {
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("unknown block mode %q (valid modes: %s, %s, %s, %s or an IP address)",
+		mode, blockModeNXDOMAIN, blockModeNODATA, blockModeRefused, blockModeZeroIP)
+}
+
+// createBlockedResponse builds the answer for a blocked query according to block_mode.
+func (s *DNSServer) createBlockedResponse(r *dns.Msg, reason string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	msg.RecursionAvailable = true
+
+	switch mode := s.blockModes.modeFor(r.Question[0].Qtype); mode {
+	case blockModeNODATA:
+		// Empty NOERROR answer
+	case blockModeRefused:
+		msg.Authoritative = false
+		msg.SetRcode(r, dns.RcodeRefused)
+	case blockModeZeroIP:
+		sinkhole := net.IPv4zero
+		if r.Question[0].Qtype == dns.TypeAAAA {
+			sinkhole = net.IPv6zero
+		}
+		if rr := overwriteRecord(r.Question[0], sinkhole, sinkholeTTL); rr != nil {
+			msg.Answer = append(msg.Answer, rr)
+		}
+	default:
+		// A sinkhole IP answers queries for its address family, with NODATA for other types
+		if sinkhole := net.ParseIP(mode); sinkhole != nil {
+			if rr := overwriteRecord(r.Question[0], sinkhole, sinkholeTTL); rr != nil {
+				msg.Answer = append(msg.Answer, rr)
+			}
+			break
+		}
+		msg.SetRcode(r, dns.RcodeNameError)
+	}
+	s.addExtendedError(msg, r, dns.ExtendedErrorCodeFiltered, reason)
+	return msg
+}
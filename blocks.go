@@ -5,20 +5,35 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
+// blockListLoad is a block list read at startup. Lists are read in parallel and published
+// in config order, so a domain listed twice still gets the entry of the later list.
+type blockListLoad struct {
+	path         string
+	restrictions *BlockEntry
+	source       string
+	entries      map[string]*BlockEntry
+	patterns     []regexBlock
+	err          error
+}
+
 // loadBlockLists loads adblock-style host files with per-file IP/subnet restrictions.
 func (s *DNSServer) loadBlockLists() error {
 	if s.config.BlockLists == nil {
 		return nil
 	}
 
+	var loads []*blockListLoad
 	switch blockLists := s.config.BlockLists.(type) {
 	case []interface{}:
 		// New format: can contain strings (file paths) or maps (file with restrictions)
@@ -26,42 +41,65 @@ func (s *DNSServer) loadBlockLists() error {
 			switch v := item.(type) {
 			case string:
 				// Simple file path - load from file with no restrictions
-				if err := s.loadBlockListFile(v, nil); err != nil {
-					log.Printf("Warning: failed to load block list %s: %v", v, err)
-					// Continue loading other files even if one fails
-				}
+				loads = append(loads, &blockListLoad{path: v})
 			case map[string]interface{}:
 				// File entry with restrictions
-				if err := s.loadBlockListFileWithRestrictions(v); err != nil {
+				filePath, restrictions, err := s.parseBlockListRestrictions(v)
+				if err != nil {
 					log.Printf("Warning: failed to load block list entry: %v", err)
+					continue
 				}
+				loads = append(loads, &blockListLoad{path: filePath, restrictions: restrictions})
 			case map[interface{}]interface{}:
 				// File entry with restrictions (fallback)
-				if err := s.loadBlockListFileWithRestrictionsMap(v); err != nil {
+				filePath, restrictions, err := s.parseBlockListRestrictionsMap(v)
+				if err != nil {
 					log.Printf("Warning: failed to load block list entry: %v", err)
+					continue
 				}
+				loads = append(loads, &blockListLoad{path: filePath, restrictions: restrictions})
 			}
 		}
 	case []string:
 		// Old format: array of file paths (no restrictions)
 		for _, filePath := range blockLists {
-			if err := s.loadBlockListFile(filePath, nil); err != nil {
-				log.Printf("Warning: failed to load block list %s: %v", filePath, err)
-				// Continue loading other files even if one fails
-			}
+			loads = append(loads, &blockListLoad{path: filePath})
 		}
 	default:
 		return fmt.Errorf("invalid block_lists format")
 	}
 
+	// Read in parallel, URL downloads bounded by max_concurrent_downloads
+	var wg sync.WaitGroup
+	for _, load := range loads {
+		wg.Add(1)
+		go func(load *blockListLoad) {
+			defer wg.Done()
+			load.source, load.entries, load.patterns, load.err = s.readBlockListFile(load.path, load.restrictions)
+		}(load)
+	}
+	wg.Wait()
+
+	for _, load := range loads {
+		// URL lists that failed are still reloaded every reload_interval
+		if isURL(load.path) {
+			s.trackURLBlockList(load.path, load.restrictions)
+		}
+		if load.err != nil {
+			log.Printf("Warning: failed to load block list %s: %v", load.path, load.err)
+			// Continue loading other files even if one fails
+			continue
+		}
+		s.publishBlockList(load.source, load.entries, load.patterns, load.restrictions)
+	}
 	return nil
 }
 
-// loadBlockListFileWithRestrictions loads a file with IP/subnet restrictions.
-func (s *DNSServer) loadBlockListFileWithRestrictions(entry map[string]interface{}) error {
+// parseBlockListRestrictions returns the file and IP/subnet restrictions of a block list entry.
+func (s *DNSServer) parseBlockListRestrictions(entry map[string]interface{}) (string, *BlockEntry, error) {
 	filePath, ok := entry["file"].(string)
 	if !ok {
-		return fmt.Errorf("missing 'file' field in block list entry")
+		return "", nil, fmt.Errorf("missing 'file' field in block list entry")
 	}
 
 	// Parse restrictions
@@ -71,7 +109,7 @@ func (s *DNSServer) loadBlockListFileWithRestrictions(entry map[string]interface
 			if subnet, ok := subnetStr.(string); ok {
 				ipNet, err := parseSubnet(subnet)
 				if err != nil {
-					return fmt.Errorf("invalid subnet %s: %w", subnet, err)
+					return "", nil, fmt.Errorf("invalid subnet %s: %w", subnet, err)
 				}
 				restrictions.Subnets = append(restrictions.Subnets, ipNet)
 			}
@@ -89,15 +127,27 @@ func (s *DNSServer) loadBlockListFileWithRestrictions(entry map[string]interface
 		}
 	}
 
-	// Load file with restrictions
-	return s.loadBlockListFile(filePath, restrictions)
+	if macs, ok := entry["macs"].([]interface{}); ok {
+		macList, err := parseMACs(macs)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid MAC in block list entry %s: %w", filePath, err)
+		}
+		restrictions.MACs = macList
+		s.macRulesEnabled = true
+	}
+
+	category, _ := entry["category"].(string)
+	restrictions.Category = s.blockCategories.intern(category)
+	restrictions.ExactOnly, _ = entry["exact_only"].(bool)
+
+	return filePath, restrictions, nil
 }
 
-// loadBlockListFileWithRestrictionsMap loads a file with IP/subnet restrictions (fallback).
-func (s *DNSServer) loadBlockListFileWithRestrictionsMap(entry map[interface{}]interface{}) error {
+// parseBlockListRestrictionsMap returns the file and IP/subnet restrictions of a block list entry (fallback).
+func (s *DNSServer) parseBlockListRestrictionsMap(entry map[interface{}]interface{}) (string, *BlockEntry, error) {
 	filePath, ok := entry["file"].(string)
 	if !ok {
-		return fmt.Errorf("missing 'file' field in block list entry")
+		return "", nil, fmt.Errorf("missing 'file' field in block list entry")
 	}
 
 	// Parse restrictions
@@ -107,7 +157,7 @@ func (s *DNSServer) loadBlockListFileWithRestrictionsMap(entry map[interface{}]i
 			if subnet, ok := subnetStr.(string); ok {
 				ipNet, err := parseSubnet(subnet)
 				if err != nil {
-					return fmt.Errorf("invalid subnet %s: %w", subnet, err)
+					return "", nil, fmt.Errorf("invalid subnet %s: %w", subnet, err)
 				}
 				restrictions.Subnets = append(restrictions.Subnets, ipNet)
 			}
@@ -125,19 +175,34 @@ func (s *DNSServer) loadBlockListFileWithRestrictionsMap(entry map[interface{}]i
 		}
 	}
 
-	// Load file with restrictions
-	return s.loadBlockListFile(filePath, restrictions)
+	if macs, ok := entry["macs"].([]interface{}); ok {
+		macList, err := parseMACs(macs)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid MAC in block list entry %s: %w", filePath, err)
+		}
+		restrictions.MACs = macList
+		s.macRulesEnabled = true
+	}
+
+	category, _ := entry["category"].(string)
+	restrictions.Category = s.blockCategories.intern(category)
+	restrictions.ExactOnly, _ = entry["exact_only"].(bool)
+
+	return filePath, restrictions, nil
 }
 
-// loadBlockListFile loads a single adblock-style host file or URL with optional restrictions.
-// The function ensures proper resource cleanup via defer, which executes on both success
-// and error paths, including any errors returned by processBlockListReader.
-func (s *DNSServer) loadBlockListFile(filePath string, restrictions *BlockEntry) error {
-	reader, sourceName, closer, err := s.getBlockListReader(filePath, restrictions)
+// readBlockListFile reads a single adblock-style host file or URL with optional restrictions,
+// without publishing it. The reader/connection is closed on all return paths.
+func (s *DNSServer) readBlockListFile(filePath string, restrictions *BlockEntry) (string, map[string]*BlockEntry, []regexBlock, error) {
+	if isURL(filePath) {
+		s.acquireDownloadSlot()
+		defer s.releaseDownloadSlot()
+	}
+
+	reader, sourceName, closer, err := s.getBlockListReader(filePath)
 	if err != nil {
-		return err
+		return "", nil, nil, err
 	}
-	// Defer ensures the reader/connection is closed on all return paths (success or error).
 	defer func() {
 		if closer != nil {
 			if closeErr := closer.Close(); closeErr != nil {
@@ -146,19 +211,20 @@ func (s *DNSServer) loadBlockListFile(filePath string, restrictions *BlockEntry)
 		}
 	}()
 
-	return s.processBlockListReader(reader, sourceName, restrictions)
+	entries, patterns, err := s.scanBlockList(reader, sourceName, restrictions)
+	return sourceName, entries, patterns, err
 }
 
 // getBlockListReader returns a reader for a block list file or URL.
-func (s *DNSServer) getBlockListReader(filePath string, restrictions *BlockEntry) (io.Reader, string, io.Closer, error) {
+func (s *DNSServer) getBlockListReader(filePath string) (io.Reader, string, io.Closer, error) {
 	if isURL(filePath) {
-		return s.getURLReader(filePath, restrictions)
+		return s.getURLReader(filePath)
 	}
 	return s.getFileReader(filePath)
 }
 
 // getURLReader downloads a block list from a URL and returns a reader.
-func (s *DNSServer) getURLReader(filePath string, restrictions *BlockEntry) (io.Reader, string, io.Closer, error) {
+func (s *DNSServer) getURLReader(filePath string) (io.Reader, string, io.Closer, error) {
 	resp, err := s.httpClient.Get(filePath)
 	if err != nil {
 		return nil, "", nil, fmt.Errorf("failed to download %s: %w", filePath, err)
@@ -171,9 +237,6 @@ func (s *DNSServer) getURLReader(filePath string, restrictions *BlockEntry) (io.
 		return nil, "", nil, fmt.Errorf("failed to download %s: HTTP %d", filePath, resp.StatusCode)
 	}
 
-	// Track URL-based block lists for periodic reloading (only if not already tracked)
-	s.trackURLBlockList(filePath, restrictions)
-
 	return resp.Body, filePath, resp.Body, nil
 }
 
@@ -190,11 +253,15 @@ func (s *DNSServer) trackURLBlockList(filePath string, restrictions *BlockEntry)
 	// Add new URL to tracking list
 	if restrictions != nil {
 		restrictionsCopy := &BlockEntry{
-			Subnets: make([]*net.IPNet, len(restrictions.Subnets)),
-			IPs:     make([]net.IP, len(restrictions.IPs)),
+			Subnets:   make([]*net.IPNet, len(restrictions.Subnets)),
+			IPs:       make([]net.IP, len(restrictions.IPs)),
+			MACs:      make([]net.HardwareAddr, len(restrictions.MACs)),
+			Category:  restrictions.Category,
+			ExactOnly: restrictions.ExactOnly,
 		}
 		copy(restrictionsCopy.Subnets, restrictions.Subnets)
 		copy(restrictionsCopy.IPs, restrictions.IPs)
+		copy(restrictionsCopy.MACs, restrictions.MACs)
 		s.urlBlockLists = append(s.urlBlockLists, URLBlockList{
 			URL:          filePath,
 			Restrictions: restrictionsCopy,
@@ -217,12 +284,26 @@ func (s *DNSServer) getFileReader(filePath string) (io.Reader, string, io.Closer
 	return file, cleanPath, file, nil
 }
 
-// processBlockListReader processes a block list from a reader.
-// Note: The caller is responsible for closing the reader. This function does not close it.
-func (s *DNSServer) processBlockListReader(reader io.Reader, sourceName string, restrictions *BlockEntry) error {
+// publishBlockList publishes the domains and patterns of a block list at once.
+func (s *DNSServer) publishBlockList(sourceName string, entries map[string]*BlockEntry, patterns []regexBlock, restrictions *BlockEntry) {
+	s.addBlockedDomains(entries)
+	s.setRegexBlocks(sourceName, patterns)
+	s.logBlockListLoaded(sourceName, len(entries), restrictions)
+	if len(patterns) > 0 {
+		log.Printf("Loaded %d patterns from %s", len(patterns), sourceName)
+	}
+}
+
+// scanBlockList reads the domains and "regex:" patterns of a block list. Published entries
+// are never modified, so all domains of the list share one entry. Domains are copied out of
+// their line and not added to the domain cache, so a large list holds little more than its names.
+// Invalid patterns are logged and skipped.
+func (s *DNSServer) scanBlockList(reader io.Reader, sourceName string, restrictions *BlockEntry) (map[string]*BlockEntry, []regexBlock, error) {
 	scanner := bufio.NewScanner(reader)
+	entry := newBlockEntry(sourceName, restrictions)
+	entries := make(map[string]*BlockEntry)
+	var patterns []regexBlock
 	lineNum := 0
-	loadedCount := 0
 
 	for scanner.Scan() {
 		lineNum++
@@ -233,38 +314,80 @@ func (s *DNSServer) processBlockListReader(reader io.Reader, sourceName string,
 			continue
 		}
 
-		domain := s.parseHostLine(line)
-		if domain != "" {
-			s.addBlockedDomain(domain, restrictions)
-			loadedCount++
+		if pattern, ok := strings.CutPrefix(line, regexBlockPrefix); ok {
+			re, err := regexp.Compile(strings.TrimSpace(pattern))
+			if err != nil {
+				log.Printf("Warning: skipping invalid pattern in %s at line %d: %v", sourceName, lineNum, err)
+				continue
+			}
+			patterns = append(patterns, regexBlock{re: re, entry: entry})
+			continue
+		}
+
+		if domain := s.parseHostLine(line); domain != "" {
+			entries[normalizeListDomain(domain)] = entry
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading %s at line %d: %w", sourceName, lineNum, err)
+		return nil, nil, fmt.Errorf("error reading %s at line %d: %w", sourceName, lineNum, err)
 	}
+	return entries, patterns, nil
+}
 
-	s.logBlockListLoaded(sourceName, loadedCount, restrictions)
-	return nil
+// normalizeListDomain normalizes a block list domain like normalizeDomain, without going
+// through the domain cache, and copies it so the rest of its line can be freed.
+func normalizeListDomain(domain string) string {
+	return strings.Clone(strings.TrimSuffix(strings.ToLower(domain), "."))
 }
 
-// addBlockedDomain adds a domain to the blocked list with optional restrictions.
-func (s *DNSServer) addBlockedDomain(domain string, restrictions *BlockEntry) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// newBlockEntry creates the entry for a domain from a block list source with optional restrictions.
+func newBlockEntry(source string, restrictions *BlockEntry) *BlockEntry {
+	if restrictions == nil {
+		return &BlockEntry{Category: uncategorizedCategory, Source: source}
+	}
+	entry := &BlockEntry{
+		Subnets:   make([]*net.IPNet, len(restrictions.Subnets)),
+		IPs:       make([]net.IP, len(restrictions.IPs)),
+		MACs:      make([]net.HardwareAddr, len(restrictions.MACs)),
+		Category:  restrictions.Category,
+		Source:    source,
+		ExactOnly: restrictions.ExactOnly,
+	}
+	copy(entry.Subnets, restrictions.Subnets)
+	copy(entry.IPs, restrictions.IPs)
+	copy(entry.MACs, restrictions.MACs)
+	return entry
+}
 
-	domain = normalizeDomain(domain)
-	if restrictions != nil {
-		entry := &BlockEntry{
-			Subnets: make([]*net.IPNet, len(restrictions.Subnets)),
-			IPs:     make([]net.IP, len(restrictions.IPs)),
-		}
-		copy(entry.Subnets, restrictions.Subnets)
-		copy(entry.IPs, restrictions.IPs)
-		s.blocked[domain] = entry
-	} else {
-		s.blocked[domain] = &BlockEntry{}
+// blockedDomains returns the current snapshot of blocked domains. The snapshot is never
+// modified, so it can be read without holding any lock.
+func (s *DNSServer) blockedDomains() map[string]*BlockEntry {
+	if blocked := s.blocked.Load(); blocked != nil {
+		return *blocked
 	}
+	return nil
+}
+
+// updateBlocked applies a change to a copy of the blocked domains and publishes the copy,
+// so concurrent queries see the set either before or after the change, never halfway.
+// The copy has room for growth more entries, so adding a large list doesn't rehash it repeatedly.
+func (s *DNSServer) updateBlocked(growth int, update func(blocked map[string]*BlockEntry)) {
+	s.blockedMu.Lock()
+	defer s.blockedMu.Unlock()
+
+	current := s.blockedDomains()
+	next := make(map[string]*BlockEntry, len(current)+growth)
+	maps.Copy(next, current)
+	update(next)
+	s.blocked.Store(&next)
+}
+
+// addBlockedDomains adds the domains of a loaded block list, replacing existing entries.
+func (s *DNSServer) addBlockedDomains(entries map[string]*BlockEntry) {
+	s.updateBlocked(len(entries), func(blocked map[string]*BlockEntry) {
+		maps.Copy(blocked, entries)
+	})
 }
 
 // logBlockListLoaded logs the loading of a block list file with optional restrictions.
@@ -285,6 +408,16 @@ func (s *DNSServer) logBlockListLoaded(filePath string, count int, restrictions
 			}
 			restrictionStr += fmt.Sprintf(" (subnets: %v)", subnets)
 		}
+		if len(restrictions.MACs) > 0 {
+			macs := make([]string, len(restrictions.MACs))
+			for i, mac := range restrictions.MACs {
+				macs[i] = mac.String()
+			}
+			restrictionStr += fmt.Sprintf(" (MACs: %v)", macs)
+		}
+		if restrictions.Category != "" && restrictions.Category != uncategorizedCategory {
+			restrictionStr += fmt.Sprintf(" (category: %s)", restrictions.Category)
+		}
 		log.Printf("Loaded %d domains from %s%s", count, filePath, restrictionStr)
 	} else {
 		log.Printf("Loaded %d domains from %s", count, filePath)
@@ -324,15 +457,16 @@ func (s *DNSServer) parseHostLine(line string) string {
 	return domain
 }
 
-// isBlocked checks if a domain is blocked for the given client IP.
-func (s *DNSServer) isBlocked(domain string, clientIP net.IP) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// matchBlock returns the block entry that blocks a domain for the given client IP or MAC,
+// and the blocked name it was found under (the domain itself or a parent), or nil.
+func (s *DNSServer) matchBlock(domain string, clientIP net.IP, clientMAC net.HardwareAddr) (*BlockEntry, string) {
+	// Domain entries come from a lock-free snapshot, since this runs on every query
+	blocked := s.blockedDomains()
 
 	// Check exact match first (most common case)
-	if entry, exists := s.blocked[domain]; exists {
-		if s.matchesBlockEntry(entry, clientIP) {
-			return true
+	if entry, exists := blocked[domain]; exists {
+		if s.matchesBlockEntry(entry, clientIP, clientMAC) {
+			return entry, domain
 		}
 	}
 
@@ -341,21 +475,34 @@ func (s *DNSServer) isBlocked(domain string, clientIP net.IP) bool {
 	for i := 0; i < len(domain); i++ {
 		if domain[i] == '.' && i+1 < len(domain) {
 			parentDomain := domain[i+1:]
-			if entry, exists := s.blocked[parentDomain]; exists {
-				if s.matchesBlockEntry(entry, clientIP) {
-					return true
+			if entry, exists := blocked[parentDomain]; exists && !entry.ExactOnly {
+				if s.matchesBlockEntry(entry, clientIP, clientMAC) {
+					return entry, parentDomain
 				}
 			}
 		}
 	}
 
-	return false
+	// TLD and suffix rules apply when no domain entry matched, then patterns
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.blockTLDs) > 0 {
+		if entry, suffix := s.matchBlockTLD(domain, clientIP, clientMAC); entry != nil {
+			return entry, suffix
+		}
+	}
+	return s.matchRegexBlockLocked(domain, clientIP, clientMAC)
 }
 
-// matchesBlockEntry checks if a block entry applies to the given client IP.
-func (s *DNSServer) matchesBlockEntry(entry *BlockEntry, clientIP net.IP) bool {
+// matchesBlockEntry checks if a block entry applies to the given client IP or MAC.
+func (s *DNSServer) matchesBlockEntry(entry *BlockEntry, clientIP net.IP, clientMAC net.HardwareAddr) bool {
 	// If no restrictions, block for all clients
-	if len(entry.Subnets) == 0 && len(entry.IPs) == 0 {
+	if len(entry.Subnets) == 0 && len(entry.IPs) == 0 && len(entry.MACs) == 0 {
+		return true
+	}
+
+	// Check if client MAC matches any specific MAC
+	if containsMAC(entry.MACs, clientMAC) {
 		return true
 	}
 
@@ -384,6 +531,9 @@ func (s *DNSServer) matchesBlockEntry(entry *BlockEntry, clientIP net.IP) bool {
 
 // reloadURLBlockList reloads a single URL-based block list.
 func (s *DNSServer) reloadURLBlockList(urlBlockList URLBlockList) error {
+	s.acquireDownloadSlot()
+	defer s.releaseDownloadSlot()
+
 	// Download directly without tracking (already tracked)
 	resp, err := s.httpClient.Get(urlBlockList.URL)
 	if err != nil {
@@ -403,50 +553,55 @@ func (s *DNSServer) reloadURLBlockList(urlBlockList URLBlockList) error {
 		}
 	}()
 
-	reader := resp.Body
-
-	scanner := bufio.NewScanner(reader)
-	lineNum := 0
-	loadedCount := 0
-
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
-
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-
-		domain := s.parseHostLine(line)
-		if domain != "" {
-			s.addBlockedDomain(domain, urlBlockList.Restrictions)
-			loadedCount++
-		}
+	entries, patterns, err := s.scanBlockList(resp.Body, urlBlockList.URL, urlBlockList.Restrictions)
+	if err != nil {
+		return err
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading %s at line %d: %w", urlBlockList.URL, lineNum, err)
-	}
+	// Queries see the old list until the reloaded one is published in one swap
+	s.addBlockedDomains(entries)
+	s.setRegexBlocks(urlBlockList.URL, patterns)
 
-	log.Printf("Reloaded %d domains from %s", loadedCount, urlBlockList.URL)
+	log.Printf("Reloaded %d domains and %d patterns from %s", len(entries), len(patterns), urlBlockList.URL)
 	return nil
 }
 
+// acquireDownloadSlot blocks until fewer than max_concurrent_downloads block lists are downloading.
+func (s *DNSServer) acquireDownloadSlot() {
+	s.downloadSlots <- struct{}{}
+}
+
+// releaseDownloadSlot frees a slot taken by acquireDownloadSlot.
+func (s *DNSServer) releaseDownloadSlot() {
+	<-s.downloadSlots
+}
+
 // startBlockListReloader starts a goroutine that periodically reloads URL-based block lists.
 func (s *DNSServer) startBlockListReloader(interval time.Duration) {
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
-		for range ticker.C {
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
 			log.Printf("Reloading URL-based block lists...")
+			// Download in parallel, bounded by max_concurrent_downloads
+			var wg sync.WaitGroup
 			for _, urlBlockList := range s.urlBlockLists {
-				if err := s.reloadURLBlockList(urlBlockList); err != nil {
-					log.Printf("Warning: failed to reload block list %s: %v", urlBlockList.URL, err)
-					// Continue reloading other lists even if one fails
-				}
+				wg.Add(1)
+				go func(urlBlockList URLBlockList) {
+					defer wg.Done()
+					if err := s.reloadURLBlockList(urlBlockList); err != nil {
+						log.Printf("Warning: failed to reload block list %s: %v", urlBlockList.URL, err)
+						// Continue reloading other lists even if one fails
+					}
+				}(urlBlockList)
 			}
+			wg.Wait()
 			log.Printf("Finished reloading URL-based block lists")
 		}
 	}()
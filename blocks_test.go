@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInitialBlockListDownloadsBounded(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			peak := maxInFlight.Load()
+			if n <= peak || maxInFlight.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		_, _ = fmt.Fprintf(w, "0.0.0.0 shared.example\n0.0.0.0 only%s.example\n", r.URL.Path[1:])
+	}))
+	t.Cleanup(srv.Close)
+
+	var lists []interface{}
+	for i := 0; i < 6; i++ {
+		lists = append(lists, map[string]interface{}{
+			"file":     fmt.Sprintf("%s/%d", srv.URL, i),
+			"category": fmt.Sprintf("list%d", i),
+		})
+	}
+	s := newTestServer(t, &Config{BlockLists: lists, MaxConcurrentDownloads: 2})
+
+	if peak := maxInFlight.Load(); peak != 2 {
+		t.Errorf("peak concurrent downloads = %d, want 2", peak)
+	}
+	if len(s.urlBlockLists) != 6 {
+		t.Errorf("%d URL block lists tracked for reloads, want 6", len(s.urlBlockLists))
+	}
+	for i := 0; i < 6; i++ {
+		if entry, _ := s.matchBlock(fmt.Sprintf("only%d.example", i), testClient, nil); entry == nil {
+			t.Errorf("only%d.example not blocked", i)
+		}
+	}
+	// Lists are published in config order, so the last one wins for shared domains
+	if entry, _ := s.matchBlock("shared.example", testClient, nil); entry == nil || entry.Category != "list5" {
+		t.Errorf("shared.example entry = %+v, want the one of the last list", entry)
+	}
+}
+
+// writeTestBlockDB creates a block_db database blocking the given domains.
+func writeTestBlockDB(t *testing.T, domains ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blocks.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	if _, err := db.Exec("CREATE TABLE blocks (domain TEXT PRIMARY KEY, category TEXT, clients TEXT, macs TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range domains {
+		if _, err := db.Exec("INSERT INTO blocks (domain) VALUES (?)", domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestMatchBlockDuringSwaps(t *testing.T) {
+	s := newTestServer(t, &Config{
+		BlockLists: []interface{}{writeTestFile(t, "hosts.txt", "0.0.0.0 list.example\n")},
+		BlockDB:    writeTestBlockDB(t, "db.example"),
+	})
+
+	// Readers must always see both sources: a block_db reload removes and re-adds its
+	// domains, which would show as a gap if the set were updated in place
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, domain := range []string{"list.example", "www.db.example"} {
+					if entry, _ := s.matchBlock(domain, testClient, nil); entry == nil {
+						t.Errorf("%s not blocked during a swap", domain)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	entry := newBlockEntry("swap", nil)
+	for i := 0; i < 50; i++ {
+		s.addBlockedDomains(map[string]*BlockEntry{fmt.Sprintf("swap%d.example", i): entry})
+		if _, err := s.loadBlockDB(); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := len(s.blockedDomains()); got != 52 {
+		t.Errorf("%d blocked domains after the swaps, want 52", got)
+	}
+}
+
+func BenchmarkMatchBlock(b *testing.B) {
+	s := &DNSServer{config: &Config{}}
+	entries := make(map[string]*BlockEntry, 100000)
+	entry := newBlockEntry("bench", nil)
+	for i := 0; i < 100000; i++ {
+		entries[fmt.Sprintf("host%d.ads%d.example", i, i%100)] = entry
+	}
+	s.addBlockedDomains(entries)
+
+	for _, bm := range []struct {
+		name, domain string
+	}{
+		{"exact", "host42.ads42.example"},
+		{"parent", "cdn.host42.ads42.example"},
+		{"miss", "www.example.com"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s.matchBlock(bm.domain, testClient, nil)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkScanBlockList(b *testing.B) {
+	var list bytes.Buffer
+	list.WriteString("# Generated hosts list\n")
+	for i := 0; i < 300000; i++ {
+		fmt.Fprintf(&list, "0.0.0.0 Tracker%d.Ads%d.example.COM\n", i, i%500)
+	}
+	data := list.Bytes()
+	s := &DNSServer{config: &Config{}}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		entries, _, err := s.scanBlockList(bytes.NewReader(data), "bench", nil)
+		if err != nil || len(entries) != 300000 {
+			b.Fatalf("%d entries, error %v", len(entries), err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// blockTLDSource is the source recorded on block_tlds rules, for debug logs and diagnostics.
+const blockTLDSource = "block_tlds"
+
+// parseBlockTLDs parses block_tlds: suffixes such as "zip" or "co.cc", either as plain
+// strings or as maps with a "suffix" and the same restrictions as block list entries.
+// Returns true if any rule matches on MACs.
+func (s *DNSServer) parseBlockTLDs(items []interface{}) (map[string]*BlockEntry, bool, error) {
+	result := make(map[string]*BlockEntry, len(items))
+	hasMACs := false
+	for _, item := range items {
+		var fields map[string]interface{}
+		switch v := item.(type) {
+		case string:
+			fields = map[string]interface{}{"suffix": v}
+		case map[string]interface{}:
+			fields = v
+		case map[interface{}]interface{}:
+			fields = make(map[string]interface{}, len(v))
+			for key, value := range v {
+				if name, ok := key.(string); ok {
+					fields[name] = value
+				}
+			}
+		default:
+			return nil, false, fmt.Errorf("invalid block_tlds entry %v", item)
+		}
+
+		suffixStr, _ := fields["suffix"].(string)
+		suffix := normalizeDomain(suffixStr)
+		if suffix == "" {
+			return nil, false, fmt.Errorf("missing 'suffix' field in block_tlds entry")
+		}
+		if _, ok := dns.IsDomainName(suffix); !ok {
+			return nil, false, fmt.Errorf("invalid block_tlds suffix %q", suffixStr)
+		}
+
+		entry := &BlockEntry{Source: blockTLDSource}
+		subnets, _ := fields["subnets"].([]interface{})
+		var err error
+		if entry.Subnets, err = parseOverwriteSubnets(subnets); err != nil {
+			return nil, false, fmt.Errorf("invalid block_tlds entry %s: %w", suffix, err)
+		}
+		ips, _ := fields["ips"].([]interface{})
+		for _, ipStr := range interfaceStrings(ips) {
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				return nil, false, fmt.Errorf("invalid IP %s in block_tlds entry %s", ipStr, suffix)
+			}
+			entry.IPs = append(entry.IPs, ip)
+		}
+		macs, _ := fields["macs"].([]interface{})
+		if entry.MACs, err = parseMACs(macs); err != nil {
+			return nil, false, fmt.Errorf("invalid MAC in block_tlds entry %s: %w", suffix, err)
+		}
+		hasMACs = hasMACs || len(entry.MACs) > 0
+		category, _ := fields["category"].(string)
+		entry.Category = s.blockCategories.intern(category)
+
+		result[suffix] = entry
+	}
+	return result, hasMACs, nil
+}
+
+// reloadBlockTLDs replaces the block_tlds rules on SIGHUP. Invalid rules keep the previous ones.
+func (s *DNSServer) reloadBlockTLDs(config *Config) {
+	if s.config.Mode == modeResolver {
+		return
+	}
+	blockTLDs, hasMACs, err := s.parseBlockTLDs(config.BlockTLDs)
+	if err != nil {
+		log.Printf("Warning: keeping previous block_tlds: %v", err)
+		return
+	}
+	if hasMACs && !s.macRulesEnabled {
+		log.Printf("Warning: MAC-based block_tlds rules take effect after a restart")
+	}
+
+	s.mu.Lock()
+	s.blockTLDs = blockTLDs
+	s.mu.Unlock()
+}
+
+// matchBlockTLD returns the block_tlds rule for the longest matching suffix of a domain
+// that applies to the client, and the suffix. The caller must hold s.mu.
+func (s *DNSServer) matchBlockTLD(domain string, clientIP net.IP, clientMAC net.HardwareAddr) (*BlockEntry, string) {
+	if entry, exists := s.blockTLDs[domain]; exists && s.matchesBlockEntry(entry, clientIP, clientMAC) {
+		return entry, domain
+	}
+	for i := 0; i < len(domain); i++ {
+		if domain[i] == '.' && i+1 < len(domain) {
+			suffix := domain[i+1:]
+			if entry, exists := s.blockTLDs[suffix]; exists && s.matchesBlockEntry(entry, clientIP, clientMAC) {
+				return entry, suffix
+			}
+		}
+	}
+	return nil, ""
+}
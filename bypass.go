@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// isBypassDomain reports whether a domain or one of its parents is listed in bypass_domains.
+func (s *DNSServer) isBypassDomain(domain string) bool {
+	if len(s.bypassDomains) == 0 {
+		return false
+	}
+	_, found := lookupDomainSuffix(s.bypassDomains, domain)
+	return found
+}
+
+// forwardBypass resolves a bypass domain without any filtering. With bypass_upstream set,
+// the trusted nameservers are tried in order; otherwise the regular nameservers are used.
+func (s *DNSServer) forwardBypass(w dns.ResponseWriter, r *dns.Msg, domain string, clientIP net.IP, view string, trace *queryTrace) {
+	if len(s.bypassNameservers) == 0 {
+		s.forwardRequest(w, r, domain, clientIP, view, trace)
+		return
+	}
+	if s.answerInShadow(w, r) || s.answerInMaintenance(w, r, domain, view, trace) {
+		return
+	}
+
+	upstreamReq, addedOpt := s.withUpstreamEDNS(r)
+	ctx, cancel := context.WithTimeout(withQueryTrace(context.Background(), trace), s.coalesceTimeout())
+	defer cancel()
+	for i, nameserver := range s.bypassNameservers {
+		if nameserver.self {
+			continue
+		}
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, s.attemptTimeout(i, len(s.bypassNameservers)))
+		resp, _, err := s.tryForwardToNameserver(attemptCtx, upstreamReq, nameserver, domain)
+		cancelAttempt()
+		if err != nil {
+			break
+		}
+		if resp == nil {
+			continue
+		}
+		if addedOpt {
+			removeOPT(resp)
+		}
+		s.withoutAddedDNSSEC(r, resp)
+		resp.RecursionAvailable = true
+		trace.setUpstream(nameserver)
+		s.setCachedResponse(r, resp, view)
+		s.sendResponse(w, r, resp)
+		return
+	}
+
+	// Never answer a bypass domain with a synthesized NXDOMAIN - let the client retry
+	s.debugLog("All bypass upstreams failed for %s", domain)
+	s.sendResponse(w, r, s.createServerFailureResponse(r, "bypass upstreams unreachable"))
+}
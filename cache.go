@@ -8,52 +8,103 @@ import (
 	"github.com/miekg/dns"
 )
 
-// getCacheKey generates a cache key from the DNS question.
-func getCacheKey(r *dns.Msg) string {
+// getCacheKey generates a cache key from the DNS question and the client's view.
+// Queries with the DNSSEC OK bit get their own entries, since their answers carry RRSIGs.
+func getCacheKey(r *dns.Msg, view string) string {
 	if len(r.Question) == 0 {
 		return ""
 	}
+	return cacheKeyFor(normalizeDomain(r.Question[0].Name), r, view)
+}
+
+// cacheKeyFor generates the cache key of a query whose domain the caller already normalized.
+func cacheKeyFor(domain string, r *dns.Msg, view string) string {
 	q := r.Question[0]
-	return fmt.Sprintf("%s:%d:%d", normalizeDomain(q.Name), q.Qtype, q.Qclass)
+	key := fmt.Sprintf("%s:%d:%d", domain, q.Qtype, q.Qclass)
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		key += ":do"
+	}
+	if view != "" {
+		key += ":view=" + view
+	}
+	return key
 }
 
-// getCachedResponse retrieves a cached DNS response if it exists and is not expired.
-func (s *DNSServer) getCachedResponse(r *dns.Msg, clientIP net.IP) *dns.Msg {
+// getCachedResponse retrieves a cached DNS response of a view if it exists and is not expired.
+func (s *DNSServer) getCachedResponse(r *dns.Msg, clientIP net.IP, view string) *dns.Msg {
 	// Check if caching is enabled (either positive or negative)
 	if s.config.CacheTTL <= 0 && s.config.NegativeCacheTTL <= 0 {
 		return nil
 	}
 
-	key := getCacheKey(r)
-	if key == "" {
+	if len(r.Question) == 0 {
 		return nil
 	}
 
-	s.cacheMu.RLock()
-	defer s.cacheMu.RUnlock()
+	// Domains on the no_cache list are always forwarded
+	domain := normalizeDomain(r.Question[0].Name)
+	if s.isNoCacheDomain(domain) {
+		return nil
+	}
+	key := cacheKeyFor(domain, r, view)
 
-	entry, exists := s.cache[key]
+	// Answers cached for the query's ECS network come first, then the global entry
+	entry := s.lookupScopedCacheEntry(key, r)
+	exists, scoped := entry != nil, entry != nil
 	if !exists {
-		return nil
+		entry, exists = s.lookupCacheEntry(key)
 	}
 
-	// Check if cache entry is expired
-	if time.Now().After(entry.ExpiresAt) {
-		return nil
+	// On a local miss (or expired entry), consult the shared cache
+	if !exists || time.Now().After(entry.ExpiresAt) {
+		if entry = s.getSharedCacheEntry(key); entry == nil {
+			return nil
+		}
+	} else {
+		s.touchCacheEntry(entry)
 	}
 
-	// Create a copy of the cached message for this request
+	// Create a copy of the cached message for this request, with TTLs counted down
 	cachedMsg := entry.Message.Copy()
+	ageTTLs(cachedMsg, time.Until(entry.ExpiresAt))
 	cachedMsg.Id = r.Id // Use the request ID
 	cachedMsg.Question = r.Question
 	cachedMsg.RecursionDesired = r.RecursionDesired
+	cachedMsg.RecursionAvailable = true
 	cachedMsg.CheckingDisabled = r.CheckingDisabled
+	matchClientEDNS(cachedMsg, r)
+	if scoped {
+		echoECS(cachedMsg, r)
+	}
 
 	// Log cache hit with response type
 	logCacheHit(s, cachedMsg, r, clientIP)
 	return cachedMsg
 }
 
+// isNoCacheDomain checks if a domain (or one of its parents) is on the no_cache list.
+func (s *DNSServer) isNoCacheDomain(domain string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.noCache) == 0 {
+		return false
+	}
+	_, found := lookupDomainSuffix(s.noCache, domain)
+	return found
+}
+
+// forcedCacheTTL returns the force_cache TTL for a domain (or one of its parents).
+func (s *DNSServer) forcedCacheTTL(domain string) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.forceCache) == 0 {
+		return 0, false
+	}
+	return lookupDomainSuffix(s.forceCache, domain)
+}
+
 // isNegativeResponse determines if a DNS response should be cached as negative.
 func isNegativeResponse(resp *dns.Msg) bool {
 	if resp == nil {
@@ -88,23 +139,32 @@ func isNegativeResponse(resp *dns.Msg) bool {
 	return false
 }
 
-// setCachedResponse stores a DNS response in the cache.
-func (s *DNSServer) setCachedResponse(r *dns.Msg, resp *dns.Msg) {
+// setCachedResponse stores a DNS response in the cache of a view.
+func (s *DNSServer) setCachedResponse(r *dns.Msg, resp *dns.Msg, view string) {
 	if resp == nil {
 		return
 	}
 
-	key := getCacheKey(r)
-	if key == "" {
+	if len(r.Question) == 0 {
 		return
 	}
 
+	// Domains on the no_cache list are never cached
+	domain := normalizeDomain(r.Question[0].Name)
+	if s.isNoCacheDomain(domain) {
+		return
+	}
+	key := cacheKeyFor(domain, r, view)
+
 	// Validate response matches query
 	if !validateResponse(r, resp) {
-		s.debugLog("Response validation failed for %s, not caching", normalizeDomain(r.Question[0].Name))
+		s.debugLog("Response validation failed for %s, not caching", domain)
 		return
 	}
 
+	// Answers for a narrower ECS scope than all networks are cached for that network only
+	key = s.scopedCacheKey(key, r, resp)
+
 	// Handle all negative response types
 	if isNegativeResponse(resp) {
 		s.cacheNegativeResponse(r, resp, key)
@@ -112,7 +172,7 @@ func (s *DNSServer) setCachedResponse(r *dns.Msg, resp *dns.Msg) {
 	}
 
 	// Handle successful responses with answers
-	s.cachePositiveResponse(r, resp, key)
+	s.cachePositiveResponse(resp, key, domain)
 }
 
 // cacheNegativeResponse caches NXDOMAIN or NOERROR with no answers responses.
@@ -145,31 +205,25 @@ func (s *DNSServer) cacheNegativeResponse(r *dns.Msg, resp *dns.Msg, key string)
 		}
 	}
 
+	// Records never outlive the entry, and the entry expires with its shortest record
+	msg := resp.Copy()
+	ttl = int(capTTLs(msg, uint32(ttl)))
+
 	// Don't cache if TTL is too short
 	if ttl < 1 {
 		return
 	}
 
-	s.cacheMu.Lock()
-	defer s.cacheMu.Unlock()
-
-	// Enforce cache size limit if configured
-	if s.maxCacheSize > 0 && len(s.cache) >= s.maxCacheSize {
-		// Remove oldest entries (simple FIFO - remove first expired, or random if none expired)
-		s.evictOldestCacheEntry()
-	}
-
-	cachedMsg := resp.Copy()
-	s.cache[key] = &CacheEntry{
-		Message:   cachedMsg,
+	s.storeCacheEntry(key, &CacheEntry{
+		Message:   msg,
 		ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
-	}
+	})
 
 	logCachedNegative(s, resp, r, ttl)
 }
 
-// cachePositiveResponse caches successful DNS responses.
-func (s *DNSServer) cachePositiveResponse(r *dns.Msg, resp *dns.Msg, key string) {
+// cachePositiveResponse caches successful DNS responses for a normalized domain.
+func (s *DNSServer) cachePositiveResponse(resp *dns.Msg, key, domain string) {
 	// Handle successful responses
 	if s.config.CacheTTL <= 0 {
 		return
@@ -180,23 +234,16 @@ func (s *DNSServer) cachePositiveResponse(r *dns.Msg, resp *dns.Msg, key string)
 		return
 	}
 
-	// Determine cache TTL from response or use configured TTL
-	ttl := s.config.CacheTTL
-	if len(resp.Answer) > 0 {
-		// Use minimum TTL from answer records
-		const maxUint32 = 4294967295
-		var minTTL uint32 = maxUint32
-		if ttl > 0 && ttl <= maxUint32 {
-			minTTL = uint32(ttl)
-		}
-		for _, rr := range resp.Answer {
-			if rr.Header().Ttl < minTTL {
-				minTTL = rr.Header().Ttl
-			}
-		}
-		// Use the smaller of response TTL or configured TTL
-		if minTTL < maxUint32 && int(minTTL) < ttl {
-			ttl = int(minTTL)
+	// Keep each record's own TTL, capped at the configured TTL. The entry expires
+	// with its shortest record; the others are counted down individually on serve.
+	msg := resp.Copy()
+	ttl := int(capTTLs(msg, uint32(s.config.CacheTTL))) // nolint:gosec // cache_ttl is a positive number of seconds
+
+	// Forced TTLs override the record TTLs for matching domains
+	if forced, ok := s.forcedCacheTTL(domain); ok {
+		ttl = forced
+		for _, hdr := range recordHeaders(msg) {
+			hdr.Ttl = uint32(forced) // nolint:gosec // force_cache TTLs are validated as positive
 		}
 	}
 
@@ -205,80 +252,145 @@ func (s *DNSServer) cachePositiveResponse(r *dns.Msg, resp *dns.Msg, key string)
 		return
 	}
 
-	s.cacheMu.Lock()
-	defer s.cacheMu.Unlock()
+	// Store a copy of the response
+	s.storeCacheEntry(key, &CacheEntry{
+		Message:   msg,
+		ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
+	})
+
+	s.debugLog("Cached: %s (TTL: %ds)", domain, ttl)
+}
 
-	// Enforce cache size limit if configured
-	if s.maxCacheSize > 0 && len(s.cache) >= s.maxCacheSize {
-		// Remove oldest entries (simple FIFO - remove first expired, or random if none expired)
-		s.evictOldestCacheEntry()
+// recordHeaders returns the headers of all records in a message except the OPT pseudo-record.
+func recordHeaders(msg *dns.Msg) []*dns.RR_Header {
+	headers := make([]*dns.RR_Header, 0, len(msg.Answer)+len(msg.Ns)+len(msg.Extra))
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				headers = append(headers, rr.Header())
+			}
+		}
 	}
+	return headers
+}
 
-	// Create a copy of the response for caching
-	cachedMsg := resp.Copy()
-	s.cache[key] = &CacheEntry{
-		Message:   cachedMsg,
-		ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
+// capTTLs lowers every record TTL in a message to at most maxTTL and returns the
+// smallest resulting TTL (maxTTL if the message has no records).
+func capTTLs(msg *dns.Msg, maxTTL uint32) uint32 {
+	shortest := maxTTL
+	for _, hdr := range recordHeaders(msg) {
+		hdr.Ttl = min(hdr.Ttl, maxTTL)
+		shortest = min(shortest, hdr.Ttl)
+	}
+	return shortest
+}
+
+// ageTTLs counts down the record TTLs of a cached message. The shortest stored TTL equals the
+// entry's lifetime, so the time spent in the cache is that TTL minus the remaining lifetime.
+func ageTTLs(msg *dns.Msg, remaining time.Duration) {
+	headers := recordHeaders(msg)
+	if len(headers) == 0 {
+		return
+	}
+	shortest := headers[0].Ttl
+	for _, hdr := range headers[1:] {
+		shortest = min(shortest, hdr.Ttl)
 	}
 
-	s.debugLog("Cached: %s (TTL: %ds)", normalizeDomain(r.Question[0].Name), ttl)
+	// Round the remaining lifetime up so a record never reaches 0 before the entry expires
+	left := uint32(max((remaining+time.Second-1)/time.Second, 0)) // nolint:gosec // bounded by the stored TTL below
+	if left >= shortest {
+		// Not aged yet, or the expiry was extended (cache_warmup)
+		return
+	}
+	elapsed := shortest - left
+	for _, hdr := range headers {
+		hdr.Ttl -= min(hdr.Ttl, elapsed)
+	}
 }
 
-// evictOldestCacheEntry removes the oldest cache entry when cache is full.
-func (s *DNSServer) evictOldestCacheEntry() {
-	now := time.Now()
-	var oldestKey string
-	var oldestTime time.Time
-	found := false
-
-	// Find oldest entry
-	for key, entry := range s.cache {
-		if !found || entry.ExpiresAt.Before(oldestTime) {
-			oldestKey = key
-			oldestTime = entry.ExpiresAt
-			found = true
-		}
+// storeCacheEntry stores an entry in the local cache and the shared cache, if configured.
+func (s *DNSServer) storeCacheEntry(key string, entry *CacheEntry) {
+	s.storeLocalCacheEntry(key, entry)
+	// Shared cache lookups only use global keys, so ECS-scoped answers stay local
+	if !isScopedCacheKey(key) {
+		s.setSharedCacheEntry(key, entry)
 	}
+}
+
+// storeLocalCacheEntry stores an entry in the in-memory cache, evicting entries from its shard
+// if the shard is full. Entries holding RRSIGs are also bounded by max_dnssec_cache_size, so
+// large signed answers for a few validating clients can't crowd out everything else.
+func (s *DNSServer) storeLocalCacheEntry(key string, entry *CacheEntry) {
+	measureCacheEntry(key, entry)
+	s.cacheShard(key).store(key, entry)
+}
+
+// measureCacheEntry records whether an entry holds RRSIGs and its approximate size:
+// the packed message plus its key.
+func measureCacheEntry(key string, entry *CacheEntry) {
+	entry.DNSSEC = hasRRSIG(entry.Message)
+	entry.Size = entry.Message.Len() + len(key)
+}
 
-	// If all entries are expired, prefer removing expired ones
-	if found && now.After(oldestTime) {
-		delete(s.cache, oldestKey)
+// touchCacheEntry marks a cache entry as used by a cache hit, moving it to the front of the
+// LRU list. An entry already used within cacheTouchInterval is not moved again, so hits on
+// popular entries don't all take their shard's write lock.
+func (s *DNSServer) touchCacheEntry(entry *CacheEntry) {
+	now := time.Now().UnixNano()
+	if now-entry.lastAccessed.Load() < int64(cacheTouchInterval) {
 		return
 	}
+	entry.lastAccessed.Store(now)
+	entry.shard.touch(entry)
+}
 
-	// Otherwise remove the oldest non-expired entry
-	if found {
-		delete(s.cache, oldestKey)
+// hasRRSIG reports whether a message carries DNSSEC signatures.
+func hasRRSIG(msg *dns.Msg) bool {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
 	}
+	return false
 }
 
 // validateResponse checks if a DNS response matches the query.
 func validateResponse(r *dns.Msg, resp *dns.Msg) bool {
+	return responseMismatch(r, resp) == ""
+}
+
+// responseMismatch describes how a DNS response fails to match the query, or returns "" if it matches.
+func responseMismatch(r *dns.Msg, resp *dns.Msg) string {
 	if r == nil || resp == nil {
-		return false
+		return "missing message"
 	}
 
 	// Check if response has questions
 	if len(resp.Question) == 0 || len(r.Question) == 0 {
-		return false
+		return "no question section"
 	}
 
 	// Response question should match request question
 	reqQ := normalizeDomain(r.Question[0].Name)
 	respQ := normalizeDomain(resp.Question[0].Name)
 	if reqQ != respQ {
-		return false
+		return fmt.Sprintf("name %q does not match query %q", respQ, reqQ)
 	}
 
 	// Response question type and class should match
 	if r.Question[0].Qtype != resp.Question[0].Qtype {
-		return false
+		return fmt.Sprintf("type %s does not match query type %s",
+			dns.TypeToString[resp.Question[0].Qtype], dns.TypeToString[r.Question[0].Qtype])
 	}
 	if r.Question[0].Qclass != resp.Question[0].Qclass {
-		return false
+		return fmt.Sprintf("class %s does not match query class %s",
+			dns.ClassToString[resp.Question[0].Qclass], dns.ClassToString[r.Question[0].Qclass])
 	}
 
-	return true
+	return ""
 }
 
 // logCacheHit logs a cache hit with appropriate response type information.
@@ -325,16 +437,17 @@ func logCachedNegative(s *DNSServer, resp *dns.Msg, r *dns.Msg, ttl int) {
 	}
 }
 
-// cleanupExpiredCache removes expired entries from the cache.
+// cleanupExpiredCache removes expired entries from the cache, after stale_max_age with serve_stale.
+// Expired entries are kept in maintenance mode, where they are the only answers left.
 func (s *DNSServer) cleanupExpiredCache() {
-	s.cacheMu.Lock()
-	defer s.cacheMu.Unlock()
+	if s.maintenance.Load() {
+		return
+	}
 
-	now := time.Now()
-	for key, entry := range s.cache {
-		if now.After(entry.ExpiresAt) {
-			delete(s.cache, key)
-		}
+	// With serve_stale, entries are kept until they are too old to be served
+	expired := time.Now().Add(-s.staleMaxAge())
+	for _, shard := range s.cacheShards {
+		shard.deleteExpired(expired)
 	}
 }
 
@@ -348,7 +461,12 @@ func (s *DNSServer) startCacheCleanup() {
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
 
-		for range ticker.C {
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
 			s.cleanupExpiredCache()
 		}
 	}()
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultCacheShards is the default number of in-memory cache shards (cache_shards).
+const defaultCacheShards = 256
+
+// cacheShard is one part of the in-memory cache. Keys are spread over the shards by hash,
+// and each shard has its own lock, LRU list and share of the cache limits, so queries for
+// different names rarely wait for each other.
+type cacheShard struct {
+	mu            sync.RWMutex
+	entries       map[string]*CacheEntry
+	lru           *list.List // Keys, most recently used first
+	bytes         int        // Approximate size of all entries
+	dnssecEntries int        // Entries holding RRSIGs
+	maxEntries    int        // Share of max_cache_size (0 = unlimited)
+	maxBytes      int        // Share of max_cache_bytes (0 = unlimited)
+	maxDNSSEC     int        // Share of max_dnssec_cache_size (0 = no separate limit)
+}
+
+// newCacheShards creates the cache shards and divides the cache limits between them. There
+// are never more shards than a limit has entries, or maximum-size messages for
+// max_cache_bytes, so every shard's share holds at least one entry.
+func newCacheShards(config *Config) []*cacheShard {
+	n := max(config.CacheShards, 1)
+	if config.MaxCacheSize > 0 {
+		n = min(n, config.MaxCacheSize)
+	}
+	if config.MaxDNSSECCacheSize > 0 {
+		n = min(n, config.MaxDNSSECCacheSize)
+	}
+	if config.MaxCacheBytes > 0 {
+		n = max(min(n, config.MaxCacheBytes/dns.MaxMsgSize), 1)
+	}
+
+	shards := make([]*cacheShard, n)
+	for i := range shards {
+		shards[i] = &cacheShard{
+			entries:    make(map[string]*CacheEntry),
+			lru:        list.New(),
+			maxEntries: limitShare(config.MaxCacheSize, i, n),
+			maxBytes:   limitShare(config.MaxCacheBytes, i, n),
+			maxDNSSEC:  limitShare(config.MaxDNSSECCacheSize, i, n),
+		}
+	}
+	return shards
+}
+
+// limitShare returns shard i's part of a limit divided between n shards (0 stays unlimited).
+func limitShare(limit, i, n int) int {
+	if limit <= 0 {
+		return 0
+	}
+	share := limit / n
+	if i < limit%n {
+		share++
+	}
+	return share
+}
+
+// cacheShard returns the shard holding a cache key.
+func (s *DNSServer) cacheShard(key string) *cacheShard {
+	return s.cacheShards[fnv1a(fnvOffset64, key)%uint64(len(s.cacheShards))]
+}
+
+// lookupCacheEntry returns the cache entry for a key, expired or not.
+func (s *DNSServer) lookupCacheEntry(key string) (*CacheEntry, bool) {
+	shard := s.cacheShard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	entry, exists := shard.entries[key]
+	return entry, exists
+}
+
+// cacheCounts returns the number of cache entries, how many of them hold RRSIGs, and their
+// approximate size in bytes. Each shard is locked in turn, so the totals are not a snapshot.
+func (s *DNSServer) cacheCounts() (entries, dnssecEntries, bytes int) {
+	for _, shard := range s.cacheShards {
+		shard.mu.RLock()
+		entries += len(shard.entries)
+		dnssecEntries += shard.dnssecEntries
+		bytes += shard.bytes
+		shard.mu.RUnlock()
+	}
+	return entries, dnssecEntries, bytes
+}
+
+// store adds or replaces an entry, evicting least recently used entries to stay within the
+// shard's limits. The entry must have been measured with measureCacheEntry.
+func (c *cacheShard) store(key string, entry *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxBytes > 0 && entry.Size > c.maxBytes {
+		return // Larger than the whole budget
+	}
+
+	old, exists := c.entries[key]
+	if entry.DNSSEC && (!exists || !old.DNSSEC) && c.maxDNSSEC > 0 && c.dnssecEntries >= c.maxDNSSEC {
+		c.evictLRULocked(true)
+	}
+
+	// Enforce the entry limit, replacing an entry doesn't grow the cache
+	if c.maxEntries > 0 && !exists && len(c.entries) >= c.maxEntries {
+		c.evictLRULocked(false)
+	}
+
+	// Enforce the memory budget, counting the entry being replaced as freed
+	if c.maxBytes > 0 {
+		c.deleteLocked(key)
+		for len(c.entries) > 0 && c.bytes+entry.Size > c.maxBytes {
+			c.evictLRULocked(false)
+		}
+	}
+	c.putLocked(key, entry)
+}
+
+// putLocked adds or replaces an entry, keeping the DNSSEC entry count and bytes.
+// The caller must hold c.mu.
+func (c *cacheShard) putLocked(key string, entry *CacheEntry) {
+	c.deleteLocked(key)
+	if entry.DNSSEC {
+		c.dnssecEntries++
+	}
+	c.bytes += entry.Size
+	entry.lastAccessed.Store(time.Now().UnixNano())
+	entry.shard = c
+	entry.lruElem = c.lru.PushFront(key)
+	c.entries[key] = entry
+}
+
+// deleteLocked removes an entry, keeping the DNSSEC entry count and bytes.
+// The caller must hold c.mu.
+func (c *cacheShard) deleteLocked(key string) {
+	if entry, exists := c.entries[key]; exists {
+		if entry.DNSSEC {
+			c.dnssecEntries--
+		}
+		c.bytes -= entry.Size
+		c.lru.Remove(entry.lruElem)
+		delete(c.entries, key)
+	}
+}
+
+// evictLRULocked removes the least recently used entry (only DNSSEC entries with dnssecOnly).
+// The caller must hold c.mu.
+func (c *cacheShard) evictLRULocked(dnssecOnly bool) {
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		key := elem.Value.(string)
+		if !dnssecOnly || c.entries[key].DNSSEC {
+			c.deleteLocked(key)
+			return
+		}
+	}
+}
+
+// touch moves an entry to the front of the LRU list, unless it was evicted or replaced
+// since it was looked up.
+func (c *cacheShard) touch(entry *CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[entry.lruElem.Value.(string)] == entry {
+		c.lru.MoveToFront(entry.lruElem)
+	}
+}
+
+// deleteExpired removes the entries that expired before the given time.
+func (c *cacheShard) deleteExpired(before time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if before.After(entry.ExpiresAt) {
+			c.deleteLocked(key)
+		}
+	}
+}
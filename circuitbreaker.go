@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultCircuitBreakerCooldown is how long a tripped nameserver is skipped by default.
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// circuitBreaker skips a nameserver after repeated failures. Once the cooldown has passed,
+// a single query is let through as a probe: success closes the breaker, failure reopens it.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int // Consecutive failures
+	open      bool
+	openUntil time.Time
+	probing   bool
+}
+
+// newCircuitBreakers creates one breaker per nameserver, or nil if circuit_breaker_threshold is unset.
+func newCircuitBreakers(config *Config, nameservers []NameserverConfig) []*circuitBreaker {
+	if config.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	cooldown := time.Duration(config.CircuitBreakerCooldown) * time.Second
+	if cooldown <= 0 {
+		cooldown = defaultCircuitBreakerCooldown
+	}
+
+	breakers := make([]*circuitBreaker, len(nameservers))
+	for i, ns := range nameservers {
+		breakers[i] = &circuitBreaker{
+			name:      ns.Address,
+			threshold: config.CircuitBreakerThreshold,
+			cooldown:  cooldown,
+		}
+	}
+	return breakers
+}
+
+// breaker returns the circuit breaker of a nameserver, or nil when breakers are disabled.
+func (s *DNSServer) breaker(idx int) *circuitBreaker {
+	if idx >= len(s.breakers) {
+		return nil
+	}
+	return s.breakers[idx]
+}
+
+// allow reports whether a query may be sent to the nameserver.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// allowsWithoutProbe reports whether the breaker is closed, without starting a probe.
+func (b *circuitBreaker) allowsWithoutProbe() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open
+}
+
+// available reports whether allow would let a query through, without starting a probe.
+func (b *circuitBreaker) available() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open || (!time.Now().Before(b.openUntil) && !b.probing)
+}
+
+// usableNameservers returns the indexes of the nameservers in a group a qtype can currently be
+// forwarded to, starting from position start and wrapping around: forwarding loops, nameservers not accepting
+// the qtype and nameservers whose circuit breaker is open are left out.
+func (s *DNSServer) usableNameservers(group *upstreamGroup, start int, qtype uint16) []int {
+	var usable []int
+	for i := range group.members {
+		idx := group.members[(start+i)%len(group.members)]
+		if ns := s.nameservers[idx]; ns.acceptsQtype(qtype) && !ns.self && s.breaker(idx).available() {
+			usable = append(usable, idx)
+		}
+	}
+	return usable
+}
+
+// record registers the outcome of a query sent to the nameserver.
+func (b *circuitBreaker) record(success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		if b.open {
+			log.Printf("Circuit breaker closed for nameserver %s", b.name)
+		}
+		b.failures = 0
+		b.open = false
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.open:
+		// Probe failed - stay open for another cooldown
+		b.probing = false
+		b.openUntil = time.Now().Add(b.cooldown)
+	case b.failures >= b.threshold:
+		b.open = true
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Printf("Circuit breaker opened for nameserver %s after %d consecutive failures, skipping it for %v",
+			b.name, b.failures, b.cooldown)
+	}
+}
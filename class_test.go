@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// classUpstream answers IN queries with an address, CHAOS TXT queries with a version and
+// everything else with NXDOMAIN.
+func classUpstream(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	q := r.Question[0]
+	switch {
+	case q.Qclass == dns.ClassINET:
+		msg.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: []byte{10, 4, 4, 4}}}
+	case q.Qclass == dns.ClassCHAOS && q.Qtype == dns.TypeTXT:
+		msg.Answer = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 60}, Txt: []string{"test"}}}
+	default:
+		msg.Rcode = dns.RcodeNameError
+	}
+	_ = w.WriteMsg(msg)
+}
+
+// testQueryClass sends a query for a name, type and class.
+func testQueryClass(t *testing.T, s *DNSServer, name string, qtype, qclass uint16) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.Question[0].Qclass = qclass
+	resp, err := s.Query(testClient, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestNegativeAnswerStaysInItsClass(t *testing.T) {
+	s := newTestServer(t, &Config{CacheTTL: 60, Nameservers: startTestUpstream(t, classUpstream, classUpstream)})
+	if resp := testQueryClass(t, s, "www.example", dns.TypeA, dns.ClassCHAOS); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("CHAOS rcode = %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+	resp := testQueryClass(t, s, "www.example", dns.TypeA, dns.ClassINET)
+	if resp.Rcode != dns.RcodeSuccess || len(answerIPs(resp)) != 1 {
+		t.Errorf("IN answer = %s %v, want the address, not the cached CHAOS NXDOMAIN", dns.RcodeToString[resp.Rcode], answerIPs(resp))
+	}
+}
+
+func TestRejectNonINClass(t *testing.T) {
+	s := newTestServer(t, &Config{RejectNonINClass: true, Nameservers: startTestUpstream(t, classUpstream, classUpstream)})
+	if resp := testQueryClass(t, s, "www.example", dns.TypeA, dns.ClassHESIOD); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("HESIOD rcode = %s, want REFUSED", dns.RcodeToString[resp.Rcode])
+	}
+	if succeeded := atomic.LoadUint64(&s.stats.upstreams[0].succeeded); succeeded != 0 {
+		t.Errorf("forwarded %d queries, want the HESIOD query refused locally", succeeded)
+	}
+
+	resp := testQueryClass(t, s, "version.bind", dns.TypeTXT, dns.ClassCHAOS)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("version.bind = %s with %d answers, want the forwarded CHAOS answer", dns.RcodeToString[resp.Rcode], len(resp.Answer))
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"net"
+	"strconv"
 	"strings"
+
+	"github.com/miekg/dns"
 )
 
 // parseNameserverFromString parses a simple string nameserver configuration.
@@ -12,6 +16,7 @@ func parseNameserverFromString(val string) NameserverConfig {
 		Address:  val,
 		Protocol: protocolUDP,
 		Port:     53,
+		Enabled:  true,
 	}
 	// Check if it contains a port
 	if strings.Contains(val, ":") {
@@ -31,6 +36,7 @@ func parseNameserverFromMap(val map[string]interface{}) NameserverConfig {
 	ns := NameserverConfig{
 		Protocol: protocolUDP,
 		Port:     53,
+		Enabled:  true,
 	}
 	if addr, ok := val["address"].(string); ok {
 		ns.Address = addr
@@ -38,6 +44,21 @@ func parseNameserverFromMap(val map[string]interface{}) NameserverConfig {
 	if proto, ok := val["protocol"].(string); ok {
 		ns.Protocol = strings.ToLower(proto)
 	}
+	if enabled, ok := val["enabled"].(bool); ok {
+		ns.Enabled = enabled
+	}
+	if zoneFile, ok := val["zone_file"].(string); ok {
+		ns.ZoneFile = zoneFile
+		if ns.Address == "" {
+			ns.Address = zoneFile
+		}
+	}
+	if qtypes, ok := val["only_qtypes"].([]interface{}); ok {
+		ns.OnlyQtypes = interfaceStrings(qtypes)
+	}
+	if qtypes, ok := val["except_qtypes"].([]interface{}); ok {
+		ns.ExceptQtypes = interfaceStrings(qtypes)
+	}
 	if port, ok := val["port"].(int); ok {
 		ns.Port = port
 	} else if port, ok := val["port"].(string); ok {
@@ -50,7 +71,7 @@ func parseNameserverFromMap(val map[string]interface{}) NameserverConfig {
 		switch ns.Protocol {
 		case protocolDOT:
 			ns.Port = 853
-		case protocolDOH:
+		case protocolDOH, protocolDOHJSON:
 			ns.Port = 443
 		}
 	}
@@ -62,6 +83,7 @@ func parseNameserverFromMapInterface(val map[interface{}]interface{}) Nameserver
 	ns := NameserverConfig{
 		Protocol: protocolUDP,
 		Port:     53,
+		Enabled:  true,
 	}
 	if addr, ok := val["address"].(string); ok {
 		ns.Address = addr
@@ -69,6 +91,21 @@ func parseNameserverFromMapInterface(val map[interface{}]interface{}) Nameserver
 	if proto, ok := val["protocol"].(string); ok {
 		ns.Protocol = strings.ToLower(proto)
 	}
+	if enabled, ok := val["enabled"].(bool); ok {
+		ns.Enabled = enabled
+	}
+	if zoneFile, ok := val["zone_file"].(string); ok {
+		ns.ZoneFile = zoneFile
+		if ns.Address == "" {
+			ns.Address = zoneFile
+		}
+	}
+	if qtypes, ok := val["only_qtypes"].([]interface{}); ok {
+		ns.OnlyQtypes = interfaceStrings(qtypes)
+	}
+	if qtypes, ok := val["except_qtypes"].([]interface{}); ok {
+		ns.ExceptQtypes = interfaceStrings(qtypes)
+	}
 	if port, ok := val["port"].(int); ok {
 		ns.Port = port
 	} else if port, ok := val["port"].(string); ok {
@@ -81,7 +118,7 @@ func parseNameserverFromMapInterface(val map[interface{}]interface{}) Nameserver
 		switch ns.Protocol {
 		case protocolDOT:
 			ns.Port = 853
-		case protocolDOH:
+		case protocolDOH, protocolDOHJSON:
 			ns.Port = 443
 		}
 	}
@@ -112,7 +149,72 @@ func parseNameservers(nameservers interface{}) ([]NameserverConfig, error) {
 		return nil, fmt.Errorf("invalid nameservers format")
 	}
 
-	return result, nil
+	// Reject unknown protocols instead of silently falling back to plain UDP
+	for _, ns := range result {
+		if !isValidProtocol(ns.Protocol) {
+			return nil, fmt.Errorf("unknown protocol %q for nameserver %s (valid protocols: %s)",
+				ns.Protocol, ns.Address, strings.Join(validProtocols, ", "))
+		}
+	}
+
+	// Compile per-nameserver query type filters
+	for i := range result {
+		ns := &result[i]
+		var err error
+		if ns.onlyQtypes, err = parseQtypes(ns.OnlyQtypes); err != nil {
+			return nil, fmt.Errorf("invalid only_qtypes for nameserver %s: %w", ns.Address, err)
+		}
+		if ns.exceptQtypes, err = parseQtypes(ns.ExceptQtypes); err != nil {
+			return nil, fmt.Errorf("invalid except_qtypes for nameserver %s: %w", ns.Address, err)
+		}
+	}
+
+	// Skip disabled nameservers, keeping their config for later use
+	enabled := make([]NameserverConfig, 0, len(result))
+	for _, ns := range result {
+		if !ns.Enabled {
+			log.Printf("Nameserver %s (%s) is disabled, skipping", ns.Address, ns.Protocol)
+			continue
+		}
+		enabled = append(enabled, ns)
+	}
+	if len(result) > 0 && len(enabled) == 0 {
+		return nil, fmt.Errorf("all %d configured nameservers are disabled (at least one must be enabled)", len(result))
+	}
+
+	return enabled, nil
+}
+
+// acceptsQtype reports whether queries of the given type may be sent to this nameserver.
+func (ns NameserverConfig) acceptsQtype(qtype uint16) bool {
+	if len(ns.onlyQtypes) > 0 {
+		if _, ok := ns.onlyQtypes[qtype]; !ok {
+			return false
+		}
+	}
+	_, excluded := ns.exceptQtypes[qtype]
+	return !excluded
+}
+
+// interfaceStrings converts a YAML list to strings, skipping non-string items.
+func interfaceStrings(items []interface{}) []string {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if str, ok := item.(string); ok {
+			result = append(result, str)
+		}
+	}
+	return result
+}
+
+// isValidProtocol checks if a nameserver protocol is supported.
+func isValidProtocol(protocol string) bool {
+	for _, valid := range validProtocols {
+		if protocol == valid {
+			return true
+		}
+	}
+	return false
 }
 
 // parseOverwriteIPs parses IPs from an overwrite entry.
@@ -136,6 +238,27 @@ func parseOverwriteIPs(ips []interface{}, domain string) (string, []net.IP, erro
 	return firstIP, ipList, nil
 }
 
+// parseOverwriteAnswers parses the addresses an overwrite returns: one address or a list.
+func parseOverwriteAnswers(value interface{}, domain string) ([]string, error) {
+	var answers []string
+	switch v := value.(type) {
+	case string:
+		answers = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			answer, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid answer %v for overwrite %s (must be an IP address)", item, domain)
+			}
+			answers = append(answers, answer)
+		}
+	}
+	if len(answers) == 0 {
+		return nil, fmt.Errorf("empty 'answers' field for overwrite %s (at least one IP required)", domain)
+	}
+	return answers, nil
+}
+
 // parseOverwriteSubnets parses subnets from an overwrite entry.
 func parseOverwriteSubnets(subnets []interface{}) ([]*net.IPNet, error) {
 	var subnetList []*net.IPNet
@@ -154,7 +277,18 @@ func parseOverwriteSubnets(subnets []interface{}) ([]*net.IPNet, error) {
 // parseOverwriteFromMap parses a map-based overwrite entry.
 func parseOverwriteFromMap(v map[string]interface{}, domain string) (*OverwriteEntry, error) {
 	entry := &OverwriteEntry{}
-	if ips, ok := v["ips"].([]interface{}); ok {
+	if answers, ok := v["answers"]; ok {
+		var err error
+		if entry.Answers, err = parseOverwriteAnswers(answers, domain); err != nil {
+			return nil, err
+		}
+		// With answers, every element of ips is a client IP to match
+		if ips, ok := v["ips"].([]interface{}); ok && len(ips) > 0 {
+			if _, entry.IPs, err = parseOverwriteIPs(ips, domain); err != nil {
+				return nil, err
+			}
+		}
+	} else if ips, ok := v["ips"].([]interface{}); ok {
 		firstIP, ipList, err := parseOverwriteIPs(ips, domain)
 		if err != nil {
 			return nil, err
@@ -162,7 +296,7 @@ func parseOverwriteFromMap(v map[string]interface{}, domain string) (*OverwriteE
 		entry.IP = firstIP
 		entry.IPs = ipList
 	} else {
-		return nil, fmt.Errorf("missing or empty 'ips' field for overwrite %s (at least one IP required)", domain)
+		return nil, fmt.Errorf("missing or empty 'ips' field for overwrite %s (at least one IP or 'answers' required)", domain)
 	}
 	if subnets, ok := v["subnets"].([]interface{}); ok {
 		subnetList, err := parseOverwriteSubnets(subnets)
@@ -171,13 +305,44 @@ func parseOverwriteFromMap(v map[string]interface{}, domain string) (*OverwriteE
 		}
 		entry.Subnets = subnetList
 	}
+	if macs, ok := v["macs"].([]interface{}); ok {
+		macList, err := parseMACs(macs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC for overwrite %s: %w", domain, err)
+		}
+		entry.MACs = macList
+	}
+	if qtypes, ok := v["qtypes"].([]interface{}); ok {
+		qtypeSet, err := parseQtypes(interfaceStrings(qtypes))
+		if err != nil {
+			return nil, fmt.Errorf("invalid qtypes for overwrite %s: %w", domain, err)
+		}
+		entry.Qtypes = qtypeSet
+	}
+	if ttl, ok := v["ttl"]; ok {
+		var err error
+		if entry.TTL, err = parseOverwriteTTL(ttl, domain); err != nil {
+			return nil, err
+		}
+	}
 	return entry, nil
 }
 
 // parseOverwriteFromMapInterface parses a map-based overwrite entry (fallback format).
 func parseOverwriteFromMapInterface(v map[interface{}]interface{}, domain string) (*OverwriteEntry, error) {
 	entry := &OverwriteEntry{}
-	if ips, ok := v["ips"].([]interface{}); ok {
+	if answers, ok := v["answers"]; ok {
+		var err error
+		if entry.Answers, err = parseOverwriteAnswers(answers, domain); err != nil {
+			return nil, err
+		}
+		// With answers, every element of ips is a client IP to match
+		if ips, ok := v["ips"].([]interface{}); ok && len(ips) > 0 {
+			if _, entry.IPs, err = parseOverwriteIPs(ips, domain); err != nil {
+				return nil, err
+			}
+		}
+	} else if ips, ok := v["ips"].([]interface{}); ok {
 		firstIP, ipList, err := parseOverwriteIPs(ips, domain)
 		if err != nil {
 			return nil, err
@@ -185,7 +350,7 @@ func parseOverwriteFromMapInterface(v map[interface{}]interface{}, domain string
 		entry.IP = firstIP
 		entry.IPs = ipList
 	} else {
-		return nil, fmt.Errorf("missing or empty 'ips' field for overwrite %s (at least one IP required)", domain)
+		return nil, fmt.Errorf("missing or empty 'ips' field for overwrite %s (at least one IP or 'answers' required)", domain)
 	}
 	if subnets, ok := v["subnets"].([]interface{}); ok {
 		subnetList, err := parseOverwriteSubnets(subnets)
@@ -194,9 +359,38 @@ func parseOverwriteFromMapInterface(v map[interface{}]interface{}, domain string
 		}
 		entry.Subnets = subnetList
 	}
+	if macs, ok := v["macs"].([]interface{}); ok {
+		macList, err := parseMACs(macs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC for overwrite %s: %w", domain, err)
+		}
+		entry.MACs = macList
+	}
+	if qtypes, ok := v["qtypes"].([]interface{}); ok {
+		qtypeSet, err := parseQtypes(interfaceStrings(qtypes))
+		if err != nil {
+			return nil, fmt.Errorf("invalid qtypes for overwrite %s: %w", domain, err)
+		}
+		entry.Qtypes = qtypeSet
+	}
+	if ttl, ok := v["ttl"]; ok {
+		var err error
+		if entry.TTL, err = parseOverwriteTTL(ttl, domain); err != nil {
+			return nil, err
+		}
+	}
 	return entry, nil
 }
 
+// parseOverwriteTTL validates the ttl of an overwrite.
+func parseOverwriteTTL(value interface{}, domain string) (uint32, error) {
+	ttl, ok := value.(int)
+	if !ok || ttl < 1 || ttl > maxOverwriteTTL {
+		return 0, fmt.Errorf("invalid ttl %v for overwrite %s (must be between 1 and %d seconds)", value, domain, maxOverwriteTTL)
+	}
+	return uint32(ttl), nil
+}
+
 // parseOverwrites parses overwrite configuration (supports both old and new format).
 func parseOverwrites(overwrites map[string]interface{}) (map[string]*OverwriteEntry, error) {
 	result := make(map[string]*OverwriteEntry)
@@ -213,6 +407,12 @@ func parseOverwrites(overwrites map[string]interface{}) (map[string]*OverwriteEn
 		case string:
 			// Old format: simple IP string
 			entry.IP = v
+		case []interface{}:
+			// List of addresses, all returned to all clients
+			var err error
+			if entry.Answers, err = parseOverwriteAnswers(v, domain); err != nil {
+				return nil, err
+			}
 		case map[string]interface{}:
 			var err error
 			entry, err = parseOverwriteFromMap(v, domain)
@@ -229,8 +429,8 @@ func parseOverwrites(overwrites map[string]interface{}) (map[string]*OverwriteEn
 			return nil, fmt.Errorf("invalid overwrite format for %s (got type %T, value: %v)", domain, value, value)
 		}
 
-		if entry.IP == "" {
-			return nil, fmt.Errorf("missing IP for overwrite %s", domain)
+		if err := finishOverwriteEntry(entry, domain); err != nil {
+			return nil, err
 		}
 
 		result[normalizeDomain(domain)] = entry
@@ -238,3 +438,123 @@ func parseOverwrites(overwrites map[string]interface{}) (map[string]*OverwriteEn
 
 	return result, nil
 }
+
+// finishOverwriteEntry validates the returned IPs of a parsed overwrite and applies the default query types.
+func finishOverwriteEntry(entry *OverwriteEntry, domain string) error {
+	answers := entry.Answers
+	if len(answers) == 0 {
+		if entry.IP == "" {
+			return fmt.Errorf("missing IP for overwrite %s", domain)
+		}
+		answers = []string{entry.IP}
+	}
+	entry.Addrs = make([]net.IP, 0, len(answers))
+	for _, answer := range answers {
+		ip := net.ParseIP(strings.TrimSpace(answer))
+		if ip == nil {
+			return fmt.Errorf("invalid IP %q for overwrite %s", answer, domain)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		entry.Addrs = append(entry.Addrs, ip)
+	}
+	entry.IP = answers[0]
+
+	// Without qtypes, only queries for the addresses' own record types are overwritten
+	if len(entry.Qtypes) == 0 {
+		entry.Qtypes = make(map[uint16]struct{}, 2)
+		for _, ip := range entry.Addrs {
+			if ip.To4() != nil {
+				entry.Qtypes[dns.TypeA] = struct{}{}
+			} else {
+				entry.Qtypes[dns.TypeAAAA] = struct{}{}
+			}
+		}
+	}
+	return nil
+}
+
+// parseDomainSet parses a list of domains into a normalized set.
+func parseDomainSet(domains []string) map[string]struct{} {
+	result := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		if normalized := normalizeDomain(domain); normalized != "" {
+			result[normalized] = struct{}{}
+		}
+	}
+	return result
+}
+
+// parseForceCache parses and validates the force_cache domain to TTL mapping.
+func parseForceCache(forceCache map[string]int) (map[string]int, error) {
+	result := make(map[string]int, len(forceCache))
+	for domain, ttl := range forceCache {
+		if ttl < 1 || ttl > maxForcedCacheTTL {
+			return nil, fmt.Errorf("invalid force_cache TTL %d for %s (must be between 1 and %d seconds)", ttl, domain, maxForcedCacheTTL)
+		}
+		result[normalizeDomain(domain)] = ttl
+	}
+	return result, nil
+}
+
+// parsePortRange parses a "low-high" port range (a single port is also accepted).
+func parsePortRange(portRange string) (int, int, error) {
+	lowStr, highStr, found := strings.Cut(strings.TrimSpace(portRange), "-")
+	if !found {
+		highStr = lowStr
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(lowStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", portRange, err)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(highStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", portRange, err)
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q (must be within 1-65535 and low <= high)", portRange)
+	}
+	return low, high, nil
+}
+
+// parseSubnets parses a list of CIDR subnets or single IP addresses.
+func parseSubnets(subnets []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, subnet := range subnets {
+		ipNet, err := parseSubnet(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %s: %w", subnet, err)
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// parseMACs parses a list of MAC addresses.
+func parseMACs(macs []interface{}) ([]net.HardwareAddr, error) {
+	var result []net.HardwareAddr
+	for _, macStr := range macs {
+		if s, ok := macStr.(string); ok {
+			mac, err := net.ParseMAC(s)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, mac)
+		}
+	}
+	return result, nil
+}
+
+// parseQtypes parses a list of query type names (e.g. "A", "DNSKEY") into a set.
+func parseQtypes(qtypes []string) (map[uint16]struct{}, error) {
+	result := make(map[uint16]struct{}, len(qtypes))
+	for _, name := range qtypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type %q", name)
+		}
+		result[qtype] = struct{}{}
+	}
+	return result, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnknownNameserverProtocolRejected(t *testing.T) {
+	_, err := NewDNSServer(&Config{Nameservers: []interface{}{map[string]interface{}{
+		"address":  "192.0.2.53",
+		"port":     853,
+		"protocol": "tsl",
+	}}})
+	if err == nil {
+		t.Fatal("server started with protocol \"tsl\", want a startup error")
+	}
+	for _, want := range append([]string{`"tsl"`}, validProtocols...) {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestKnownNameserverProtocolsAccepted(t *testing.T) {
+	for _, protocol := range []string{"udp", "TCP", "dot"} {
+		nameservers, err := parseNameservers([]interface{}{map[string]interface{}{
+			"address":  "192.0.2.53",
+			"protocol": protocol,
+		}})
+		if err != nil {
+			t.Errorf("protocol %q rejected: %v", protocol, err)
+		} else if nameservers[0].Protocol != strings.ToLower(protocol) {
+			t.Errorf("protocol %q parsed as %q", protocol, nameservers[0].Protocol)
+		}
+	}
+}
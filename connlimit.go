@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// connLimitLogInterval rate-limits the "connection limit reached" log message.
+const connLimitLogInterval = 10 * time.Second
+
+// connLimitListener closes new connections beyond a global and a per-client-IP limit.
+type connLimitListener struct {
+	net.Listener
+	maxTotal int // 0 = unlimited
+	maxPerIP int // 0 = unlimited
+
+	mu         sync.Mutex
+	total      int
+	perIP      map[string]int
+	rejected   int // Rejections since the last log message
+	lastLogged time.Time
+}
+
+// newConnLimitListener wraps a listener with connection limits (0 = unlimited).
+func newConnLimitListener(l net.Listener, maxTotal, maxPerIP int) net.Listener {
+	return &connLimitListener{
+		Listener: l,
+		maxTotal: maxTotal,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+	}
+}
+
+// Accept returns the next connection within the limits, closing any that exceed them.
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := ""
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = tcpAddr.IP.String()
+		}
+		if l.acquire(ip) {
+			return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+		_ = conn.Close()
+	}
+}
+
+// acquire reserves a connection slot for a client IP, logging (rate-limited) when a limit is hit.
+func (l *connLimitListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if (l.maxTotal > 0 && l.total >= l.maxTotal) || (l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP) {
+		l.rejected++
+		if time.Since(l.lastLogged) >= connLimitLogInterval {
+			log.Printf("Warning: TCP connection limit reached (%d open, %d from %s; limits %d total, %d per IP), rejected %d connections",
+				l.total, l.perIP[ip], ip, l.maxTotal, l.maxPerIP, l.rejected)
+			l.rejected = 0
+			l.lastLogged = time.Now()
+		}
+		return false
+	}
+	l.total++
+	l.perIP[ip]++
+	return true
+}
+
+// release frees the slot of a closed connection.
+func (l *connLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
+
+// limitedConn releases its connection slot when closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+// Close closes the connection and releases its slot once.
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
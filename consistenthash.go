@@ -0,0 +1,38 @@
+package main
+
+import "strconv"
+
+// FNV-1a parameters. The hash must be the same on every instance of a fleet,
+// so a per-process seeded hash (hash/maphash) cannot be used.
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// fnv1a extends an FNV-1a hash with the bytes of s.
+func fnv1a(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+// nameserverKey identifies a nameserver for consistent hashing, independent of its position.
+func nameserverKey(ns NameserverConfig) string {
+	return ns.Protocol + "://" + ns.Address + ":" + strconv.Itoa(ns.Port)
+}
+
+// consistentHashNameserver returns the index of the nameserver with the highest
+// rendezvous hash score for a domain. Adding or removing a nameserver only moves
+// the domains that scored highest on that nameserver.
+func consistentHashNameserver(nameservers []NameserverConfig, domain string) int {
+	best, bestScore := 0, uint64(0)
+	for i, ns := range nameservers {
+		score := fnv1a(fnv1a(fnvOffset64, nameserverKey(ns)), domain)
+		if i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
@@ -4,11 +4,134 @@ import "time"
 
 // Protocol constants for nameserver configuration.
 const (
-	protocolUDP = "udp"
-	protocolTCP = "tcp"
-	protocolDOT = "dot"
-	protocolDOH = "doh"
+	protocolUDP     = "udp"
+	protocolTCP     = "tcp"
+	protocolDOT     = "dot"
+	protocolDOH     = "doh"
+	protocolDOHJSON = "doh-json"
+	protocolFile    = "file"
 )
 
+// validProtocols lists all supported nameserver protocols.
+var validProtocols = []string{protocolUDP, protocolTCP, protocolDOT, protocolDOH, protocolDOHJSON, protocolFile}
+
+// Upstream selection modes.
+const (
+	upstreamModeRoundRobin     = "round_robin"
+	upstreamModeFixed          = "fixed"
+	upstreamModeConsistentHash = "consistent_hash"
+)
+
+// Operating modes.
+const (
+	modeFull     = "full"     // Forwarding, blocking and overwrites
+	modeResolver = "resolver" // Plain forwarder: no block lists or overwrites
+	modeBlocker  = "blocker"  // Forwarding and blocking, no overwrites
+)
+
+// Policies for upstream responses that fail validation.
+const (
+	validationFailureNext     = "next"     // Try the next nameserver
+	validationFailureServfail = "servfail" // Answer SERVFAIL immediately
+)
+
+// Actions for upstream answers with more than max_answers records.
+const (
+	maxAnswersTrim   = "trim"   // Keep the first max_answers records
+	maxAnswersReject = "reject" // Try the next nameserver
+)
+
+// Answers to ANY queries (any_mode).
+const (
+	anyModeForward = "forward" // Forward like any other query
+	anyModeRefuse  = "refuse"  // Answer REFUSED
+	anyModeMinimal = "minimal" // Answer with a synthesized HINFO record (RFC 8482)
+)
+
+// Answers to queries from clients outside allow_query (allow_query_action).
+const (
+	allowQueryRefuse = "refuse" // Answer REFUSED
+	allowQueryDrop   = "drop"   // Send no answer
+)
+
+// anyHINFOTTL is the TTL of the HINFO record synthesized for ANY queries in minimal mode.
+const anyHINFOTTL = 3600
+
+// Block response modes
+const (
+	blockModeNXDOMAIN = "nxdomain"
+	blockModeNODATA   = "nodata"
+	blockModeRefused  = "refused"
+	blockModeZeroIP   = "zeroip" // 0.0.0.0 for A, :: for AAAA, NODATA otherwise
+)
+
+// sinkholeTTL is the TTL of the address records answering blocked queries with block_mode
+// "zeroip" or a sinkhole IP.
+const sinkholeTTL = 60
+
+// Order of the records answering an overwrite with several addresses (overwrite_answer_mode).
+const (
+	overwriteAnswersAll        = "all"         // Every address, in configured order
+	overwriteAnswersRoundRobin = "round_robin" // Every address, the first one rotating between queries
+)
+
+// Default TTL of overwrite records, and largest accepted overwrite TTL (one week)
+const (
+	defaultOverwriteTTL = 300
+	maxOverwriteTTL     = 7 * 24 * 60 * 60
+)
+
+// Default maximum number of CNAME records in a forwarded answer
+const defaultMaxCNAMEChain = 16
+
+// Default maximum number of records in a forwarded answer section
+const defaultMaxAnswers = 100
+
+// Default EDNS UDP payload size advertised to upstreams (DNS flag day 2020)
+const defaultUpstreamEDNSBufSize = 1232
+
+// Default EDNS padding block size for queries (RFC 8467 block-length padding)
+const defaultEDNSPaddingBlockSize = 128
+
+// Largest accepted EDNS padding block size
+const maxEDNSPaddingBlockSize = 4096
+
+// Cache hits on an entry within this interval move it to the front of the LRU list only once
+const cacheTouchInterval = time.Second
+
+// Largest accepted answer_ttl_jitter, in percent
+const maxAnswerTTLJitter = 50
+
+// Default fallback DNS server for block list downloads when system DNS is down
+const defaultFallbackDNS = "8.8.8.8"
+
+// Default bound on interned domain names in normalizeDomain
+const defaultDomainCacheSize = 100000
+
+// Default limit on block lists downloaded at the same time
+const defaultMaxConcurrentDownloads = 4
+
+// Default TCP connection limits
+const (
+	defaultMaxTCPConnections      = 1000
+	defaultMaxTCPConnectionsPerIP = 100
+)
+
+// Default timeout for a single upstream query
+const defaultUpstreamTimeout = 5 * time.Second
+
+// Default time coalesced requests wait for the first request's answer (coalesce_timeout),
+// which bounds all upstream attempts for one query as well
+const defaultCoalesceTimeout = 10 * time.Second
+
+// How long in-flight queries get to finish on SIGINT/SIGTERM
+const shutdownTimeout = 5 * time.Second
+
 // DNS check timeout constant
 const dnsCheckTimeout = 5 * time.Second
+
+// Maximum TTL accepted in force_cache (one week)
+const maxForcedCacheTTL = 7 * 24 * 60 * 60
+
+// Source port ranges smaller than this are warned about (weak spoofing protection)
+const minSafeSourcePorts = 1024
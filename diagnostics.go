@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Labels of the diagnostics queries under diagnostics_suffix.
+const (
+	diagnosticsStatusLabel = "_status"
+	diagnosticsCheckLabel  = "_check"
+)
+
+// maxTXTStringLength is the longest character-string a TXT record can hold.
+const maxTXTStringLength = 255
+
+// diagnosticsResponse answers the magic TXT queries under diagnostics_suffix:
+//
+//	_status.<suffix>          server status and statistics
+//	<domain>._check.<suffix>  how <domain> is handled for the querying client
+//
+// Returns nil if the query is not below the suffix (or diagnostics are disabled).
+func (s *DNSServer) diagnosticsResponse(r *dns.Msg, domain string, clientIP net.IP) *dns.Msg {
+	if s.diagnosticsSuffix == "" {
+		return nil
+	}
+	name, found := strings.CutSuffix(domain, "."+s.diagnosticsSuffix)
+	if !found && domain != s.diagnosticsSuffix {
+		return nil
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	msg.RecursionAvailable = true
+
+	var lines []string
+	switch checked, isCheck := strings.CutSuffix(name, "."+diagnosticsCheckLabel); {
+	case name == diagnosticsStatusLabel:
+		lines = append([]string{"mode: " + s.config.Mode}, s.statsSummary()...)
+	case isCheck && checked != "":
+		ruleIP := s.ruleClientIP(r, clientIP)
+		decision := s.explainDecision(checked, dns.TypeA, ruleIP, s.getClientMAC(clientIP))
+		lines = []string{fmt.Sprintf("%s for %s: %s", checked, ruleIP, decision)}
+	case found:
+		msg.Rcode = dns.RcodeNameError
+		return msg
+	}
+
+	if r.Question[0].Qtype == dns.TypeTXT {
+		for _, line := range lines {
+			msg.Answer = append(msg.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: splitTXT(line),
+			})
+		}
+	}
+	return msg
+}
+
+// splitTXT splits a string into TXT character-strings of at most 255 bytes.
+func splitTXT(text string) []string {
+	var parts []string
+	for len(text) > maxTXTStringLength {
+		parts = append(parts, text[:maxTXTStringLength])
+		text = text[maxTXTStringLength:]
+	}
+	return append(parts, text)
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// errDNSSECBogus is returned when validate_dnssec is set and a signed upstream answer does
+// not validate.
+var errDNSSECBogus = errors.New("DNSSEC validation failed")
+
+// defaultDNSSECTrustAnchors are the DS records of the root zone's key signing keys, the
+// trust anchors used when dnssec_trust_anchors is not set.
+var defaultDNSSECTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBF683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// DNSSEC validation tuning
+const (
+	dnssecMinKeyTTL   = 30 * time.Second // Validated keys are kept at least this long
+	dnssecMaxKeyTTL   = time.Hour        // and at most this long
+	dnssecFailureTTL  = time.Minute      // Zones whose keys failed validation are retried after this
+	dnssecMaxZones    = 10000            // Expired zones and delegations are swept once more are cached
+	dnssecEDNSBufSize = 1232             // EDNS payload size of queries for DNSKEY and DS records
+
+	// NSEC3 records with more hash iterations prove an insecure delegation (RFC 9276)
+	dnssecMaxNSEC3Iterations = 150
+	nsec3OptOut              = 1 // NSEC3 flag: unsigned delegations may be skipped (RFC 5155)
+)
+
+// dnssecValidator checks the signatures of upstream answers for validate_dnssec (RFC 4035
+// section 5). The keys of each signing zone are authenticated through the DS records of the
+// zones above it, down from a trust anchor, and kept until their TTL expires. A name is only
+// accepted as unsigned when its parent zone proves the delegation insecure.
+type dnssecValidator struct {
+	anchors  map[string][]*dns.DS // Trust anchors by zone, DNSKEY anchors as their DS
+	exchange func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+
+	mu          sync.Mutex
+	zones       map[string]*dnssecZone       // Authenticated keys by zone name
+	delegations map[string]*dnssecDelegation // What the parent zone proves about each name's DS records
+
+	secure   atomic.Uint64 // Answers whose records all validated
+	insecure atomic.Uint64 // Answers with unsigned records, or signed by a zone without a chain of trust
+	bogus    atomic.Uint64 // Answers that failed validation
+}
+
+// dnssecZone is the outcome of authenticating one zone's DNSKEY set.
+type dnssecZone struct {
+	keys    []*dns.DNSKEY // Zone keys, nil when no chain of trust reaches the zone
+	err     error         // Why the keys failed validation
+	expires time.Time
+}
+
+// dnssecDelegation is what a signed parent zone proves about the DS records of a name below
+// it: the name is a signed zone (validated DS records), an insecure delegation, or no zone
+// cut at all (neither).
+type dnssecDelegation struct {
+	ds       []*dns.DS
+	insecure bool
+	err      error // Why the proof failed
+	expires  time.Time
+}
+
+// newDNSSECValidator parses the trust anchors, DS or DNSKEY records in presentation format,
+// and returns a validator that looks up DNSKEY and DS records with exchange.
+func newDNSSECValidator(trustAnchors []string, exchange func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)) (*dnssecValidator, error) {
+	v := &dnssecValidator{
+		anchors:     make(map[string][]*dns.DS),
+		exchange:    exchange,
+		zones:       make(map[string]*dnssecZone),
+		delegations: make(map[string]*dnssecDelegation),
+	}
+	for _, anchor := range trustAnchors {
+		rr, err := dns.NewRR(anchor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %q: %w", anchor, err)
+		}
+		var ds *dns.DS
+		switch rr := rr.(type) {
+		case *dns.DS:
+			ds = rr
+		case *dns.DNSKEY:
+			ds = rr.ToDS(dns.SHA256)
+		}
+		if ds == nil {
+			return nil, fmt.Errorf("invalid trust anchor %q (valid: DS, DNSKEY records)", anchor)
+		}
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	return v, nil
+}
+
+// validate checks every RRset in the answer and authority sections. An error means the
+// answer is bogus, or could not be checked if it is a dnssecFetchError. Otherwise it reports
+// whether the answer is secure: it has answer records, and all of them are signed by zones a
+// chain of trust reaches. Unsigned records are only accepted below a delegation proven
+// insecure, and a signed zone's denial of existence must carry a verified SOA or NSEC record.
+func (v *dnssecValidator) validate(ctx context.Context, resp *dns.Msg) (bool, error) {
+	secure, err := v.checkResponse(ctx, resp)
+	switch {
+	case isDNSSECFetchError(err):
+	case err != nil:
+		v.bogus.Add(1)
+	case secure:
+		v.secure.Add(1)
+	default:
+		v.insecure.Add(1)
+	}
+	return secure, err
+}
+
+// checkResponse does the checks of validate without counting the outcome.
+func (v *dnssecValidator) checkResponse(ctx context.Context, resp *dns.Msg) (bool, error) {
+	secure := len(resp.Answer) > 0
+	provenDenial := false
+	for i, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, set := range splitRRsets(section) {
+			hdr := set.rrs[0].Header()
+			if len(set.sigs) == 0 {
+				// Delegation NS records in the parent zone, and CNAMEs synthesized from a DNAME
+				// (checked on its own), are never signed
+				if (i == 1 && hdr.Rrtype == dns.TypeNS) || (hdr.Rrtype == dns.TypeCNAME && synthesizedFromDNAME(resp, hdr.Name)) {
+					continue
+				}
+				signed, err := v.isSecureName(ctx, hdr.Name)
+				if err != nil {
+					return false, fmt.Errorf("%s %s: %w", hdr.Name, dns.TypeToString[hdr.Rrtype], err)
+				}
+				if signed {
+					return false, fmt.Errorf("%s %s: not signed, but in a signed zone", hdr.Name, dns.TypeToString[hdr.Rrtype])
+				}
+				secure = false
+				continue
+			}
+			verified, err := v.verifyRRset(ctx, set.rrs, set.sigs, "")
+			if err != nil {
+				return false, fmt.Errorf("%s %s: %w", hdr.Name, dns.TypeToString[hdr.Rrtype], err)
+			}
+			if !verified {
+				secure = false
+			}
+			provenDenial = provenDenial || (i == 1 && verified)
+		}
+	}
+
+	// Stripping the whole authority section must not turn a signed denial into an insecure one
+	if len(resp.Answer) == 0 && !provenDenial && len(resp.Question) > 0 {
+		signed, err := v.isSecureName(ctx, resp.Question[0].Name)
+		if err != nil {
+			return false, err
+		}
+		if signed {
+			return false, fmt.Errorf("%s: unsigned denial of existence in a signed zone", resp.Question[0].Name)
+		}
+	}
+	return secure, nil
+}
+
+// synthesizedFromDNAME reports whether a signed DNAME in the answer covers a name, so a
+// CNAME for it may have been synthesized by the upstream (RFC 6672 section 5.3.1).
+func synthesizedFromDNAME(resp *dns.Msg, name string) bool {
+	for _, set := range splitRRsets(resp.Answer) {
+		hdr := set.rrs[0].Header()
+		if hdr.Rrtype == dns.TypeDNAME && len(set.sigs) > 0 && dns.IsSubDomain(hdr.Name, name) && !strings.EqualFold(hdr.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// signedRRset is an RRset of a message section with the signatures covering it.
+type signedRRset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// splitRRsets groups a message section into RRsets, in order of first appearance.
+func splitRRsets(section []dns.RR) []*signedRRset {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+		class uint16
+	}
+	var sets []*signedRRset
+	byKey := make(map[rrsetKey]*signedRRset)
+	get := func(key rrsetKey) *signedRRset {
+		set, ok := byKey[key]
+		if !ok {
+			set = &signedRRset{}
+			byKey[key] = set
+			sets = append(sets, set)
+		}
+		return set
+	}
+	for _, rr := range section {
+		hdr := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			set := get(rrsetKey{dns.CanonicalName(hdr.Name), sig.TypeCovered, hdr.Class})
+			set.sigs = append(set.sigs, sig)
+			continue
+		}
+		set := get(rrsetKey{dns.CanonicalName(hdr.Name), hdr.Rrtype, hdr.Class})
+		set.rrs = append(set.rrs, rr)
+	}
+
+	// Signatures without the records they cover have nothing to validate
+	kept := sets[:0]
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			kept = append(kept, set)
+		}
+	}
+	return kept
+}
+
+// verifyRRset checks that one of the signatures over an RRset is currently valid and made
+// by an authenticated key of its signer zone, which must enclose the RRset's owner. Records
+// the parent zone answers for a name, such as its DS records, pass that name as above: the
+// signer must then be a zone above it. Reports false without an error when the signer zone
+// is insecure.
+func (v *dnssecValidator) verifyRRset(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG, above string) (bool, error) {
+	owner := dns.CanonicalName(rrset[0].Header().Name)
+	now := time.Now()
+	var lastErr error
+	for _, sig := range sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, owner) || (above != "" && (signer == above || !dns.IsSubDomain(signer, above))) {
+			lastErr = fmt.Errorf("signer %s is not responsible for %s", signer, owner)
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			lastErr = fmt.Errorf("signature by %s key %d is expired or not yet valid", signer, sig.KeyTag)
+			continue
+		}
+		keys, err := v.zoneKeys(ctx, signer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if keys == nil {
+			return false, nil
+		}
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && sig.Verify(key, rrset) == nil {
+				return true, nil
+			}
+		}
+		lastErr = fmt.Errorf("no key of %s verifies the signature by key %d", signer, sig.KeyTag)
+	}
+	return false, lastErr
+}
+
+// zoneKeys returns the authenticated DNSKEY records of a zone, or nil when no chain of
+// trust reaches the zone.
+func (v *dnssecValidator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	now := time.Now()
+	v.mu.Lock()
+	cached, ok := v.zones[zone]
+	v.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.keys, cached.err
+	}
+
+	keys, ttl, err := v.authenticateZone(ctx, zone)
+	if isDNSSECFetchError(err) {
+		return nil, err // Not cached, the upstream may answer next time
+	}
+	if err != nil {
+		ttl = dnssecFailureTTL
+	}
+	v.mu.Lock()
+	v.sweepLocked(now)
+	v.zones[zone] = &dnssecZone{keys: keys, err: err, expires: now.Add(ttl)}
+	v.mu.Unlock()
+	return keys, err
+}
+
+// sweepLocked removes expired zones and delegations once more than dnssecMaxZones are cached.
+// The caller must hold v.mu.
+func (v *dnssecValidator) sweepLocked(now time.Time) {
+	if len(v.zones)+len(v.delegations) < dnssecMaxZones {
+		return
+	}
+	for name, z := range v.zones {
+		if now.After(z.expires) {
+			delete(v.zones, name)
+		}
+	}
+	for name, d := range v.delegations {
+		if now.After(d.expires) {
+			delete(v.delegations, name)
+		}
+	}
+}
+
+// authenticateZone fetches a zone's DNSKEY set and checks that it is signed by a key
+// matching one of the zone's DS records: a trust anchor, or the parent zone's signed DS
+// set. Returns the zone keys and how long they may be kept.
+func (v *dnssecValidator) authenticateZone(ctx context.Context, zone string) ([]*dns.DNSKEY, time.Duration, error) {
+	dsSet, ttl, err := v.delegationSigners(ctx, zone)
+	if err != nil || dsSet == nil {
+		return nil, ttl, err
+	}
+
+	resp, err := v.lookup(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	var keySet []dns.RR
+	var sigs []*dns.RRSIG
+	for _, set := range splitRRsets(resp.Answer) {
+		if hdr := set.rrs[0].Header(); hdr.Rrtype == dns.TypeDNSKEY && dns.CanonicalName(hdr.Name) == zone {
+			keySet, sigs = set.rrs, set.sigs
+		}
+	}
+	if len(keySet) == 0 {
+		return nil, 0, fmt.Errorf("zone %s has DS records but no DNSKEY records", zone)
+	}
+
+	now := time.Now()
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, rr := range keySet {
+			key := rr.(*dns.DNSKEY)
+			if !matchesDS(key, dsSet) || sig.Verify(key, keySet) != nil {
+				continue
+			}
+			keys := make([]*dns.DNSKEY, 0, len(keySet))
+			for _, rr := range keySet {
+				ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+				keys = append(keys, rr.(*dns.DNSKEY))
+			}
+			ttl = min(ttl, time.Until(time.Unix(int64(sig.Expiration), 0)))
+			return keys, min(max(ttl, dnssecMinKeyTTL), dnssecMaxKeyTTL), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("DNSKEY set of %s is not signed by a key matching its DS records", zone)
+}
+
+// delegationSigners returns the DS records vouching for a zone's keys and how long they may
+// be kept, or nil DS records when the zone is insecure: neither a trust anchor nor below one
+// through signed delegations.
+func (v *dnssecValidator) delegationSigners(ctx context.Context, zone string) ([]*dns.DS, time.Duration, error) {
+	if anchors, ok := v.anchors[zone]; ok {
+		return anchors, dnssecMaxKeyTTL, nil
+	}
+	if zone == "." {
+		return nil, dnssecMaxKeyTTL, nil
+	}
+	signed, err := v.isSecureName(ctx, parentName(zone))
+	if err != nil || !signed {
+		return nil, dnssecMaxKeyTTL, err
+	}
+	d, err := v.delegation(ctx, zone)
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.insecure {
+		return nil, time.Until(d.expires), nil
+	}
+	if d.ds == nil {
+		return nil, 0, fmt.Errorf("%s signs records but is not a delegated zone", zone)
+	}
+	return d.ds, time.Until(d.expires), nil
+}
+
+// isSecureName reports whether a name is in a signed zone a chain of trust reaches: below a
+// trust anchor, and with no delegation proven insecure on the way down to it.
+func (v *dnssecValidator) isSecureName(ctx context.Context, name string) (bool, error) {
+	name = dns.CanonicalName(name)
+	// The name and the names above it, most specific first
+	var names []string
+	for _, offset := range dns.Split(name) {
+		names = append(names, name[offset:])
+	}
+	if name != "." {
+		names = append(names, ".")
+	}
+
+	anchor := -1
+	for i, n := range names {
+		if _, ok := v.anchors[n]; ok {
+			anchor = i
+			break
+		}
+	}
+	if anchor < 0 {
+		return false, nil // No trust anchor above the name
+	}
+	for i := anchor - 1; i >= 0; i-- {
+		d, err := v.delegation(ctx, names[i])
+		if err != nil {
+			return false, err
+		}
+		if d.insecure {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// delegation returns what the signed zone above a name proves about the name's DS records.
+func (v *dnssecValidator) delegation(ctx context.Context, name string) (*dnssecDelegation, error) {
+	now := time.Now()
+	v.mu.Lock()
+	cached, ok := v.delegations[name]
+	v.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached, cached.err
+	}
+
+	d, ttl, err := v.proveDelegation(ctx, name)
+	if isDNSSECFetchError(err) {
+		return nil, err // Not cached, the upstream may answer next time
+	}
+	if err != nil {
+		d, ttl = &dnssecDelegation{err: err}, dnssecFailureTTL
+	}
+	d.expires = now.Add(min(max(ttl, dnssecMinKeyTTL), dnssecMaxKeyTTL))
+	v.mu.Lock()
+	v.sweepLocked(now)
+	v.delegations[name] = d
+	v.mu.Unlock()
+	return d, err
+}
+
+// proveDelegation looks up the DS records of a name in a signed zone and checks them, or
+// the NSEC or NSEC3 records proving there are none (RFC 4035 section 5.2, RFC 5155 section
+// 8.6). Returns the outcome and how long it may be kept.
+func (v *dnssecValidator) proveDelegation(ctx context.Context, name string) (*dnssecDelegation, time.Duration, error) {
+	resp, err := v.lookup(ctx, name, dns.TypeDS)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, set := range splitRRsets(resp.Answer) {
+		hdr := set.rrs[0].Header()
+		if dns.CanonicalName(hdr.Name) != name || (hdr.Rrtype != dns.TypeDS && hdr.Rrtype != dns.TypeCNAME) {
+			continue
+		}
+		// The parent zone must sign the DS set (or the CNAME, which rules out a zone cut)
+		if len(set.sigs) == 0 {
+			return nil, 0, fmt.Errorf("%s records of %s are not signed", dns.TypeToString[hdr.Rrtype], name)
+		}
+		verified, err := v.verifyRRset(ctx, set.rrs, set.sigs, name)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s records of %s: %w", dns.TypeToString[hdr.Rrtype], name, err)
+		}
+		if !verified {
+			return nil, 0, fmt.Errorf("%s records of %s are signed by an insecure zone", dns.TypeToString[hdr.Rrtype], name)
+		}
+		ttl := rrsetTTL(set.rrs)
+		if hdr.Rrtype == dns.TypeCNAME {
+			return &dnssecDelegation{}, ttl, nil
+		}
+		d := &dnssecDelegation{}
+		for _, rr := range set.rrs {
+			d.ds = append(d.ds, rr.(*dns.DS))
+		}
+		return d, ttl, nil
+	}
+
+	// No DS records: the parent zone must prove their absence
+	for _, set := range splitRRsets(resp.Ns) {
+		rrtype := set.rrs[0].Header().Rrtype
+		if (rrtype != dns.TypeNSEC && rrtype != dns.TypeNSEC3) || len(set.sigs) == 0 {
+			continue
+		}
+		if verified, err := v.verifyRRset(ctx, set.rrs, set.sigs, name); err != nil || !verified {
+			continue
+		}
+		for _, rr := range set.rrs {
+			if d, err := denialProof(rr, name); d != nil || err != nil {
+				return d, rrsetTTL(set.rrs), err
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("no proof that %s has no DS records", name)
+}
+
+// denialProof returns what a verified NSEC or NSEC3 record proves about the DS records of a
+// name, or nil if it says nothing about the name.
+func denialProof(rr dns.RR, name string) (*dnssecDelegation, error) {
+	switch rr := rr.(type) {
+	case *dns.NSEC:
+		if dns.CanonicalName(rr.Hdr.Name) == name {
+			return delegationFromTypes(rr.TypeBitMap, name)
+		}
+		if nsecCovers(rr, name) {
+			return &dnssecDelegation{}, nil // The name doesn't exist, or is an empty non-terminal
+		}
+	case *dns.NSEC3:
+		if rr.Iterations > dnssecMaxNSEC3Iterations {
+			return &dnssecDelegation{insecure: true}, nil
+		}
+		if rr.Match(name) {
+			return delegationFromTypes(rr.TypeBitMap, name)
+		}
+		if rr.Cover(name) {
+			// Opt-out spans may hide unsigned delegations; otherwise the name doesn't exist
+			return &dnssecDelegation{insecure: rr.Flags&nsec3OptOut != 0}, nil
+		}
+	}
+	return nil, nil
+}
+
+// delegationFromTypes interprets the type bitmap of the NSEC or NSEC3 record of a name
+// without DS records.
+func delegationFromTypes(types []uint16, name string) (*dnssecDelegation, error) {
+	has := func(rrtype uint16) bool {
+		for _, t := range types {
+			if t == rrtype {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has(dns.TypeDS):
+		return nil, fmt.Errorf("denial of DS records of %s lists DS", name)
+	case has(dns.TypeNS) && !has(dns.TypeSOA):
+		return &dnssecDelegation{insecure: true}, nil
+	}
+	return &dnssecDelegation{}, nil
+}
+
+// nsecCovers reports whether an NSEC record proves that a name doesn't exist: the name sorts
+// between the record's owner and next name, in canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := dns.CanonicalName(nsec.Hdr.Name), dns.CanonicalName(nsec.NextDomain)
+	afterOwner := canonicalCompare(owner, name) < 0
+	beforeNext := canonicalCompare(name, next) < 0
+	if canonicalCompare(owner, next) < 0 {
+		return afterOwner && beforeNext
+	}
+	return afterOwner || beforeNext // The last NSEC of the zone wraps around to the apex
+}
+
+// canonicalCompare compares two lower-case names in DNSSEC canonical order (RFC 4034
+// section 6.1), label by label from the right.
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// parentName returns the name one label above a name.
+func parentName(name string) string {
+	if offset, end := dns.NextLabel(name, 0); !end {
+		return name[offset:]
+	}
+	return "."
+}
+
+// rrsetTTL returns the lowest TTL of an RRset.
+func rrsetTTL(rrs []dns.RR) time.Duration {
+	ttl := dnssecMaxKeyTTL
+	for _, rr := range rrs {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	return ttl
+}
+
+// matchesDS reports whether a key signing key matches one of a zone's DS records.
+func matchesDS(key *dns.DNSKEY, dsSet []*dns.DS) bool {
+	tag := key.KeyTag()
+	for _, ds := range dsSet {
+		if ds.KeyTag != tag || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		if digest := key.ToDS(ds.DigestType); digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnssecFetchError is a failure to look up DNSKEY or DS records, as opposed to records that
+// failed validation.
+type dnssecFetchError struct {
+	name  string
+	qtype uint16
+	err   error
+}
+
+func (e *dnssecFetchError) Error() string {
+	return fmt.Sprintf("looking up %s %s: %v", e.name, dns.TypeToString[e.qtype], e.err)
+}
+
+func (e *dnssecFetchError) Unwrap() error {
+	return e.err
+}
+
+// isDNSSECFetchError reports whether validation failed because DNSKEY or DS records could not
+// be looked up, so the answer is neither secure nor bogus.
+func isDNSSECFetchError(err error) bool {
+	var fetchErr *dnssecFetchError
+	return errors.As(err, &fetchErr)
+}
+
+// lookup queries the upstreams for a zone's DNSKEY or DS records.
+func (v *dnssecValidator) lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	resp, err := v.exchange(ctx, name, qtype)
+	if err != nil {
+		return nil, &dnssecFetchError{name: name, qtype: qtype, err: err}
+	}
+	return resp, nil
+}
+
+// lookupDNSSECRecords queries the nameservers a name is routed to, in order, for records the
+// validator needs. Checking is disabled, so upstreams that validate themselves still return
+// the records, and the answers skip the checks of regular forwarding.
+func (s *DNSServer) lookupDNSSECRecords(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.CheckingDisabled = true
+	req.SetEdns0(dnssecEDNSBufSize, true)
+
+	err := errNoEligibleNameserver
+	for _, nameserver := range s.upstreamGroupFor(normalizeDomain(name)).nameservers {
+		if nameserver.self || !nameserver.acceptsQtype(qtype) {
+			continue
+		}
+		address := net.JoinHostPort(nameserver.Address, fmt.Sprintf("%d", nameserver.Port))
+		var resp *dns.Msg
+		resp, err = s.forwardToNameserver(ctx, req, nameserver, address)
+		if err != nil {
+			continue
+		}
+		if resp != nil && resp.Truncated && !isTCPBasedProtocol(nameserver.Protocol) {
+			resp = s.handleTruncatedResponse(ctx, req, address, name)
+		}
+		if resp == nil || responseMismatch(req, resp) != "" {
+			err = fmt.Errorf("no usable answer from %s", address)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("%s from %s", getRcodeName(resp.Rcode), address)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// withoutAddedDNSSEC undoes the DNSSEC OK bit withUpstreamEDNS set on a query for
+// validate_dnssec when the client did not set it: the DNSSEC records the client didn't ask
+// for are removed, and the AD bit is only kept if the client set it (RFC 6840 section 5.8).
+func (s *DNSServer) withoutAddedDNSSEC(r, resp *dns.Msg) {
+	if s.dnssecValidator == nil || wantsDNSSEC(r) {
+		return
+	}
+	stripDNSSECRecords(resp, r.Question[0].Qtype)
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+	resp.AuthenticatedData = resp.AuthenticatedData && r.AuthenticatedData
+}
+
+// createDNSSECBogusResponse creates a SERVFAIL response for an answer that failed DNSSEC
+// validation.
+func (s *DNSServer) createDNSSECBogusResponse(r *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.RecursionAvailable = true
+	msg.SetRcode(r, dns.RcodeServerFailure)
+	s.addExtendedError(msg, r, dns.ExtendedErrorCodeDNSBogus, "DNSSEC validation failed")
+	return msg
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testSignedZone is a zone with a key signing key and a zone signing key.
+type testSignedZone struct {
+	name       string
+	ksk, zsk   *dns.DNSKEY
+	kskSigner  crypto.Signer
+	zskSigner  crypto.Signer
+	validUntil time.Time
+}
+
+func newTestSignedZone(t *testing.T, name string) *testSignedZone {
+	t.Helper()
+	z := &testSignedZone{name: name, validUntil: time.Now().Add(time.Hour)}
+	generate := func(flags uint16) (*dns.DNSKEY, crypto.Signer) {
+		key := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     flags,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, priv.(crypto.Signer)
+	}
+	z.ksk, z.kskSigner = generate(dns.ZONE | dns.SEP)
+	z.zsk, z.zskSigner = generate(dns.ZONE)
+	return z
+}
+
+// sign returns the RRset followed by its signature, made with the zone signing key.
+func (z *testSignedZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	return z.signWith(t, z.zsk, z.zskSigner, rrs)
+}
+
+func (z *testSignedZone) signWith(t *testing.T, key *dns.DNSKEY, signer crypto.Signer, rrs []dns.RR) []dns.RR {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		KeyTag:     key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(z.validUntil.Unix()),
+	}
+	if err := sig.Sign(signer, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]dns.RR{}, rrs...), sig)
+}
+
+// keys returns the zone's DNSKEY set signed by its key signing key.
+func (z *testSignedZone) keys(t *testing.T) []dns.RR {
+	return z.signWith(t, z.ksk, z.kskSigner, []dns.RR{z.ksk, z.zsk})
+}
+
+// ds returns the DS record of the zone's key signing key.
+func (z *testSignedZone) ds() *dns.DS {
+	return z.ksk.ToDS(dns.SHA256)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func testNSEC(owner, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// testAnswer is the response of the test authority for one name and type.
+type testAnswer struct {
+	rcode  int
+	answer []dns.RR
+	ns     []dns.RR
+}
+
+// dnssecTestServer starts a validating server in front of a signed example.test zone with a
+// signed child zone sub.example.test and an unsigned delegation plain.example.test.
+func dnssecTestServer(t *testing.T, tweak func(answers map[string]testAnswer)) *DNSServer {
+	t.Helper()
+	parent := newTestSignedZone(t, "example.test.")
+	child := newTestSignedZone(t, "sub.example.test.")
+	soa := mustRR(t, "example.test. 300 IN SOA ns.example.test. host.example.test. 1 3600 600 86400 300")
+
+	tampered := parent.sign(t, mustRR(t, "bad.example.test. 300 IN A 10.0.0.2"))
+	tampered[0] = mustRR(t, "bad.example.test. 300 IN A 6.6.6.6")
+
+	answers := map[string]testAnswer{
+		"example.test./DNSKEY":     {answer: parent.keys(t)},
+		"sub.example.test./DNSKEY": {answer: child.keys(t)},
+		"sub.example.test./DS":     {answer: parent.sign(t, child.ds())},
+		"plain.example.test./DS": {ns: append(parent.sign(t, soa),
+			parent.sign(t, testNSEC("plain.example.test.", "strip.example.test.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))...)},
+		"strip.example.test./DS": {ns: append(parent.sign(t, soa),
+			parent.sign(t, testNSEC("strip.example.test.", "sub.example.test.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))...)},
+		"gone.example.test./DS": {rcode: dns.RcodeNameError, ns: append(parent.sign(t, soa),
+			parent.sign(t, testNSEC("example.test.", "plain.example.test.", dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY))...)},
+
+		"www.example.test./A":        {answer: parent.sign(t, mustRR(t, "www.example.test. 300 IN A 10.0.0.1"))},
+		"bad.example.test./A":        {answer: tampered},
+		"www.sub.example.test./A":    {answer: child.sign(t, mustRR(t, "www.sub.example.test. 300 IN A 10.0.0.3"))},
+		"host.plain.example.test./A": {answer: []dns.RR{mustRR(t, "host.plain.example.test. 300 IN A 10.0.0.4")}},
+		"strip.example.test./A":      {answer: []dns.RR{mustRR(t, "strip.example.test. 300 IN A 6.6.6.6")}},
+		"gone.example.test./A":       {rcode: dns.RcodeNameError},
+		"none.example.test./A": {rcode: dns.RcodeNameError, ns: append(parent.sign(t, soa),
+			parent.sign(t, testNSEC("example.test.", "plain.example.test.", dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY))...)},
+	}
+	if tweak != nil {
+		tweak(answers)
+	}
+	authority := func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		entry, ok := answers[strings.ToLower(q.Name)+"/"+dns.TypeToString[q.Qtype]]
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		if !ok {
+			msg.Rcode = dns.RcodeServerFailure
+		}
+		if entry.rcode != 0 {
+			msg.Rcode = entry.rcode
+		}
+		msg.Answer, msg.Ns = entry.answer, entry.ns
+		if opt := r.IsEdns0(); opt != nil {
+			msg.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		}
+		_ = w.WriteMsg(msg)
+	}
+	return newTestServer(t, &Config{
+		ValidateDNSSEC:     true,
+		DNSSECTrustAnchors: []string{parent.ds().String()},
+		Nameservers:        startTestUpstream(t, authority, authority),
+	})
+}
+
+// dnssecQuery sends an A query with the DNSSEC OK bit set.
+func dnssecQuery(t *testing.T, s *DNSServer, name string) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+	resp, err := s.Query(testClient, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	s := dnssecTestServer(t, nil)
+	tests := []struct {
+		name   string
+		rcode  int
+		secure bool
+	}{
+		{"www.example.test", dns.RcodeSuccess, true},
+		{"www.sub.example.test", dns.RcodeSuccess, true},      // Through the signed delegation
+		{"host.plain.example.test", dns.RcodeSuccess, false},  // Below a proven insecure delegation
+		{"none.example.test", dns.RcodeNameError, false},      // Signed denial
+		{"bad.example.test", dns.RcodeServerFailure, false},   // Altered after signing
+		{"strip.example.test", dns.RcodeServerFailure, false}, // Signatures removed
+		{"gone.example.test", dns.RcodeServerFailure, false},  // Denial with its proof removed
+	}
+	for _, tt := range tests {
+		resp := dnssecQuery(t, s, tt.name)
+		if resp.Rcode != tt.rcode || resp.AuthenticatedData != tt.secure {
+			t.Errorf("%s: rcode %s, AD %v, want %s, AD %v", tt.name, dns.RcodeToString[resp.Rcode], resp.AuthenticatedData,
+				dns.RcodeToString[tt.rcode], tt.secure)
+		}
+	}
+	if bogus := s.dnssecValidator.bogus.Load(); bogus != 3 {
+		t.Errorf("bogus answers = %d, want 3", bogus)
+	}
+}
+
+func TestDNSSECStrippedForClientsWithoutDO(t *testing.T) {
+	s := dnssecTestServer(t, nil)
+	resp := testQuery(t, s, "www.example.test", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.IsEdns0() != nil {
+		t.Errorf("answer = %v, want the A record without its RRSIG or an OPT record", resp)
+	}
+}
+
+func TestDNSSECLookupFailureIsNotBogus(t *testing.T) {
+	s := dnssecTestServer(t, func(answers map[string]testAnswer) {
+		delete(answers, "example.test./DNSKEY") // Answered with SERVFAIL
+	})
+	resp := dnssecQuery(t, s, "www.example.test")
+	if resp.Rcode == dns.RcodeServerFailure {
+		t.Errorf("rcode = SERVFAIL, want the lookup failure treated as the nameserver failing")
+	}
+	if bogus := s.dnssecValidator.bogus.Load(); bogus != 0 {
+		t.Errorf("bogus answers = %d, want 0", bogus)
+	}
+	if atomic.LoadUint64(&s.stats.cacheHits) != 0 {
+		t.Error("unexpected cache hit")
+	}
+}
+
+func TestDenialProofNSEC3(t *testing.T) {
+	name := "child.example.test."
+	hashed := func(n string) string {
+		return strings.ToLower(dns.HashName(n, dns.SHA1, 0, "")) + ".example.test."
+	}
+	nsec3 := func(owner, next string, flags uint8, types ...uint16) *dns.NSEC3 {
+		return &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			NextDomain: next,
+			HashLength: 20,
+			TypeBitMap: types,
+		}
+	}
+	lowest, highest := strings.Repeat("0", 32), strings.Repeat("V", 32)
+
+	tests := []struct {
+		desc     string
+		rr       dns.RR
+		insecure bool
+		noCut    bool
+		err      bool
+	}{
+		{"matching, delegation without DS", nsec3(hashed(name), highest, 0, dns.TypeNS), true, false, false},
+		{"matching, not a zone cut", nsec3(hashed(name), highest, 0, dns.TypeA, dns.TypeRRSIG), false, true, false},
+		{"matching, lists DS", nsec3(hashed(name), highest, 0, dns.TypeNS, dns.TypeDS), false, false, true},
+		{"covering with opt-out", nsec3(lowest+".example.test.", highest, nsec3OptOut), true, false, false},
+		{"covering without opt-out", nsec3(lowest+".example.test.", highest, 0), false, true, false},
+	}
+	for _, tt := range tests {
+		d, err := denialProof(tt.rr, name)
+		switch {
+		case tt.err:
+			if err == nil {
+				t.Errorf("%s: no error", tt.desc)
+			}
+		case err != nil || d == nil:
+			t.Errorf("%s: proof %v, error %v", tt.desc, d, err)
+		case d.insecure != tt.insecure || (d.ds == nil && !d.insecure) != tt.noCut:
+			t.Errorf("%s: insecure %v, want %v", tt.desc, d.insecure, tt.insecure)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "github.com/miekg/dns"
+
+// dnssecStripWriter removes DNSSEC records from responses to clients that did not set the
+// DNSSEC OK bit (RFC 4035 section 3.2.1, RFC 6840 section 5.9), for strip_dnssec.
+// It runs as the response is written, so after any processing of the signed answer.
+type dnssecStripWriter struct {
+	dns.ResponseWriter
+	qtype uint16 // Explicitly queried DNSSEC types are kept
+}
+
+// wantsDNSSEC reports whether a query set the DNSSEC OK bit.
+func wantsDNSSEC(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// isDNSSECType reports whether a record type only carries DNSSEC data.
+func isDNSSECType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDNSKEY, dns.TypeDS:
+		return true
+	}
+	return false
+}
+
+// WriteMsg strips DNSSEC records that were not explicitly asked for.
+func (w *dnssecStripWriter) WriteMsg(msg *dns.Msg) error {
+	msg = msg.Copy()
+	stripDNSSECRecords(msg, w.qtype)
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// stripDNSSECRecords removes DNSSEC records from every section of a message, except those of
+// the queried type.
+func stripDNSSECRecords(msg *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			if rrtype := rr.Header().Rrtype; !isDNSSECType(rrtype) || rrtype == qtype {
+				kept = append(kept, rr)
+			}
+		}
+		return kept
+	}
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+	msg.Extra = strip(msg.Extra)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dohJSONResponse is the Google/Cloudflare style DNS-over-HTTPS JSON response.
+type dohJSONResponse struct {
+	Status    int               `json:"Status"`
+	TC        bool              `json:"TC"`
+	RD        bool              `json:"RD"`
+	RA        bool              `json:"RA"`
+	AD        bool              `json:"AD"`
+	CD        bool              `json:"CD"`
+	Question  []dohJSONQuestion `json:"Question"`
+	Answer    []dohJSONRecord   `json:"Answer,omitempty"`
+	Authority []dohJSONRecord   `json:"Authority,omitempty"`
+}
+
+// dohJSONQuestion is a question entry in a DoH JSON response.
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// dohJSONRecord is a resource record entry in a DoH JSON response.
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// forwardDOHJSON forwards a DNS request using the DNS-over-HTTPS JSON API.
+func (s *DNSServer) forwardDOHJSON(ctx context.Context, r *dns.Msg, nameserver NameserverConfig) (*dns.Msg, error) {
+	if len(r.Question) == 0 {
+		return nil, fmt.Errorf("no question in request")
+	}
+	q := r.Question[0]
+
+	// Build DOH JSON URL
+	var endpoint string
+	if strings.HasPrefix(nameserver.Address, "http://") || strings.HasPrefix(nameserver.Address, "https://") {
+		endpoint = nameserver.Address
+	} else {
+		// Try common DOH JSON endpoints
+		switch nameserver.Address {
+		case "1.1.1.1", "1.0.0.1":
+			endpoint = "https://cloudflare-dns.com/dns-query"
+		case "8.8.8.8", "8.8.4.4":
+			endpoint = "https://dns.google/resolve"
+		default:
+			// Default DOH JSON endpoint format
+			endpoint = fmt.Sprintf("https://%s/resolve", nameserver.Address)
+		}
+	}
+
+	params := url.Values{}
+	params.Set("name", q.Name)
+	params.Set("type", strconv.Itoa(int(q.Qtype)))
+	if r.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		params.Set("do", "1")
+	}
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+sep+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Accept", "application/dns-json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			s.debugLog("Warning: failed to close response body: %v", closeErr)
+		}
+	}()
+
+	return parseDOHJSONResponse(r, resp)
+}
+
+// parseDOHJSONResponse parses a DoH JSON response into a DNS message answering r.
+func parseDOHJSONResponse(r *dns.Msg, resp *http.Response) (*dns.Msg, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var jsonResp dohJSONResponse
+	if err := json.Unmarshal(body, &jsonResp); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON response: %w", err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Rcode = jsonResp.Status
+	msg.Truncated = jsonResp.TC
+	msg.RecursionAvailable = jsonResp.RA
+	msg.AuthenticatedData = jsonResp.AD
+	msg.CheckingDisabled = jsonResp.CD
+	msg.Answer = dohJSONRecordsToRRs(jsonResp.Answer)
+	msg.Ns = dohJSONRecordsToRRs(jsonResp.Authority)
+	return msg, nil
+}
+
+// dohJSONRecordsToRRs converts DoH JSON records into DNS resource records.
+// Records that cannot be converted are skipped.
+func dohJSONRecordsToRRs(records []dohJSONRecord) []dns.RR {
+	var rrs []dns.RR
+	for _, rec := range records {
+		if rr := dohJSONRecordToRR(rec); rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// dohJSONRecordToRR converts a single DoH JSON record into a DNS resource record.
+func dohJSONRecordToRR(rec dohJSONRecord) dns.RR {
+	hdr := dns.RR_Header{
+		Name:   dns.Fqdn(rec.Name),
+		Rrtype: rec.Type,
+		Class:  dns.ClassINET,
+		Ttl:    rec.TTL,
+	}
+
+	switch rec.Type {
+	case dns.TypeA:
+		ip := net.ParseIP(rec.Data).To4()
+		if ip == nil {
+			return nil
+		}
+		return &dns.A{Hdr: hdr, A: ip}
+	case dns.TypeAAAA:
+		ip := net.ParseIP(rec.Data)
+		if ip == nil || ip.To4() != nil {
+			return nil
+		}
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}
+	case dns.TypeCNAME:
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(rec.Data)}
+	case dns.TypeMX:
+		fields := strings.Fields(rec.Data)
+		if len(fields) != 2 {
+			return nil
+		}
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil
+		}
+		return &dns.MX{Hdr: hdr, Preference: uint16(pref), Mx: dns.Fqdn(fields[1])}
+	case dns.TypeTXT:
+		// Some providers quote TXT data, others return it raw
+		data := rec.Data
+		if !strings.HasPrefix(data, "\"") {
+			return &dns.TXT{Hdr: hdr, Txt: []string{data}}
+		}
+	}
+
+	// Fall back to parsing the presentation format for other types
+	typeName, ok := dns.TypeToString[rec.Type]
+	if !ok {
+		return nil
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", hdr.Name, rec.TTL, typeName, rec.Data))
+	if err != nil {
+		return nil
+	}
+	return rr
+}
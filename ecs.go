@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// getCoalescingKey returns the key under which identical upstream queries are coalesced.
+// Queries whose ECS option is forwarded upstream may get network-specific answers, so their
+// key includes the client subnet. All other queries share the cheaper cache key.
+func (s *DNSServer) getCoalescingKey(r *dns.Msg, view string) string {
+	key := getCacheKey(r, view)
+	if key == "" || s.config.ECSPrivacy {
+		return key
+	}
+	if ecs := requestECS(r); ecs != nil {
+		return fmt.Sprintf("%s:ecs=%s/%d", key, ecs.Address, ecs.SourceNetmask)
+	}
+	return key
+}
+
+// requestECS returns the EDNS Client Subnet option of a message, or nil.
+func requestECS(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// clientSubnetECS returns an EDNS Client Subnet option for the network of a client address,
+// truncated to prefixV4 or prefixV6 bits.
+func clientSubnetECS(clientIP net.IP, prefixV4, prefixV6 int) *dns.EDNS0_SUBNET {
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := clientIP.To4(); ip4 != nil {
+		ecs.Family, ecs.SourceNetmask = 1, uint8(prefixV4)
+		ecs.Address = ip4.Mask(net.CIDRMask(prefixV4, 32))
+	} else {
+		ecs.Family, ecs.SourceNetmask = 2, uint8(prefixV6)
+		ecs.Address = clientIP.Mask(net.CIDRMask(prefixV6, 128))
+	}
+	return ecs
+}
+
+// addECS appends an EDNS Client Subnet option to a query, adding an OPT record if it has none.
+func addECS(r *dns.Msg, ecs *dns.EDNS0_SUBNET) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		r.SetEdns0(defaultUpstreamEDNSBufSize, false)
+		opt = r.IsEdns0()
+	}
+	opt.Option = append(opt.Option, ecs)
+}
+
+// removeAddedECS removes an ECS option added to a client's query from the response, and the
+// OPT record too if the client sent none.
+func removeAddedECS(resp *dns.Msg, hadOPT bool) {
+	if !hadOPT {
+		removeOPT(resp)
+	} else if opt := resp.IsEdns0(); opt != nil {
+		removeECS(opt)
+	}
+}
+
+// forwardECS returns the ECS option enable_ecs adds to a client's queries, or nil for clients
+// whose address says nothing about their location: private, loopback and link-local addresses,
+// and trust_ecs_from forwarders.
+func (s *DNSServer) forwardECS(clientIP net.IP) *dns.EDNS0_SUBNET {
+	if clientIP == nil || !clientIP.IsGlobalUnicast() || clientIP.IsPrivate() || subnetsContain(s.trustECSFrom, clientIP) {
+		return nil
+	}
+	return clientSubnetECS(clientIP, s.config.ECSPrefixV4, s.config.ECSPrefixV6)
+}
+
+// ecsAddedWriter hides the ECS option enable_ecs added to a query from the client's answer.
+type ecsAddedWriter struct {
+	dns.ResponseWriter
+	hadOPT bool // Whether the client's query had an OPT record
+}
+
+// WriteMsg removes the added ECS option from a copy of the response, since the message may
+// be shared with coalesced waiters.
+func (w *ecsAddedWriter) WriteMsg(msg *dns.Msg) error {
+	msg = msg.Copy()
+	removeAddedECS(msg, w.hadOPT)
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// withoutECS returns a copy of a message with its EDNS Client Subnet option removed.
+func withoutECS(r *dns.Msg) *dns.Msg {
+	stripped := r.Copy()
+	removeECS(stripped.IsEdns0())
+	return stripped
+}
+
+// removeECS removes any EDNS Client Subnet options from an OPT record.
+func removeECS(opt *dns.OPT) {
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0SUBNET {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
+
+// ecsScopeWriter answers ECS queries in ecs_privacy mode with SCOPE PREFIX-LENGTH 0,
+// telling the client the answer is valid for all networks since no subnet was sent upstream.
+type ecsScopeWriter struct {
+	dns.ResponseWriter
+	ecs *dns.EDNS0_SUBNET // ECS option from the client's query
+}
+
+// WriteMsg adds the client's ECS option with scope /0 to the response.
+func (w *ecsScopeWriter) WriteMsg(msg *dns.Msg) error {
+	msg = msg.Copy()
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.MinMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0SUBNET {
+			options = append(options, option)
+		}
+	}
+	opt.Option = append(options, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        w.ecs.Family,
+		SourceNetmask: w.ecs.SourceNetmask,
+		SourceScope:   0,
+		Address:       w.ecs.Address,
+	})
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// ecsFamilyBits returns the address length of an ECS family and its index in ecsScopeLens.
+func ecsFamilyBits(family uint16) (bits, idx int, ok bool) {
+	switch family {
+	case 1:
+		return 32, 0, true
+	case 2:
+		return 128, 1, true
+	}
+	return 0, 0, false
+}
+
+// ecsScopeCacheKey returns the cache key for an ECS address truncated to a scope prefix length.
+func ecsScopeCacheKey(key string, ecs *dns.EDNS0_SUBNET, bits int, scope uint8) string {
+	addr := ecs.Address.To16()
+	if bits == 32 {
+		addr = ecs.Address.To4()
+	}
+	if addr == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:scope=%s/%d", key, addr.Mask(net.CIDRMask(int(scope), bits)), scope)
+}
+
+// scopedCacheKey returns the key under which the answer to an ECS query is cached. An answer
+// with a non-zero ECS scope is only valid for the network the scope covers (RFC 7871 section 7.3),
+// so it is cached under that network. Answers with scope /0 are cached globally under key.
+func (s *DNSServer) scopedCacheKey(key string, r, resp *dns.Msg) string {
+	if s.config.ECSPrivacy {
+		return key
+	}
+	ecs, respECS := requestECS(r), requestECS(resp)
+	if ecs == nil || respECS == nil || respECS.SourceScope == 0 {
+		return key
+	}
+	bits, idx, ok := ecsFamilyBits(ecs.Family)
+	if !ok {
+		return key
+	}
+	// A scope longer than the query revealed can't be told apart from the query's own network
+	scope := min(respECS.SourceScope, ecs.SourceNetmask, uint8(bits))
+	if scope == 0 {
+		return key
+	}
+	scopedKey := ecsScopeCacheKey(key, ecs, bits, scope)
+	if scopedKey == "" {
+		return key
+	}
+
+	s.ecsScopeLens[idx][scope].Store(true)
+	return scopedKey
+}
+
+// lookupScopedCacheEntry returns the unexpired cache entry for an ECS query whose scope
+// network contains the query's address, most specific scope first.
+func (s *DNSServer) lookupScopedCacheEntry(key string, r *dns.Msg) *CacheEntry {
+	if s.config.ECSPrivacy {
+		return nil
+	}
+	ecs := requestECS(r)
+	if ecs == nil {
+		return nil
+	}
+	bits, idx, ok := ecsFamilyBits(ecs.Family)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	for scope := min(int(ecs.SourceNetmask), bits); scope > 0; scope-- {
+		if !s.ecsScopeLens[idx][scope].Load() {
+			continue
+		}
+		if entry, exists := s.lookupCacheEntry(ecsScopeCacheKey(key, ecs, bits, uint8(scope))); exists && now.Before(entry.ExpiresAt) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// isScopedCacheKey reports whether a cache key holds an answer for one ECS scope network.
+func isScopedCacheKey(key string) bool {
+	return strings.Contains(key, ":scope=")
+}
+
+// markECSScope records the ECS scope length of a restored scoped cache key, so lookups try it.
+func (s *DNSServer) markECSScope(key string) {
+	i := strings.LastIndex(key, ":scope=")
+	if i < 0 {
+		return
+	}
+	prefix, err := netip.ParsePrefix(key[i+len(":scope="):])
+	if err != nil || prefix.Bits() <= 0 {
+		return
+	}
+	idx := 0
+	if prefix.Addr().Is6() {
+		idx = 1
+	}
+	s.ecsScopeLens[idx][prefix.Bits()].Store(true)
+}
+
+// echoECS sets the ECS option of a scoped cached answer to the source network of the query
+// it answers, keeping the cached scope (RFC 7871 section 7.2.1).
+func echoECS(resp, r *dns.Msg) {
+	ecs, respECS := requestECS(r), requestECS(resp)
+	if ecs == nil || respECS == nil {
+		return
+	}
+	respECS.Family = ecs.Family
+	respECS.SourceNetmask = ecs.SourceNetmask
+	respECS.Address = ecs.Address
+}
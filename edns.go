@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ruleClientIP returns the client address used for block and overwrite matching.
+// Queries from trust_ecs_from peers are matched on their EDNS Client Subnet address;
+// all other queries, and trusted queries without ECS, use the transport address.
+func (s *DNSServer) ruleClientIP(r *dns.Msg, clientIP net.IP) net.IP {
+	if len(s.trustECSFrom) == 0 || !subnetsContain(s.trustECSFrom, clientIP) {
+		return clientIP
+	}
+	if ecs := requestECS(r); ecs != nil && ecs.SourceNetmask > 0 && ecs.Address != nil {
+		return ecs.Address
+	}
+	return clientIP
+}
+
+// withUpstreamEDNS returns the request to send upstream, advertising upstream_edns_bufsize
+// so large answers fit in a single UDP response instead of needing a TCP retry.
+// A client's own OPT record is forwarded unchanged, except that its ECS option is removed
+// in ecs_privacy mode, and that validate_dnssec sets the DNSSEC OK bit so signed zones
+// answer with their signatures. Reports whether an OPT record was added.
+func (s *DNSServer) withUpstreamEDNS(r *dns.Msg) (*dns.Msg, bool) {
+	if s.config.ECSPrivacy && requestECS(r) != nil {
+		r = withoutECS(r)
+	}
+	validating := s.dnssecValidator != nil && !wantsDNSSEC(r)
+	if r.IsEdns0() != nil {
+		if !validating {
+			return r, false
+		}
+		upstreamReq := r.Copy()
+		upstreamReq.IsEdns0().SetDo()
+		return upstreamReq, false
+	}
+	bufSize := s.config.UpstreamEDNSBufSize
+	if bufSize <= 0 {
+		if !validating {
+			return r, false
+		}
+		bufSize = dnssecEDNSBufSize
+	}
+	if bufSize < dns.MinMsgSize {
+		bufSize = dns.MinMsgSize
+	}
+	if bufSize > dns.MaxMsgSize {
+		bufSize = dns.MaxMsgSize
+	}
+
+	upstreamReq := r.Copy()
+	// nolint:gosec // Safe: bufSize is clamped to the uint16 range above
+	upstreamReq.SetEdns0(uint16(bufSize), validating)
+	return upstreamReq, true
+}
+
+// padUpstreamQuery returns a copy of an encrypted-transport query padded (RFC 7830) to a
+// multiple of edns_padding_block_size, so its size doesn't reveal the name being resolved.
+// Reports whether an OPT record was added to carry the padding.
+func (s *DNSServer) padUpstreamQuery(r *dns.Msg) (*dns.Msg, bool) {
+	padded := r.Copy()
+	addedOpt := false
+	opt := padded.IsEdns0()
+	if opt == nil {
+		padded.SetEdns0(dns.MinMsgSize, false)
+		opt = padded.IsEdns0()
+		addedOpt = true
+	}
+	removePadding(opt)
+
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	blockSize := s.config.EDNSPaddingBlockSize
+	if remainder := padded.Len() % blockSize; remainder != 0 {
+		padding.Padding = make([]byte, blockSize-remainder)
+	}
+	return padded, addedOpt
+}
+
+// unpadResponse strips EDNS padding from an upstream response before it is cached or
+// answered over plain UDP/TCP, and the OPT record too if padUpstreamQuery added it.
+func unpadResponse(resp *dns.Msg, addedOpt bool) {
+	if resp == nil {
+		return
+	}
+	if addedOpt {
+		removeOPT(resp)
+		return
+	}
+	if opt := resp.IsEdns0(); opt != nil {
+		removePadding(opt)
+	}
+}
+
+// removePadding removes any padding options from an OPT record.
+func removePadding(opt *dns.OPT) {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// removeOPT strips the OPT record from a response, for clients that did not use EDNS.
+func removeOPT(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
+
+// matchClientEDNS removes the OPT record from a shared answer (cached, or of a coalesced
+// query) when the query it answers did not use EDNS, which RFC 6891 forbids answering with one.
+func matchClientEDNS(msg, r *dns.Msg) {
+	if msg != nil && r.IsEdns0() == nil {
+		removeOPT(msg)
+	}
+}
+
+// addExtendedError attaches an Extended DNS Error (RFC 8914) to a response.
+// It is a no-op unless extended_errors is enabled and the query carried an OPT record,
+// since an OPT record must not be sent to clients that did not use EDNS.
+func (s *DNSServer) addExtendedError(msg *dns.Msg, r *dns.Msg, code uint16, text string) {
+	if !s.config.ExtendedErrors || msg == nil || r == nil {
+		return
+	}
+	reqOpt := r.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		udpSize := reqOpt.UDPSize()
+		if udpSize < dns.MinMsgSize {
+			udpSize = dns.MinMsgSize
+		}
+		msg.SetEdns0(udpSize, reqOpt.Do())
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  code,
+		ExtraText: text,
+	})
+}
+
+// udpSizeWriter truncates UDP responses to the payload size the client can receive: 512 bytes
+// without EDNS, or the size advertised in its OPT record. Answers are fetched and cached with
+// upstream_edns_bufsize, so they can be larger than what a client accepts. A truncated response
+// has the TC bit set, so the client retries over TCP.
+type udpSizeWriter struct {
+	dns.ResponseWriter
+	size int
+}
+
+// newUDPSizeWriter wraps w for a UDP query, or returns it unchanged for other transports.
+func newUDPSizeWriter(w dns.ResponseWriter, r *dns.Msg) dns.ResponseWriter {
+	if !isUDPRequest(w) {
+		return w
+	}
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return &udpSizeWriter{ResponseWriter: w, size: size}
+}
+
+// WriteMsg writes the response, truncated to a copy that fits the client's payload size.
+func (w *udpSizeWriter) WriteMsg(msg *dns.Msg) error {
+	if msg.Len() > w.size {
+		msg = msg.Copy()
+		msg.Truncate(w.size)
+	}
+	return w.ResponseWriter.WriteMsg(msg)
+}
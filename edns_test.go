@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUDPAnswerTruncatedToClientSize(t *testing.T) {
+	var records []string
+	for i := 1; i <= 40; i++ {
+		records = append(records, fmt.Sprintf("big.example. 300 IN A 10.0.0.%d", i))
+	}
+	upstream := replyWith(records...)
+	s := newTestServer(t, &Config{CacheTTL: 60, Nameservers: startTestUpstream(t, upstream, upstream)})
+
+	resp := testQuery(t, s, "big.example", dns.TypeA)
+	if !resp.Truncated || resp.Len() > dns.MinMsgSize || resp.IsEdns0() != nil {
+		t.Errorf("answer without EDNS: TC %v, %d bytes, want TC set and at most %d bytes without OPT",
+			resp.Truncated, resp.Len(), dns.MinMsgSize)
+	}
+
+	// The full answer is cached for clients that can take it
+	msg := new(dns.Msg)
+	msg.SetQuestion("big.example.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	resp, err := s.Query(testClient, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Truncated || len(answerIPs(resp)) != len(records) {
+		t.Errorf("answer with EDNS: TC %v, %d records, want all %d", resp.Truncated, len(answerIPs(resp)), len(records))
+	}
+}
+
+func TestCachedAnswerWithoutOPTForNonEDNSClient(t *testing.T) {
+	upstream := func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeNameError)
+		msg.Ns = []dns.RR{mustRR(t, "example. 300 IN SOA ns.example. host.example. 1 3600 600 86400 300")}
+		if r.IsEdns0() != nil {
+			msg.SetEdns0(dns.DefaultMsgSize, false)
+			msg.IsEdns0().Option = append(msg.IsEdns0().Option,
+				&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther, ExtraText: "upstream"})
+		}
+		_ = w.WriteMsg(msg)
+	}
+	s := newTestServer(t, &Config{NegativeCacheTTL: 300, Nameservers: startTestUpstream(t, upstream, upstream)})
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("gone.example.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	if _, err := s.Query(testClient, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := testQuery(t, s, "gone.example", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError || resp.IsEdns0() != nil {
+		t.Errorf("cached answer to a client without EDNS: %v, want NXDOMAIN without an OPT record", resp)
+	}
+	if hits := atomic.LoadUint64(&s.stats.cacheHits); hits != 1 {
+		t.Errorf("cache hits = %d, want 1", hits)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fallbackCacheTTL is how long fallback resolutions are reused, so block lists on the same
+// host don't each wait for a resolution while system DNS is down.
+const fallbackCacheTTL = time.Minute
+
+// fallbackResolver resolves block list hosts through fallback_dns when system DNS fails.
+type fallbackResolver struct {
+	servers     []string      // host:port of each fallback server, in configured order
+	timeout     time.Duration // Per-server query timeout
+	parallelism int           // Servers queried at the same time
+
+	mu    sync.Mutex
+	cache map[string]fallbackCacheEntry
+}
+
+// fallbackCacheEntry is a cached fallback resolution.
+type fallbackCacheEntry struct {
+	addrs     []string
+	expiresAt time.Time
+}
+
+// parseFallbackDNS parses fallback_dns, a single server or a list, each "ip" or "ip:port".
+func parseFallbackDNS(value interface{}) ([]string, error) {
+	var entries []string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		entries = []string{v}
+	case []interface{}:
+		entries = interfaceStrings(v)
+	default:
+		return nil, fmt.Errorf("invalid fallback_dns format")
+	}
+
+	servers := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(entry); err != nil {
+			entry = net.JoinHostPort(entry, "53")
+		}
+		servers = append(servers, entry)
+	}
+	if len(servers) == 0 {
+		servers = []string{net.JoinHostPort(defaultFallbackDNS, "53")}
+	}
+	return servers, nil
+}
+
+// newFallbackResolver creates a resolver for the configured fallback servers.
+func newFallbackResolver(config *Config) (*fallbackResolver, error) {
+	servers, err := parseFallbackDNS(config.FallbackDNS)
+	if err != nil {
+		return nil, err
+	}
+	parallelism := config.FallbackDNSParallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	return &fallbackResolver{
+		servers:     servers,
+		timeout:     time.Duration(config.FallbackDNSTimeoutMs) * time.Millisecond,
+		parallelism: parallelism,
+		cache:       make(map[string]fallbackCacheEntry),
+	}, nil
+}
+
+// resolve resolves a hostname using system DNS, or falls back to the fallback servers.
+// Fallback resolutions are cached for fallbackCacheTTL.
+func (f *fallbackResolver) resolve(host string) ([]string, error) {
+	// First try system DNS
+	addrs, err := net.LookupHost(host)
+	if err == nil {
+		return addrs, nil
+	}
+
+	f.mu.Lock()
+	cached, ok := f.cache[host]
+	f.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.addrs, nil
+	}
+
+	addrs, err = f.query(host)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.cache[host] = fallbackCacheEntry{addrs: addrs, expiresAt: time.Now().Add(fallbackCacheTTL)}
+	f.mu.Unlock()
+	return addrs, nil
+}
+
+// query asks the fallback servers in configured order, up to parallelism at a time,
+// and returns the first successful answer.
+func (f *fallbackResolver) query(host string) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		addrs []string
+		err   error
+	}
+	results := make(chan result, len(f.servers))
+	inFlight := 0
+	var errs []error
+
+	for next := 0; next < len(f.servers) || inFlight > 0; {
+		// Start queries until parallelism servers are being asked
+		if next < len(f.servers) && inFlight < f.parallelism {
+			server := f.servers[next]
+			next++
+			inFlight++
+			go func() {
+				addrs, err := f.queryServer(ctx, host, server)
+				results <- result{addrs, err}
+			}()
+			continue
+		}
+
+		res := <-results
+		inFlight--
+		if res.err == nil {
+			return res.addrs, nil
+		}
+		errs = append(errs, res.err)
+	}
+	return nil, fmt.Errorf("fallback DNS resolution failed: %w", errors.Join(errs...))
+}
+
+// queryServer resolves the A records of a host with one fallback server.
+func (f *fallbackResolver) queryServer(ctx context.Context, host, server string) ([]string, error) {
+	client := &dns.Client{Timeout: f.timeout}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
+
+	resp, _, err := client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", server, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s: DNS query failed with Rcode %d", server, resp.Rcode)
+	}
+
+	var addrs []string
+	for _, answer := range resp.Answer {
+		if a, ok := answer.(*dns.A); ok {
+			addrs = append(addrs, a.A.String())
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s: no A records found for %s", server, host)
+	}
+	return addrs, nil
+}
@@ -2,21 +2,46 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// errUpstreamRateLimited is returned when the global max_upstream_qps cap prevents forwarding.
+var errUpstreamRateLimited = errors.New("upstream QPS cap reached")
+
+// errNoEligibleNameserver is returned when every nameserver excludes the query type.
+var errNoEligibleNameserver = errors.New("no nameserver accepts this query type")
+
+// errNoUsableNameserver is returned with upstream_fast_fail when every eligible nameserver's
+// circuit breaker is open.
+var errNoUsableNameserver = errors.New("every nameserver's circuit breaker is open")
+
+// errInvalidResponse is returned when an upstream response fails validation and
+// on_validation_failure is "servfail".
+var errInvalidResponse = errors.New("upstream response failed validation")
+
 // forwardDOH forwards a DNS request using DNS-over-HTTPS.
-func (s *DNSServer) forwardDOH(r *dns.Msg, nameserver NameserverConfig) (*dns.Msg, error) {
+func (s *DNSServer) forwardDOH(ctx context.Context, r *dns.Msg, nameserver NameserverConfig) (*dns.Msg, error) {
+	addedOpt := false
+	if s.config.EDNSPadding {
+		r, addedOpt = s.padUpstreamQuery(r)
+	}
+
 	// Encode DNS message
 	buf, err := r.Pack()
 	if err != nil {
@@ -40,13 +65,17 @@ func (s *DNSServer) forwardDOH(r *dns.Msg, nameserver NameserverConfig) (*dns.Ms
 		}
 	}
 
-	return buildDOHRequest(s, url, buf)
+	resp, err := buildDOHRequest(ctx, s, url, buf)
+	if s.config.EDNSPadding {
+		unpadResponse(resp, addedOpt)
+	}
+	return resp, err
 }
 
 // buildDOHRequest builds and executes a DNS-over-HTTPS request.
-func buildDOHRequest(s *DNSServer, url string, buf []byte) (*dns.Msg, error) {
+func buildDOHRequest(ctx context.Context, s *DNSServer, url string, buf []byte) (*dns.Msg, error) {
 	// Try POST first (more reliable), fallback to GET
-	req, err := http.NewRequest("POST", url, bytes.NewReader(buf))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(buf))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
@@ -61,7 +90,7 @@ func buildDOHRequest(s *DNSServer, url string, buf []byte) (*dns.Msg, error) {
 				s.debugLog("Warning: failed to close response body: %v", closeErr)
 			}
 		}
-		return tryDOHGet(s, url, buf)
+		return tryDOHGet(ctx, s, url, buf)
 	}
 	defer func() {
 		if closeErr := resp.Body.Close(); closeErr != nil {
@@ -73,9 +102,9 @@ func buildDOHRequest(s *DNSServer, url string, buf []byte) (*dns.Msg, error) {
 }
 
 // tryDOHGet attempts a GET request for DNS-over-HTTPS.
-func tryDOHGet(s *DNSServer, url string, buf []byte) (*dns.Msg, error) {
+func tryDOHGet(ctx context.Context, s *DNSServer, url string, buf []byte) (*dns.Msg, error) {
 	b64 := base64.RawURLEncoding.EncodeToString(buf)
-	req, err := http.NewRequest("GET", url+"?dns="+b64, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"?dns="+b64, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
@@ -103,36 +132,56 @@ func parseDOHResponse(resp *http.Response) (*dns.Msg, error) {
 	}
 	msg := new(dns.Msg)
 	if err := msg.Unpack(body); err != nil {
-		return nil, fmt.Errorf("failed to unpack DNS message: %w", err)
+		return nil, fmt.Errorf("%w: failed to unpack DNS message: %v", errMalformedResponse, err)
 	}
 	return msg, nil
 }
 
 // forwardRequest forwards the DNS request to upstream nameservers with request coalescing.
-func (s *DNSServer) forwardRequest(w dns.ResponseWriter, r *dns.Msg, domain string, clientIP net.IP) {
-	if len(s.nameservers) == 0 {
+func (s *DNSServer) forwardRequest(w dns.ResponseWriter, r *dns.Msg, domain string, clientIP net.IP, view string, trace *queryTrace) {
+	trace.note("cache miss")
+
+	// Shadow copies (--shadow) and maintenance mode never reach an upstream
+	if s.answerInShadow(w, r) {
+		return
+	}
+	if s.answerInMaintenance(w, r, domain, view, trace) {
+		return
+	}
+	if len(s.upstreamGroupFor(domain).members) == 0 {
 		s.sendErrorResponse(w, r, dns.RcodeServerFailure)
 		return
 	}
 
 	// Double-check cache before forwarding (race condition protection)
-	if cachedResp := s.getCachedResponse(r, clientIP); cachedResp != nil {
+	if cachedResp := s.getCachedResponse(r, clientIP, view); cachedResp != nil {
 		if err := w.WriteMsg(cachedResp); err != nil {
 			errorLog("Error writing cached response: %v", err)
 		}
 		return
 	}
 
-	// Get cache key for request coalescing
-	key := getCacheKey(r)
+	// With serve_stale, a recently expired answer is served while it is refreshed
+	if s.answerStale(w, r, domain, view, trace) {
+		return
+	}
+
+	// Break forwarding loops: the same question keeps coming back from the same client
+	if s.loopDetector != nil && s.loopDetector.record(clientIP, r.Question[0]) {
+		s.sendResponse(w, r, s.createServerFailureResponse(r, "possible forwarding loop"))
+		return
+	}
+
+	// Get key for request coalescing
+	key := s.getCoalescingKey(r, view)
 	if key == "" {
 		// Fallback to direct forwarding if we can't generate a key
-		s.forwardDirect(w, r, domain)
+		s.forwardDirect(w, r, domain, view, trace)
 		return
 	}
 
 	// Check if there's already a pending request for this key
-	// Lock ordering: pendingMu is always released before acquiring cacheMu
+	// Lock ordering: pendingMu is always released before acquiring a cache shard lock
 	// to prevent deadlock. This ensures consistent lock ordering throughout.
 	s.pendingMu.Lock()
 	pending, exists := s.pendingRequests[key]
@@ -142,20 +191,20 @@ func (s *DNSServer) forwardRequest(w dns.ResponseWriter, r *dns.Msg, domain stri
 			waiters: make([]chan *dns.Msg, 0),
 		}
 		s.pendingRequests[key] = pending
-		s.pendingMu.Unlock() // Released before calling handleFirstRequest (which may acquire cacheMu)
-		s.handleFirstRequest(w, r, domain, key, pending)
+		s.pendingMu.Unlock() // Released before calling handleFirstRequest (which may acquire a cache shard lock)
+		s.handleFirstRequest(w, r, domain, key, pending, view, trace)
 		return
 	}
 
 	// There's already a pending request - wait for it
 	s.pendingMu.Unlock()
-	s.waitForPendingRequest(w, r, pending)
+	s.waitForPendingRequest(w, r, pending, view, trace)
 }
 
 // handleFirstRequest handles the first request for a cache key.
-func (s *DNSServer) handleFirstRequest(w dns.ResponseWriter, r *dns.Msg, domain, key string, pending *PendingRequest) {
+func (s *DNSServer) handleFirstRequest(w dns.ResponseWriter, r *dns.Msg, domain, key string, pending *PendingRequest, view string, trace *queryTrace) {
 	// Double-check cache before forwarding (in case it was just cached)
-	if cachedResp := s.getCachedResponse(r, nil); cachedResp != nil {
+	if cachedResp := s.getCachedResponse(r, nil, view); cachedResp != nil {
 		// Get waiters and clear them
 		pending.mu.Lock()
 		waiters := pending.waiters
@@ -174,22 +223,42 @@ func (s *DNSServer) handleFirstRequest(w dns.ResponseWriter, r *dns.Msg, domain,
 	}
 
 	// This is the first request - forward it
-	resp := s.forwardDirectInternal(r, domain)
+	resp, err := s.forwardDirectInternal(r, domain, trace)
 
-	// If request failed or timed out, create NXDOMAIN response and cache it
-	if resp == nil {
+	switch {
+	case errors.Is(err, errUpstreamRateLimited):
+		// Upstream QPS cap reached - answer SERVFAIL without caching
+		s.debugLog("Upstream QPS cap reached, not forwarding %s", domain)
+		resp = s.createServerFailureResponse(r, "upstream query rate limit reached")
+	case errors.Is(err, errNoEligibleNameserver):
+		// Query type filtered out on every nameserver - answer SERVFAIL without caching
+		resp = s.createServerFailureResponse(r, "no nameserver accepts this query type")
+	case errors.Is(err, errNoUsableNameserver):
+		// Every nameserver is down - answer from an expired entry or SERVFAIL, without caching
+		resp = s.upstreamsDownResponse(r, view)
+	case errors.Is(err, errInvalidResponse):
+		// Possibly spoofed response - answer SERVFAIL without caching
+		resp = s.createServerFailureResponse(r, "upstream response failed validation")
+	case errors.Is(err, errDNSSECBogus):
+		// Signatures don't validate - answer SERVFAIL without caching
+		resp = s.createDNSSECBogusResponse(r)
+	case errors.Is(err, errForwardingLoop):
+		// Only nameserver is this server - answer SERVFAIL without caching
+		resp = s.createServerFailureResponse(r, "forwarding loop")
+	case err != nil:
+		// If request failed or timed out, create NXDOMAIN response and cache it
 		resp = s.createNXDOMAINResponse(r)
 		// Cache the NXDOMAIN response
 		if resp != nil {
-			s.setCachedResponse(r, resp)
+			s.setCachedResponse(r, resp, view)
 		}
-	} else {
+	default:
 		// Log negative response types
 		if isNegativeResponse(resp) {
 			logNegativeResponse(s, resp, domain)
 		}
 		// Cache the response (including negative responses from upstream)
-		s.setCachedResponse(r, resp)
+		s.setCachedResponse(r, resp, view)
 	}
 
 	// Get waiters and clear them
@@ -210,8 +279,20 @@ func (s *DNSServer) handleFirstRequest(w dns.ResponseWriter, r *dns.Msg, domain,
 	s.pendingMu.Unlock()
 }
 
+// coalesceTimeout returns how long clients wait for an identical in-flight query, which is
+// also the deadline for all upstream attempts of one query. An unset coalesce_timeout
+// falls back to the default, so queries never start with an expired deadline.
+func (s *DNSServer) coalesceTimeout() time.Duration {
+	if s.config.CoalesceTimeout <= 0 {
+		return defaultCoalesceTimeout
+	}
+	return time.Duration(s.config.CoalesceTimeout) * time.Second
+}
+
 // waitForPendingRequest waits for a pending request to complete.
-func (s *DNSServer) waitForPendingRequest(w dns.ResponseWriter, r *dns.Msg, pending *PendingRequest) {
+func (s *DNSServer) waitForPendingRequest(w dns.ResponseWriter, r *dns.Msg, pending *PendingRequest, view string, trace *queryTrace) {
+	trace.note("waiting for identical in-flight query")
+
 	// Create a channel to wait for the response
 	responseChan := make(chan *dns.Msg, 1)
 	pending.mu.Lock()
@@ -221,17 +302,19 @@ func (s *DNSServer) waitForPendingRequest(w dns.ResponseWriter, r *dns.Msg, pend
 	// Wait for response with timeout
 	select {
 	case resp := <-responseChan:
+		matchClientEDNS(resp, r)
 		s.sendResponse(w, r, resp)
-	case <-time.After(10 * time.Second):
+	case <-time.After(s.coalesceTimeout()):
+		trace.note("gave up waiting after %s", s.coalesceTimeout())
 		// Timeout - check cache first (maybe it was cached while we waited)
-		if cachedResp := s.getCachedResponse(r, nil); cachedResp != nil {
+		if cachedResp := s.getCachedResponse(r, nil, view); cachedResp != nil {
 			s.sendResponse(w, r, cachedResp)
 			return
 		}
 		// Create and cache NXDOMAIN response
 		resp := s.createNXDOMAINResponse(r)
 		if resp != nil {
-			s.setCachedResponse(r, resp)
+			s.setCachedResponse(r, resp, view)
 			s.sendResponse(w, r, resp)
 		} else {
 			s.sendErrorResponse(w, r, dns.RcodeServerFailure)
@@ -277,22 +360,53 @@ func (s *DNSServer) sendErrorResponse(w dns.ResponseWriter, r *dns.Msg, rcode in
 	msg := new(dns.Msg)
 	msg.SetReply(r)
 	msg.SetRcode(r, rcode)
+	msg.RecursionAvailable = true
 	if err := w.WriteMsg(msg); err != nil {
 		errorLog("Error writing response: %v", err)
 	}
 }
 
 // forwardDirect forwards a request directly without coalescing (fallback).
-func (s *DNSServer) forwardDirect(w dns.ResponseWriter, r *dns.Msg, domain string) {
-	resp := s.forwardDirectInternal(r, domain)
-	if resp == nil {
+func (s *DNSServer) forwardDirect(w dns.ResponseWriter, r *dns.Msg, domain, view string, trace *queryTrace) {
+	resp, err := s.forwardDirectInternal(r, domain, trace)
+	if errors.Is(err, errUpstreamRateLimited) {
+		// Upstream QPS cap reached - answer SERVFAIL without caching
+		s.sendResponse(w, r, s.createServerFailureResponse(r, "upstream query rate limit reached"))
+		return
+	}
+	if errors.Is(err, errNoEligibleNameserver) {
+		// Query type filtered out on every nameserver - answer SERVFAIL without caching
+		s.sendResponse(w, r, s.createServerFailureResponse(r, "no nameserver accepts this query type"))
+		return
+	}
+	if errors.Is(err, errNoUsableNameserver) {
+		// Every nameserver is down - answer from an expired entry or SERVFAIL, without caching
+		s.sendResponse(w, r, s.upstreamsDownResponse(r, view))
+		return
+	}
+	if errors.Is(err, errInvalidResponse) {
+		// Possibly spoofed response - answer SERVFAIL without caching
+		s.sendResponse(w, r, s.createServerFailureResponse(r, "upstream response failed validation"))
+		return
+	}
+	if errors.Is(err, errDNSSECBogus) {
+		// Signatures don't validate - answer SERVFAIL without caching
+		s.sendResponse(w, r, s.createDNSSECBogusResponse(r))
+		return
+	}
+	if errors.Is(err, errForwardingLoop) {
+		// Only nameserver is this server - answer SERVFAIL without caching
+		s.sendResponse(w, r, s.createServerFailureResponse(r, "forwarding loop"))
+		return
+	}
+	if err != nil {
 		// Request failed - create and cache NXDOMAIN response
 		resp = s.createNXDOMAINResponse(r)
 		if resp != nil {
-			s.setCachedResponse(r, resp)
+			s.setCachedResponse(r, resp, view)
 		}
 	} else {
-		s.setCachedResponse(r, resp)
+		s.setCachedResponse(r, resp, view)
 	}
 
 	if resp != nil {
@@ -304,107 +418,428 @@ func (s *DNSServer) forwardDirect(w dns.ResponseWriter, r *dns.Msg, domain strin
 	}
 }
 
+// upstreamsDownResponse answers a query that upstream_fast_fail kept from being forwarded:
+// from an expired cache entry if one is left, otherwise with SERVFAIL.
+func (s *DNSServer) upstreamsDownResponse(r *dns.Msg, view string) *dns.Msg {
+	if stale := s.getStaleCachedResponse(r, view, "all nameservers down", 0); stale != nil {
+		return stale
+	}
+	return s.createServerFailureResponse(r, "all nameservers down")
+}
+
 // forwardDirectInternal performs the actual forwarding and returns the response.
-// Uses round-robin to distribute load across nameservers.
-func (s *DNSServer) forwardDirectInternal(r *dns.Msg, domain string) *dns.Msg {
-	if len(s.nameservers) == 0 {
+// Uses round-robin to distribute load across the nameservers the domain is routed to.
+// Returns errUpstreamRateLimited if the global upstream QPS cap was reached, and
+// errNoEligibleNameserver if every nameserver's query type filter excludes the query,
+// errNoUsableNameserver if upstream_fast_fail is set and every circuit breaker is open,
+// and errForwardingLoop if every remaining nameserver is this server itself.
+func (s *DNSServer) forwardDirectInternal(r *dns.Msg, domain string, trace *queryTrace) (*dns.Msg, error) {
+	group := s.upstreamGroupFor(domain)
+	if len(group.members) == 0 {
 		s.debugLog("No nameservers configured for %s", domain)
-		return nil
+		return nil, fmt.Errorf("no nameservers configured")
+	}
+	if group.suffix != "" {
+		trace.note("routed via %s", group.suffix)
 	}
 
-	// Get starting index using round-robin (atomic increment)
-	// Safe conversion: number of nameservers is always small (< 1000)
-	nsCount := uint64(len(s.nameservers))
-	idxValue := atomic.AddUint64(&s.nameserverIdx, 1) - 1
-	modValue := idxValue % nsCount
-	// nolint:gosec // Safe: modValue is always < len(s.nameservers) which is small
-	startIdx := int(modValue)
+	qtype := r.Question[0].Qtype
+	eligible, self := 0, 0
+	for _, nameserver := range group.nameservers {
+		switch {
+		case !nameserver.acceptsQtype(qtype):
+		case nameserver.self:
+			self++
+		default:
+			eligible++
+		}
+	}
+	if eligible == 0 && self > 0 {
+		s.debugLog("Not forwarding %s to this server itself (forwarding loop)", domain)
+		return nil, errForwardingLoop
+	}
+	if eligible == 0 {
+		s.debugLog("No nameserver accepts %s queries for %s", dns.TypeToString[qtype], domain)
+		return nil, errNoEligibleNameserver
+	}
+
+	// Nameservers to try, starting from the selected one and wrapping around. Nameservers
+	// with an open circuit breaker are skipped; if that leaves none, they are all tried anyway,
+	// unless upstream_fast_fail is set.
+	start := s.selectStartNameserver(group, domain)
+	candidates := s.usableNameservers(group, start, qtype)
+	ignoreBreakers := len(candidates) == 0
+	if ignoreBreakers {
+		if s.config.UpstreamFastFail {
+			trace.note("every nameserver's circuit breaker is open")
+			s.debugLog("Every nameserver is down, not forwarding %s", domain)
+			return nil, errNoUsableNameserver
+		}
+		for i := range group.members {
+			if idx := group.members[(start+i)%len(group.members)]; s.nameservers[idx].acceptsQtype(qtype) && !s.nameservers[idx].self {
+				candidates = append(candidates, idx)
+			}
+		}
+	}
 
-	// Try nameservers starting from the round-robin index, wrapping around
-	for i := 0; i < len(s.nameservers); i++ {
-		idx := (startIdx + i) % len(s.nameservers)
+	// Apply the global upstream QPS cap
+	if !s.acquireUpstreamToken() {
+		trace.note("upstream QPS cap reached")
+		return nil, errUpstreamRateLimited
+	}
+
+	upstreamReq, addedOpt := s.withUpstreamEDNS(r)
+
+	// Waiting clients give up after coalesce_timeout, so all attempts share that deadline
+	ctx, cancel := context.WithTimeout(withQueryTrace(context.Background(), trace), s.coalesceTimeout())
+	defer cancel()
+	attempts := 0
+
+	for _, idx := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
 		nameserver := s.nameservers[idx]
-		resp := s.tryForwardToNameserver(r, nameserver, domain)
+		// A breaker may have reopened, or another query may be probing it, since the list was built
+		breaker := s.breaker(idx)
+		if !ignoreBreakers && !breaker.allow() {
+			trace.note("skipped %s (circuit open)", nameserver.Address)
+			continue
+		}
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, s.attemptTimeout(attempts, eligible))
+		attempts++
+		attemptStart := time.Now()
+		resp, healthy, err := s.tryForwardToNameserver(attemptCtx, upstreamReq, nameserver, domain)
+		cancelAttempt()
+		if trace != nil {
+			outcome := "no usable answer"
+			if resp != nil {
+				outcome = getRcodeName(resp.Rcode)
+			}
+			trace.note("upstream %s (%s) %s in %dms", net.JoinHostPort(nameserver.Address, fmt.Sprintf("%d", nameserver.Port)),
+				nameserver.Protocol, outcome, time.Since(attemptStart).Milliseconds())
+		}
+		breaker.record(healthy)
+		s.stats.recordUpstream(idx, healthy, time.Since(attemptStart))
+		if err != nil {
+			return nil, err
+		}
 		if resp != nil {
-			return resp
+			if addedOpt {
+				removeOPT(resp)
+			}
+			s.withoutAddedDNSSEC(r, resp)
+			// Clients get recursion from this server, even when the answer came from an authority
+			resp.RecursionAvailable = true
+			trace.setUpstream(nameserver)
+			return resp, nil
 		}
 	}
 
 	// All nameservers failed
 	s.debugLog("All nameservers failed for %s, will return NXDOMAIN", domain)
-	return nil
+	return nil, fmt.Errorf("all nameservers failed for %s", domain)
+}
+
+// attemptTimeout returns the timeout for the given upstream attempt (0-based): the first of
+// several attempts fails fast with upstream_timeout_initial_ms, later attempts and a single
+// eligible nameserver get upstream_timeout_final_ms.
+func (s *DNSServer) attemptTimeout(attempt, eligible int) time.Duration {
+	if attempt == 0 && eligible > 1 {
+		return time.Duration(s.config.UpstreamTimeoutInitialMs) * time.Millisecond
+	}
+	return time.Duration(s.config.UpstreamTimeoutFinalMs) * time.Millisecond
+}
+
+// selectStartNameserver returns the position in a group of the first nameserver to try.
+// In fixed mode this is always the group's first nameserver, in consistent_hash mode
+// it is chosen by the domain; otherwise round-robin is used within the group.
+func (s *DNSServer) selectStartNameserver(group *upstreamGroup, domain string) int {
+	switch s.config.UpstreamMode {
+	case upstreamModeFixed:
+		return 0
+	case upstreamModeConsistentHash:
+		return consistentHashNameserver(group.nameservers, domain)
+	}
+
+	// Get starting index using round-robin (atomic increment)
+	// Safe conversion: number of nameservers is always small (< 1000)
+	nsCount := uint64(len(group.members))
+	idxValue := group.next.Add(1) - 1
+	modValue := idxValue % nsCount
+	// nolint:gosec // Safe: modValue is always < len(group.members) which is small
+	return int(modValue)
 }
 
 // tryForwardToNameserver attempts to forward a request to a specific nameserver.
-func (s *DNSServer) tryForwardToNameserver(r *dns.Msg, nameserver NameserverConfig, domain string) *dns.Msg {
+// A nil response means the next nameserver should be tried. errInvalidResponse is returned
+// when a response fails validation and on_validation_failure is "servfail", errDNSSECBogus
+// when validate_dnssec is set and its signatures don't validate.
+// healthy reports whether the nameserver answered, for its circuit breaker and statistics:
+// transport errors, timeouts, malformed responses and SERVFAIL count against it, answers
+// only rejected by local policy don't.
+func (s *DNSServer) tryForwardToNameserver(ctx context.Context, r *dns.Msg, nameserver NameserverConfig, domain string) (resp *dns.Msg, healthy bool, err error) {
 	address := net.JoinHostPort(nameserver.Address, fmt.Sprintf("%d", nameserver.Port))
-	resp, err := s.forwardToNameserver(r, nameserver, address)
+	resp, err = s.forwardToNameserver(ctx, r, nameserver, address)
 	if err != nil {
-		s.debugLog("Error forwarding to %s (%s): %v", address, nameserver.Protocol, err)
-		return nil
+		queryTraceFrom(ctx).note("upstream %s (%s) error: %v", address, nameserver.Protocol, err)
+		if isMalformedError(err) {
+			s.recordMalformedResponse(domain, address, nameserver, err.Error())
+			return nil, false, nil
+		}
+		s.logUpstreamError(address, nameserver, err)
+		return nil, false, nil
+	}
+	if resp == nil {
+		return nil, false, nil
+	}
+
+	// Re-check responses the parser tolerated, so garbage is never cached
+	if s.config.RevalidateResponses {
+		if problem := malformedResponse(resp); problem != "" {
+			s.recordMalformedResponse(domain, address, nameserver, problem)
+			return nil, false, nil
+		}
 	}
 
-	// Validate response matches query
-	if resp != nil && !validateResponse(r, resp) {
-		s.debugLog("Response validation failed for %s from %s, trying next nameserver", domain, address)
-		return nil
+	// Validate response matches query - a mismatch may indicate spoofing
+	if mismatch := responseMismatch(r, resp); mismatch != "" {
+		atomic.AddUint64(&s.stats.invalidResponses, 1)
+		if s.config.OnValidationFailure == validationFailureServfail {
+			log.Printf("Warning: invalid response for %s from %s (%s): %s, answering SERVFAIL", domain, address, nameserver.Protocol, mismatch)
+			return nil, true, errInvalidResponse
+		}
+		log.Printf("Warning: invalid response for %s from %s (%s): %s, trying next nameserver", domain, address, nameserver.Protocol, mismatch)
+		return nil, true, nil
 	}
 
 	// Handle truncated UDP responses - retry with TCP
-	if resp != nil && resp.Truncated && !isTCPBasedProtocol(nameserver.Protocol) {
-		resp = s.handleTruncatedResponse(r, address, domain)
+	if resp.Truncated && !isTCPBasedProtocol(nameserver.Protocol) {
+		queryTraceFrom(ctx).note("TCP retry after truncation from %s", address)
+		if resp = s.handleTruncatedResponse(ctx, r, address, domain); resp == nil {
+			return nil, false, nil
+		}
+	}
+
+	// Reject pathologically long CNAME chains (after any TCP retry, which returns the full chain)
+	if s.config.MaxCNAMEChain > 0 {
+		if chain := countCNAMEs(resp); chain > s.config.MaxCNAMEChain {
+			log.Printf("Warning: rejected answer for %s from %s with %d CNAMEs (max_cname_chain: %d), trying next nameserver",
+				domain, address, chain, s.config.MaxCNAMEChain)
+			return nil, true, nil
+		}
+	}
+
+	// Check signatures before anything changes the answer, unless the client disabled checking
+	if s.dnssecValidator != nil && wantsDNSSEC(r) && !r.CheckingDisabled {
+		secure, err := s.dnssecValidator.validate(ctx, resp)
+		if isDNSSECFetchError(err) {
+			// Neither secure nor bogus: the keys could not be looked up right now
+			queryTraceFrom(ctx).note("DNSSEC validation incomplete: %v", err)
+			log.Printf("Warning: could not validate the answer for %s from %s (%s): %v, trying next nameserver", domain, address, nameserver.Protocol, err)
+			return nil, true, nil
+		}
+		if err != nil {
+			queryTraceFrom(ctx).note("DNSSEC validation failed: %v", err)
+			log.Printf("Warning: DNSSEC validation failed for %s from %s (%s): %v, answering SERVFAIL", domain, address, nameserver.Protocol, err)
+			return nil, true, errDNSSECBogus
+		}
+		resp.AuthenticatedData = secure
+	}
+
+	// Block answers that resolve into blocked address ranges, checking the full answer of any TCP retry
+	if len(s.answerIPBlocklist) > 0 && !s.isBypassDomain(domain) {
+		if ip, prefix, blocked := s.blockedAnswerIP(resp); blocked {
+			s.logBlock("Blocked: %s (answer %s in answer_ip_blocklist %s)", domain, ip, prefix)
+			s.auditBlock(r, nil, prefix.String(), &BlockEntry{Source: "answer_ip_blocklist"})
+			return s.createBlockedResponse(r, "answer in blocked address range"), true, nil
+		}
+	}
+
+	// Bound the answer section (after any TCP retry, which may return even more records)
+	if s.config.MaxAnswers > 0 && len(resp.Answer) > s.config.MaxAnswers {
+		if s.config.MaxAnswersAction == maxAnswersReject {
+			log.Printf("Warning: rejected answer for %s from %s with %d records (max_answers: %d), trying next nameserver",
+				domain, address, len(resp.Answer), s.config.MaxAnswers)
+			return nil, true, nil
+		}
+		before := len(resp.Answer)
+		trimAnswers(resp, s.config.MaxAnswers)
+		log.Printf("Trimmed answer for %s from %s from %d to %d records (max_answers: %d)",
+			domain, address, before, len(resp.Answer), s.config.MaxAnswers)
 	}
 
 	// Log response type
-	if resp != nil {
-		s.logForwardedResponse(domain, address, nameserver.Protocol, resp)
+	s.logForwardedResponse(domain, address, nameserver.Protocol, resp)
+	return resp, resp.Rcode != dns.RcodeServerFailure, nil
+}
+
+// countCNAMEs counts the CNAME records in a response's answer section.
+func countCNAMEs(resp *dns.Msg) int {
+	count := 0
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			count++
+		}
+	}
+	return count
+}
+
+// trimAnswers keeps the first maxAnswers data records of the answer section.
+// CNAME and DNAME records are always kept (and not counted) so the chain to the remaining records stays intact,
+// and signatures over RRsets that lost records are dropped, since they no longer verify.
+func trimAnswers(resp *dns.Msg, maxAnswers int) {
+	type rrset struct {
+		name  string
+		rtype uint16
+	}
+	trimmed := make(map[rrset]bool)
+	kept := resp.Answer[:0]
+	count := 0
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dns.TypeCNAME, dns.TypeDNAME, dns.TypeRRSIG:
+			kept = append(kept, rr)
+		default:
+			if count < maxAnswers {
+				kept = append(kept, rr)
+				count++
+			} else {
+				trimmed[rrset{strings.ToLower(hdr.Name), hdr.Rrtype}] = true
+			}
+		}
 	}
-	return resp
+
+	answer := kept[:0]
+	for _, rr := range kept {
+		if sig, ok := rr.(*dns.RRSIG); ok && trimmed[rrset{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}] {
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	resp.Answer = answer
 }
 
 // forwardToNameserver forwards a DNS request using the appropriate protocol.
-func (s *DNSServer) forwardToNameserver(r *dns.Msg, nameserver NameserverConfig, address string) (*dns.Msg, error) {
+// The attempt is bounded by the deadline of ctx.
+func (s *DNSServer) forwardToNameserver(ctx context.Context, r *dns.Msg, nameserver NameserverConfig, address string) (*dns.Msg, error) {
 	switch nameserver.Protocol {
 	case protocolDOH:
-		return s.forwardDOH(r, nameserver)
+		return s.forwardDOH(ctx, r, nameserver)
+	case protocolDOHJSON:
+		return s.forwardDOHJSON(ctx, r, nameserver)
+	case protocolFile:
+		return s.forwardFile(r, nameserver)
 	case protocolDOT:
-		return s.forwardDOT(r, address, nameserver.Address)
+		return s.forwardDOT(ctx, r, address, nameserver.Address)
 	case protocolTCP:
-		tcpClient := &dns.Client{Net: protocolTCP, Timeout: 5 * time.Second}
-		resp, _, err := tcpClient.Exchange(r, address)
+		tcpClient := &dns.Client{Net: protocolTCP, Timeout: upstreamTimeout(ctx)}
+		resp, _, err := tcpClient.ExchangeContext(ctx, r, address)
 		return resp, err
 	default:
+		// Known-large query types skip the UDP attempt and go straight to TCP
+		if s.prefersTCP(r) {
+			tcpClient := &dns.Client{Net: protocolTCP, Timeout: upstreamTimeout(ctx)}
+			resp, _, err := tcpClient.ExchangeContext(ctx, r, address)
+			return resp, err
+		}
 		// UDP DNS (default)
-		resp, _, err := s.client.Exchange(r, address)
+		return s.exchangeUDP(ctx, r, address)
+	}
+}
+
+// upstreamTimeout returns the time left for an upstream attempt before the deadline of ctx.
+func upstreamTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return defaultUpstreamTimeout
+}
+
+// prefersTCP checks if the query type is configured in prefer_tcp_for_qtypes.
+func (s *DNSServer) prefersTCP(r *dns.Msg) bool {
+	if len(s.preferTCPQtypes) == 0 || len(r.Question) == 0 {
+		return false
+	}
+	_, ok := s.preferTCPQtypes[r.Question[0].Qtype]
+	return ok
+}
+
+// exchangeUDP sends a query over UDP, binding to a random port in
+// upstream_source_port_range when one is configured.
+func (s *DNSServer) exchangeUDP(ctx context.Context, r *dns.Msg, address string) (*dns.Msg, error) {
+	timeout := upstreamTimeout(ctx)
+	if s.sourcePortMin == 0 {
+		client := &dns.Client{Timeout: timeout}
+		resp, _, err := client.ExchangeContext(ctx, r, address)
 		return resp, err
 	}
+
+	// Retry with a different port if the chosen one is already in use
+	var lastErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		port, err := randomPort(s.sourcePortMin, s.sourcePortMax)
+		if err != nil {
+			return nil, err
+		}
+		client := &dns.Client{
+			Timeout: timeout,
+			Dialer: &net.Dialer{
+				Timeout:   timeout,
+				LocalAddr: &net.UDPAddr{Port: port},
+			},
+		}
+		resp, _, err := client.ExchangeContext(ctx, r, address)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return resp, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// randomPort returns a cryptographically random port in [low, high].
+func randomPort(low, high int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(high-low+1)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to pick source port: %w", err)
+	}
+	return low + int(n.Int64()), nil
 }
 
 // forwardDOT forwards a DNS request using DNS-over-TLS.
-func (s *DNSServer) forwardDOT(r *dns.Msg, address, serverName string) (*dns.Msg, error) {
+func (s *DNSServer) forwardDOT(ctx context.Context, r *dns.Msg, address, serverName string) (*dns.Msg, error) {
+	addedOpt := false
+	if s.config.EDNSPadding {
+		r, addedOpt = s.padUpstreamQuery(r)
+	}
 	dotClient := &dns.Client{
 		Net:     "tcp-tls",
-		Timeout: 5 * time.Second,
+		Timeout: upstreamTimeout(ctx),
 		TLSConfig: &tls.Config{
 			ServerName:         serverName,
 			InsecureSkipVerify: false,
 			MinVersion:         tls.VersionTLS12,
 		},
 	}
-	resp, _, err := dotClient.Exchange(r, address)
+	resp, _, err := dotClient.ExchangeContext(ctx, r, address)
+	if s.config.EDNSPadding {
+		unpadResponse(resp, addedOpt)
+	}
 	return resp, err
 }
 
 // isTCPBasedProtocol checks if a protocol uses TCP.
 func isTCPBasedProtocol(protocol string) bool {
-	return protocol == protocolTCP || protocol == protocolDOT || protocol == protocolDOH
+	return protocol == protocolTCP || protocol == protocolDOT || protocol == protocolDOH || protocol == protocolDOHJSON
 }
 
 // handleTruncatedResponse handles truncated UDP responses by retrying with TCP.
-func (s *DNSServer) handleTruncatedResponse(r *dns.Msg, address, domain string) *dns.Msg {
+func (s *DNSServer) handleTruncatedResponse(ctx context.Context, r *dns.Msg, address, domain string) *dns.Msg {
 	s.debugLog("Truncated UDP response for %s, retrying with TCP", domain)
-	tcpClient := &dns.Client{Net: protocolTCP, Timeout: 5 * time.Second}
-	tcpResp, _, tcpErr := tcpClient.Exchange(r, address)
+	tcpClient := &dns.Client{Net: protocolTCP, Timeout: upstreamTimeout(ctx)}
+	tcpResp, _, tcpErr := tcpClient.ExchangeContext(ctx, r, address)
 	if tcpErr == nil && tcpResp != nil && validateResponse(r, tcpResp) {
 		s.debugLog("Forwarded: %s -> %s (tcp, retry after truncation)", domain, address)
 		return tcpResp
@@ -463,11 +898,23 @@ func getRcodeName(rcode int) string {
 	}
 }
 
+// createServerFailureResponse creates an uncached SERVFAIL response for a query that was not forwarded.
+func (s *DNSServer) createServerFailureResponse(r *dns.Msg, reason string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.RecursionAvailable = true
+	msg.SetRcode(r, dns.RcodeServerFailure)
+	s.addExtendedError(msg, r, dns.ExtendedErrorCodeOther, reason)
+	return msg
+}
+
 // createNXDOMAINResponse creates an NXDOMAIN response for a failed query.
 func (s *DNSServer) createNXDOMAINResponse(r *dns.Msg) *dns.Msg {
 	msg := new(dns.Msg)
 	msg.SetReply(r)
+	msg.RecursionAvailable = true
 	msg.Authoritative = true
 	msg.SetRcode(r, dns.RcodeNameError)
+	s.addExtendedError(msg, r, dns.ExtendedErrorCodeNetworkError, "all upstream nameservers failed")
 	return msg
 }
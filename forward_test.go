@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCoalesceTimeoutDefault(t *testing.T) {
+	s := &DNSServer{config: &Config{}}
+	if got := s.coalesceTimeout(); got != defaultCoalesceTimeout {
+		t.Errorf("coalesce timeout = %v, want %v", got, defaultCoalesceTimeout)
+	}
+}
+
+func TestQueryForwardsWithoutCoalesceTimeout(t *testing.T) {
+	s := newTestServer(t, &Config{CacheTTL: 60})
+	s.config.CoalesceTimeout = 0
+	resp := testQuery(t, s, "www.test.lan", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(answerIPs(resp)) != 1 {
+		t.Errorf("rcode = %s, answer = %v, want the zone's address", dns.RcodeToString[resp.Rcode], answerIPs(resp))
+	}
+}
+
+// startTestUpstream runs a nameserver on a local port answering UDP queries with udp and
+// TCP queries with tcp, and returns its nameservers configuration.
+func startTestUpstream(t *testing.T, udp, tcp dns.HandlerFunc) []interface{} {
+	t.Helper()
+	var pc net.PacketConn
+	var ln net.Listener
+	for attempt := 0; ; attempt++ {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if ln, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+		if attempt == 10 {
+			t.Fatal(err)
+		}
+	}
+	udpServer := &dns.Server{PacketConn: pc, Handler: udp}
+	tcpServer := &dns.Server{Listener: ln, Handler: tcp}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+	})
+	return []interface{}{map[string]interface{}{
+		"address": "127.0.0.1",
+		"port":    pc.LocalAddr().(*net.UDPAddr).Port,
+	}}
+}
+
+// truncatedReply answers with an empty, truncated response.
+func truncatedReply(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Truncated = true
+	_ = w.WriteMsg(msg)
+}
+
+// replyWith returns a handler answering every query with the given records.
+func replyWith(records ...string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				panic(err)
+			}
+			msg.Answer = append(msg.Answer, rr)
+		}
+		_ = w.WriteMsg(msg)
+	}
+}
+
+func TestMaxCNAMEChainAfterTCPRetry(t *testing.T) {
+	s := newTestServer(t, &Config{
+		MaxCNAMEChain: 2,
+		Nameservers: startTestUpstream(t, truncatedReply, replyWith(
+			"long.test.lan. 60 IN CNAME a.test.lan.",
+			"a.test.lan. 60 IN CNAME b.test.lan.",
+			"b.test.lan. 60 IN CNAME c.test.lan.",
+			"c.test.lan. 60 IN A 10.3.3.3",
+		)),
+	})
+	resp := testQuery(t, s, "long.test.lan", dns.TypeA)
+	if ips := answerIPs(resp); len(ips) != 0 {
+		t.Errorf("answer = %v, want the chain of 3 CNAMEs rejected", ips)
+	}
+}
+
+func TestAnswerIPBlocklistAfterTCPRetry(t *testing.T) {
+	s := newTestServer(t, &Config{
+		CacheTTL:          60,
+		AnswerIPBlocklist: []string{"203.0.113.0/24"},
+		Nameservers:       startTestUpstream(t, truncatedReply, replyWith("big.test.lan. 60 IN A 203.0.113.5")),
+	})
+	for i := 0; i < 2; i++ { // The second answer comes from the cache
+		if ips := answerIPs(testQuery(t, s, "big.test.lan", dns.TypeA)); len(ips) != 0 {
+			t.Fatalf("answer = %v, want the address in answer_ip_blocklist blocked", ips)
+		}
+	}
+}
+
+func TestPolicyRejectionsKeepCircuitClosed(t *testing.T) {
+	chain := replyWith(
+		"long.test.lan. 60 IN CNAME a.test.lan.",
+		"a.test.lan. 60 IN CNAME b.test.lan.",
+		"b.test.lan. 60 IN A 10.3.3.3",
+	)
+	s := newTestServer(t, &Config{
+		MaxCNAMEChain:           1,
+		CircuitBreakerThreshold: 2,
+		Nameservers:             startTestUpstream(t, chain, chain),
+	})
+	for i := 0; i < 3; i++ {
+		testQuery(t, s, "long.test.lan", dns.TypeA)
+	}
+	if !s.breaker(0).available() {
+		t.Error("circuit opened for answers rejected by max_cname_chain")
+	}
+}
+
+func TestServerFailuresOpenCircuit(t *testing.T) {
+	servfail := func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		_ = w.WriteMsg(msg)
+	}
+	s := newTestServer(t, &Config{
+		CircuitBreakerThreshold: 2,
+		Nameservers:             startTestUpstream(t, servfail, servfail),
+	})
+	for i := 0; i < 3; i++ {
+		testQuery(t, s, "www.test.lan", dns.TypeA)
+	}
+	if s.breaker(0).available() {
+		t.Error("circuit still closed after SERVFAILs")
+	}
+}
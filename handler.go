@@ -1,23 +1,163 @@
 package main
 
 import (
-	"fmt"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
 
-// handleDNSRequest handles incoming DNS requests.
-func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+// handleDNSRequest handles incoming DNS requests with the policy of the listener they arrived on.
+func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg, policy *handlerPolicy) {
+	// Time the query for slow_query_threshold_ms and query_log_file (both disabled by default)
+	s.handleTracedRequest(w, r, policy, s.newQueryTrace())
+}
+
+// handleTracedRequest handles a request, recording its steps and what happened to it in
+// trace (nil = not traced).
+func (s *DNSServer) handleTracedRequest(w dns.ResponseWriter, r *dns.Msg, policy *handlerPolicy, trace *queryTrace) {
+	atomic.AddUint64(&s.stats.queries, 1)
+
 	// Get client IP early for cache logging
 	clientIP := getClientIP(w)
+	defer s.logSlowQuery(trace, r, clientIP)
+
+	// The query log writer is innermost, so it sees the answer as sent
+	if s.queryLog != nil {
+		qw := &queryLogWriter{ResponseWriter: w}
+		w = qw
+		defer s.logQuery(trace, qw, r, clientIP)
+	}
+
+	// Answers are cached at upstream_edns_bufsize; UDP clients get them cut to their own size
+	w = newUDPSizeWriter(w, r)
+
+	// Only answer clients in allow_query (everyone by default)
+	if len(s.allowQuery) > 0 && !subnetsContain(s.allowQuery, clientIP) {
+		s.debugLog("Denied query from %s (not in allow_query)", clientIP)
+		trace.setAction(queryActionDenied)
+		if s.config.AllowQueryAction == allowQueryDrop {
+			return
+		}
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeRefused)
+		s.addExtendedError(msg, r, dns.ExtendedErrorCodeProhibited, "client not allowed to query")
+		if err := w.WriteMsg(msg); err != nil {
+			errorLog("Error writing response: %v", err)
+		}
+		return
+	}
+
+	// Refuse clients sending more than rate_limit_per_second (unlimited by default)
+	if s.clientLimiter != nil && !s.clientLimiter.allow(clientIP) {
+		s.debugLog("Rate limited: %s", clientIP)
+		trace.setAction(queryActionRateLimited)
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeRefused)
+		msg.RecursionAvailable = true
+		if err := w.WriteMsg(msg); err != nil {
+			errorLog("Error writing response: %v", err)
+		}
+		return
+	}
+
+	// In ECS privacy mode, tell ECS clients every answer is valid for all networks
+	if s.config.ECSPrivacy {
+		if ecs := requestECS(r); ecs != nil {
+			w = &ecsScopeWriter{ResponseWriter: w, ecs: ecs}
+		}
+	}
+
+	// With strip_dnssec, clients without the DO bit get no DNSSEC records they didn't ask for
+	if policy.stripDNSSEC && len(r.Question) > 0 && !wantsDNSSEC(r) {
+		w = &dnssecStripWriter{ResponseWriter: w, qtype: r.Question[0].Qtype}
+	}
+
+	// With answer_ttl_jitter, clients sharing an answer don't all re-query when it expires
+	if s.config.AnswerTTLJitter > 0 {
+		w = &ttlJitterWriter{ResponseWriter: w, percent: s.config.AnswerTTLJitter}
+	}
+
+	// Force selected clients to retry over TCP (UDP listener only)
+	if len(s.forceTCPFor) > 0 && isUDPRequest(w) && subnetsContain(s.forceTCPFor, clientIP) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Truncated = true
+		if err := w.WriteMsg(msg); err != nil {
+			errorLog("Error writing truncated response: %v", err)
+		}
+		return
+	}
+
+	// Run the hook chain (empty by default); response hooks apply to every answer below
+	if len(s.hooks) > 0 && len(r.Question) > 0 {
+		var msg *dns.Msg
+		if w, msg = s.runQueryHooks(w, r, clientIP); msg != nil {
+			if err := w.WriteMsg(msg); err != nil {
+				errorLog("Error writing hook response: %v", err)
+			}
+			return
+		}
+	}
+
+	// With enable_ecs, send the client's network upstream so CDNs can answer for its location.
+	// The option is added before the cache lookup, so answers are cached per ECS scope.
+	if s.config.EnableECS && len(r.Question) > 0 && requestECS(r) == nil {
+		if ecs := s.forwardECS(clientIP); ecs != nil {
+			w = &ecsAddedWriter{ResponseWriter: w, hadOPT: r.IsEdns0() != nil}
+			addECS(r, ecs)
+		}
+	}
+
+	// Answer AAAA queries from suppress_aaaa_for clients with NODATA, so they fall back to IPv4
+	if len(s.suppressAAAAFor) > 0 && len(r.Question) > 0 && r.Question[0].Qtype == dns.TypeAAAA &&
+		subnetsContain(s.suppressAAAAFor, s.ruleClientIP(r, clientIP)) {
+		s.debugLog("Suppressed AAAA: %s (from %s)", normalizeDomain(r.Question[0].Name), clientIP)
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.RecursionAvailable = true
+		if err := w.WriteMsg(msg); err != nil {
+			errorLog("Error writing response: %v", err)
+		}
+		return
+	}
+
+	// Tenants in different views never share cached answers (a single global view by default)
+	view := s.clientViewName(s.ruleClientIP(r, clientIP))
+
+	// Refuse classes upstreams don't serve (CHAOS, e.g. version.bind, is still forwarded)
+	if policy.rejectNonINClass && len(r.Question) > 0 &&
+		r.Question[0].Qclass != dns.ClassINET && r.Question[0].Qclass != dns.ClassCHAOS {
+		s.debugLog("Refused %s query for %s (class %s)", dns.TypeToString[r.Question[0].Qtype],
+			normalizeDomain(r.Question[0].Name), dns.Class(r.Question[0].Qclass))
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeRefused)
+		msg.RecursionAvailable = true
+		s.addExtendedError(msg, r, dns.ExtendedErrorCodeNotSupported, "query class not supported")
+		if err := w.WriteMsg(msg); err != nil {
+			errorLog("Error writing response: %v", err)
+		}
+		return
+	}
+
+	// Answer ANY queries locally unless any_mode is "forward"
+	if msg := s.anyResponse(r, policy.anyMode); msg != nil {
+		if err := w.WriteMsg(msg); err != nil {
+			errorLog("Error writing ANY response: %v", err)
+		}
+		return
+	}
 
 	// Check cache first - fastest path for cached responses
-	if cachedResp := s.getCachedResponse(r, clientIP); cachedResp != nil {
-		if err := w.WriteMsg(cachedResp); err != nil {
+	if cachedResp := s.getCachedResponse(r, clientIP, view); cachedResp != nil {
+		atomic.AddUint64(&s.stats.cacheHits, 1)
+		trace.note("cache hit")
+		trace.setAction(queryActionCached)
+		if err := s.nxdomainRedirectWriter(w, r, s.ruleClientIP(r, clientIP)).WriteMsg(cachedResp); err != nil {
 			errorLog("Error writing cached response: %v", err)
 		}
 		return
 	}
+	atomic.AddUint64(&s.stats.cacheMisses, 1)
 
 	// Ensure there is at least one question to avoid panics on malformed requests
 	if len(r.Question) == 0 {
@@ -32,37 +172,100 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	// Normalize domain once
 	domain := normalizeDomain(r.Question[0].Name)
 
-	// Check if domain is blocked (with IP/subnet matching)
-	if s.isBlocked(domain, clientIP) {
-		s.logBlock("Blocked: %s (from %s)", domain, clientIP)
-		// Return NXDOMAIN for blocked domains
+	// Answer diagnostics queries under diagnostics_suffix (disabled by default)
+	if msg := s.diagnosticsResponse(r, domain, clientIP); msg != nil {
+		if err := w.WriteMsg(msg); err != nil {
+			errorLog("Error writing diagnostics response: %v", err)
+		}
+		return
+	}
+
+	// Bypass domains skip every filter and go straight to their trusted upstream
+	if s.isBypassDomain(domain) {
+		s.debugLog("Bypass: %s (from %s)", domain, clientIP)
+		trace.setAction(queryActionForwarded)
+		s.forwardBypass(s.nxdomainRedirectWriter(w, r, s.ruleClientIP(r, clientIP)), r, domain, clientIP, view, trace)
+		return
+	}
+
+	// Stop queries to suspected DNS tunnels, depending on tunnel_action
+	if s.tunnelDetector != nil && s.tunnelDetector.check(domain, r.Question[0].Qtype, clientIP) {
+		if err := w.WriteMsg(s.tunnelResponse(r)); err != nil {
+			errorLog("Error writing response: %v", err)
+		}
+		return
+	}
+
+	// Resolve the client's MAC address (only when MAC-based rules exist)
+	clientMAC := s.getClientMAC(clientIP)
+
+	// Match rules on the EDNS Client Subnet when the query comes from a trusted forwarder
+	ruleIP := s.ruleClientIP(r, clientIP)
+
+	// Check for DNS overwrite (with IP/subnet/MAC matching)
+	overwrite := s.getOverwrite(domain, r.Question[0].Qtype, ruleIP, clientMAC)
+	overwritten := overwrite != nil
+
+	// Check if domain is blocked (with IP/subnet/MAC matching); blocks win unless overwrite_over_block is set
+	var entry *BlockEntry
+	var matched string
+	if !overwritten || !s.config.OverwriteOverBlock {
+		entry, matched = s.matchBlock(domain, ruleIP, clientMAC)
+	}
+	if entry != nil {
+		atomic.AddUint64(&s.stats.blocked, 1)
+		s.blockCategories.record(entry.Category)
+		s.auditBlock(r, ruleIP, matched, entry)
+		trace.setAction(queryActionBlocked)
+		if s.config.Debug {
+			s.debugLog("Blocked: %s (%s, from %s, category: %s)",
+				domain, describeMatch(domain, matched, entry.Source, entry.Subnets, entry.IPs, entry.MACs), ruleIP, entry.Category)
+		} else {
+			s.logBlock("Blocked: %s (from %s, category: %s)", domain, ruleIP, entry.Category)
+		}
+		// Answer according to block_mode (NXDOMAIN by default)
+		msg := s.createBlockedResponse(r, "blocked by block list")
+		if err := w.WriteMsg(msg); err != nil {
+			errorLog("Error writing response: %v", err)
+		}
+		return
+	}
+
+	if overwritten {
+		atomic.AddUint64(&s.stats.overwritten, 1)
+		s.auditOverwrite(r, ruleIP, overwrite.answers())
+		trace.setAction(queryActionOverwritten)
+		if s.config.Debug {
+			s.debugLog("Overwrite: %s -> %s (%s, for client %s)",
+				domain, overwrite.answers(), s.describeOverwriteMatch(domain), ruleIP)
+		} else {
+			s.logOverwrite("Overwrite: %s -> %s (for client %s)", domain, overwrite.answers(), ruleIP)
+		}
+		// Create A/AAAA records response (empty for other overwritten query types)
 		msg := new(dns.Msg)
 		msg.SetReply(r)
 		msg.Authoritative = true
-		msg.SetRcode(r, dns.RcodeNameError)
+		msg.RecursionAvailable = true
+		msg.Answer = s.overwriteRecords(r.Question[0], overwrite)
 		if err := w.WriteMsg(msg); err != nil {
 			errorLog("Error writing response: %v", err)
 		}
 		return
 	}
 
-	// Check for DNS overwrite (with IP/subnet matching)
-	if ip, exists := s.getOverwrite(domain, clientIP); exists {
-		s.logOverwrite("Overwrite: %s -> %s (for client %s)", domain, ip, clientIP)
-		// Create A record response
+	// With strict_rd, non-recursive queries are answered from the cache only (cache miss = empty answer)
+	if policy.strictRD && !r.RecursionDesired {
+		s.debugLog("Not recursing for %s (RD=0, from %s)", domain, clientIP)
 		msg := new(dns.Msg)
 		msg.SetReply(r)
-		msg.Authoritative = true
-		rr, err := dns.NewRR(fmt.Sprintf("%s 300 IN A %s", r.Question[0].Name, ip))
-		if err == nil {
-			msg.Answer = append(msg.Answer, rr)
-			if err := w.WriteMsg(msg); err != nil {
-				errorLog("Error writing response: %v", err)
-			}
-			return
+		msg.RecursionAvailable = true
+		if err := w.WriteMsg(msg); err != nil {
+			errorLog("Error writing response: %v", err)
 		}
+		return
 	}
 
-	// Forward to upstream nameservers
-	s.forwardRequest(w, r, domain, clientIP)
+	// Forward to upstream nameservers (NXDOMAIN answers redirected for nxdomain_redirect_clients)
+	trace.setAction(queryActionForwarded)
+	s.forwardRequest(s.nxdomainRedirectWriter(w, r, ruleIP), r, domain, clientIP, view, trace)
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testQueryNoRD sends a query with the RD bit clear.
+func testQueryNoRD(t *testing.T, s *DNSServer, name string) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	msg.RecursionDesired = false
+	resp, err := s.Query(testClient, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestStrictRD(t *testing.T) {
+	s := newTestServer(t, &Config{CacheTTL: 60, StrictRD: true})
+
+	// A cache miss is answered empty, without forwarding
+	resp := testQueryNoRD(t, s, "www.test.lan")
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || !resp.RecursionAvailable || resp.RecursionDesired {
+		t.Errorf("RD=0 miss: rcode %s, %d answers, RA %v, RD %v, want an empty NOERROR with RA set and RD clear",
+			dns.RcodeToString[resp.Rcode], len(resp.Answer), resp.RecursionAvailable, resp.RecursionDesired)
+	}
+	if forwarded := atomic.LoadUint64(&s.stats.upstreams[0].succeeded); forwarded != 0 {
+		t.Errorf("RD=0 miss forwarded %d queries, want none", forwarded)
+	}
+
+	// Once a recursive query cached the answer, RD=0 queries get it
+	testQuery(t, s, "www.test.lan", dns.TypeA)
+	resp = testQueryNoRD(t, s, "www.test.lan")
+	if ips := answerIPs(resp); len(ips) != 1 || !resp.RecursionAvailable || resp.RecursionDesired {
+		t.Errorf("RD=0 hit: answer %v, RA %v, RD %v, want the cached answer with RA set and RD clear",
+			ips, resp.RecursionAvailable, resp.RecursionDesired)
+	}
+}
+
+func TestRDClearRecursesByDefault(t *testing.T) {
+	s := newTestServer(t, &Config{})
+	resp := testQueryNoRD(t, s, "www.test.lan")
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "10.1.1.1" || !resp.RecursionAvailable {
+		t.Errorf("answer = %v, RA %v, want the forwarded answer with RA set", ips, resp.RecursionAvailable)
+	}
+}
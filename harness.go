@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseRecorder is a dns.ResponseWriter that captures the response instead of
+// sending it, so queries can be run through the handler without a socket.
+type ResponseRecorder struct {
+	Local  net.Addr
+	Remote net.Addr
+	Msg    *dns.Msg // Last message written by the handler
+	Closed bool
+}
+
+// NewResponseRecorder creates a recorder for a UDP query from clientIP.
+func NewResponseRecorder(clientIP net.IP) *ResponseRecorder {
+	return &ResponseRecorder{
+		Local:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53},
+		Remote: &net.UDPAddr{IP: clientIP, Port: 53000},
+	}
+}
+
+// LocalAddr returns the server address the query was "received" on.
+func (w *ResponseRecorder) LocalAddr() net.Addr { return w.Local }
+
+// RemoteAddr returns the simulated client address.
+func (w *ResponseRecorder) RemoteAddr() net.Addr { return w.Remote }
+
+// WriteMsg captures the response message.
+func (w *ResponseRecorder) WriteMsg(msg *dns.Msg) error {
+	w.Msg = msg
+	return nil
+}
+
+// Write captures a packed response message.
+func (w *ResponseRecorder) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.Msg = msg
+	return len(b), nil
+}
+
+// Close marks the recorder as closed.
+func (w *ResponseRecorder) Close() error {
+	w.Closed = true
+	return nil
+}
+
+// TsigStatus always reports success; the recorder does not sign messages.
+func (w *ResponseRecorder) TsigStatus() error { return nil }
+
+// TsigTimersOnly is a no-op.
+func (w *ResponseRecorder) TsigTimersOnly(bool) {}
+
+// Hijack is a no-op.
+func (w *ResponseRecorder) Hijack() {}
+
+// Query runs a DNS message through the request handler as a UDP query from clientIP
+// and returns the response, without a real socket. Useful for tests and embedding.
+func (s *DNSServer) Query(clientIP net.IP, msg *dns.Msg) (*dns.Msg, error) {
+	w := NewResponseRecorder(clientIP)
+	s.handleDNSRequest(w, msg, s.listenerPolicy(listenerUDP))
+	if w.Msg == nil {
+		return nil, fmt.Errorf("no response for query %d", msg.Id)
+	}
+	return w.Msg, nil
+}
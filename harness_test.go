@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is served by the zone file nameserver of servers from newTestServer.
+const testZone = `$ORIGIN test.lan.
+@ 300 IN SOA ns. host. 1 3600 600 86400 60
+www 300 IN A 10.1.1.1
+ads 300 IN A 10.1.1.2
+many 300 IN A 10.2.0.1
+many 300 IN A 10.2.0.2
+many 300 IN A 10.2.0.3
+`
+
+// testClient is the address test queries are sent from.
+var testClient = net.ParseIP("192.0.2.10")
+
+// writeTestFile writes a file into the test's temporary directory and returns its path.
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestServer starts a server for a configuration built in code. Unless the
+// configuration sets nameservers, queries are forwarded to a zone file serving testZone.
+func newTestServer(t *testing.T, config *Config) *DNSServer {
+	t.Helper()
+	if config.Nameservers == nil {
+		config.Nameservers = []interface{}{map[string]interface{}{
+			"protocol":  protocolFile,
+			"zone_file": writeTestFile(t, "test.zone", testZone),
+		}}
+	}
+	s, err := NewDNSServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return s
+}
+
+// testQuery sends a query through the handler from testClient.
+func testQuery(t *testing.T, s *DNSServer, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	resp, err := s.Query(testClient, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// answerIPs returns the addresses in a response's A and AAAA records.
+func answerIPs(resp *dns.Msg) []string {
+	var ips []string
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A.String())
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA.String())
+		}
+	}
+	return ips
+}
+
+func TestNewDNSServerAppliesDefaults(t *testing.T) {
+	s := newTestServer(t, &Config{})
+	if s.coalesceTimeout() <= 0 {
+		t.Errorf("coalesce timeout = %v, want the default", s.coalesceTimeout())
+	}
+	if s.config.UpstreamTimeoutInitialMs <= 0 || s.config.UpstreamTimeoutFinalMs <= 0 {
+		t.Errorf("upstream timeouts = %d/%d ms, want the defaults", s.config.UpstreamTimeoutInitialMs, s.config.UpstreamTimeoutFinalMs)
+	}
+	if s.config.Mode != modeFull || s.config.UpstreamMode != upstreamModeRoundRobin {
+		t.Errorf("mode = %q, upstream mode = %q, want the defaults", s.config.Mode, s.config.UpstreamMode)
+	}
+}
+
+func TestQueryForwards(t *testing.T) {
+	s := newTestServer(t, &Config{})
+	resp := testQuery(t, s, "www.test.lan", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[resp.Rcode])
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "10.1.1.1" {
+		t.Errorf("answer = %v, want [10.1.1.1]", ips)
+	}
+}
+
+func TestQueryBlocked(t *testing.T) {
+	s := newTestServer(t, &Config{
+		BlockLists: []interface{}{writeTestFile(t, "hosts.txt", "0.0.0.0 ads.test.lan\n")},
+	})
+	resp := testQuery(t, s, "ads.test.lan", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode = %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+	if ips := answerIPs(resp); len(ips) != 0 {
+		t.Errorf("answer = %v, want none", ips)
+	}
+	if blocked := atomic.LoadUint64(&s.stats.blocked); blocked != 1 {
+		t.Errorf("blocked = %d, want 1", blocked)
+	}
+}
+
+func TestQueryOverwrite(t *testing.T) {
+	s := newTestServer(t, &Config{
+		Overwrites: map[string]interface{}{"www.test.lan": "10.9.9.9"},
+	})
+	resp := testQuery(t, s, "www.test.lan", dns.TypeA)
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "10.9.9.9" {
+		t.Errorf("answer = %v, want [10.9.9.9]", ips)
+	}
+	if overwritten := atomic.LoadUint64(&s.stats.overwritten); overwritten != 1 {
+		t.Errorf("overwritten = %d, want 1", overwritten)
+	}
+}
+
+func TestQueryCacheHit(t *testing.T) {
+	s := newTestServer(t, &Config{CacheTTL: 60})
+	first := testQuery(t, s, "www.test.lan", dns.TypeA)
+	second := testQuery(t, s, "www.test.lan", dns.TypeA)
+	if hits := atomic.LoadUint64(&s.stats.cacheHits); hits != 1 {
+		t.Errorf("cache hits = %d, want 1", hits)
+	}
+	if got, want := answerIPs(second), answerIPs(first); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("cached answer = %v, want %v", got, want)
+	}
+}
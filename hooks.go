@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Hook is a step of the query hook chain. Hooks run in order for every query that has
+// a question, before the cache, block lists, overwrites and forwarding see it:
+//
+//   - Query may inspect or modify the query in place. Returning a non-nil message answers
+//     the query with it; later hooks' Query functions and the normal pipeline are skipped.
+//   - Response may inspect or modify the response before it is written, whether it was
+//     forwarded, cached, blocked or answered by a hook. orig is the query as the client sent
+//     it. Response functions run in reverse order, so the first hook sees the final response.
+//
+// Either function may be nil. Hooks must be safe for concurrent use.
+type Hook struct {
+	Query    func(s *DNSServer, r *dns.Msg, clientIP net.IP) *dns.Msg
+	Response func(s *DNSServer, orig *dns.Msg, resp *dns.Msg)
+}
+
+// namedHook is a hook in the chain with the name it was configured or registered under.
+type namedHook struct {
+	name string
+	Hook
+}
+
+// ECS source prefix lengths sent by the add_ecs hook, and by enable_ecs by default (RFC 7871 recommendation)
+const (
+	addECSPrefixV4 = 24
+	addECSPrefixV6 = 56
+)
+
+// builtinHooks are the compiled-in hooks that can be selected with the hooks setting.
+var builtinHooks = map[string]Hook{
+	// lowercase_qname sends the query name lowercased, so upstreams and logs see one
+	// spelling, and restores the client's spelling (e.g. 0x20 randomization) in the answer.
+	"lowercase_qname": {
+		Query: func(_ *DNSServer, r *dns.Msg, _ net.IP) *dns.Msg {
+			r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+			return nil
+		},
+		Response: func(_ *DNSServer, orig *dns.Msg, resp *dns.Msg) {
+			resp.Question = orig.Question
+		},
+	},
+	// strip_ecs removes EDNS Client Subnet from queries, so upstreams never learn client networks.
+	"strip_ecs": {
+		Query: func(_ *DNSServer, r *dns.Msg, _ net.IP) *dns.Msg {
+			if opt := r.IsEdns0(); opt != nil {
+				removeECS(opt)
+			}
+			return nil
+		},
+	},
+	// add_ecs adds the client's network (/24 or /56) as EDNS Client Subnet to queries
+	// without one, for geo-aware answers behind this server. The option is removed from
+	// answers to clients that didn't send it.
+	"add_ecs": {
+		Query: func(_ *DNSServer, r *dns.Msg, clientIP net.IP) *dns.Msg {
+			if clientIP == nil || requestECS(r) != nil {
+				return nil
+			}
+			addECS(r, clientSubnetECS(clientIP, addECSPrefixV4, addECSPrefixV6))
+			return nil
+		},
+		Response: func(_ *DNSServer, orig *dns.Msg, resp *dns.Msg) {
+			if requestECS(orig) == nil {
+				removeAddedECS(resp, orig.IsEdns0() != nil)
+			}
+		},
+	},
+}
+
+// parseHooks resolves the configured hook names to the compiled-in hooks, in order.
+func parseHooks(names []string) ([]namedHook, error) {
+	hooks := make([]namedHook, 0, len(names))
+	for _, name := range names {
+		hook, ok := builtinHooks[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown hook %q", name)
+		}
+		hooks = append(hooks, namedHook{name: name, Hook: hook})
+	}
+	return hooks, nil
+}
+
+// AddHook appends a hook to the end of the chain, after the configured ones.
+// It must be called before the server starts handling queries.
+func (s *DNSServer) AddHook(name string, hook Hook) {
+	s.hooks = append(s.hooks, namedHook{name: name, Hook: hook})
+}
+
+// runQueryHooks runs the hook chain on a query. It returns the writer to answer through,
+// which applies the response hooks, and a message if a hook answered the query itself.
+func (s *DNSServer) runQueryHooks(w dns.ResponseWriter, r *dns.Msg, clientIP net.IP) (dns.ResponseWriter, *dns.Msg) {
+	hw := &hookWriter{ResponseWriter: w, server: s, orig: r.Copy()}
+	for i, hook := range s.hooks {
+		hw.ran = i + 1
+		if hook.Query == nil {
+			continue
+		}
+		if msg := hook.Query(s, r, clientIP); msg != nil {
+			s.debugLog("Hook %s answered %s", hook.name, normalizeDomain(r.Question[0].Name))
+			return hw, msg
+		}
+	}
+	return hw, nil
+}
+
+// hookWriter applies the response hooks of the hooks that ran on a query.
+type hookWriter struct {
+	dns.ResponseWriter
+	server *DNSServer
+	orig   *dns.Msg // Query as the client sent it
+	ran    int      // Number of hooks whose query step ran
+}
+
+// WriteMsg runs the response hooks in reverse order on a copy of the response,
+// since the message may be shared with coalesced waiters.
+func (w *hookWriter) WriteMsg(msg *dns.Msg) error {
+	msg = msg.Copy()
+	for i := w.ran - 1; i >= 0; i-- {
+		if hook := w.server.hooks[i]; hook.Response != nil {
+			hook.Response(w.server, w.orig, msg)
+		}
+	}
+	return w.ResponseWriter.WriteMsg(msg)
+}
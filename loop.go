@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// errForwardingLoop is returned when a query would be forwarded to this server itself.
+var errForwardingLoop = errors.New("nameserver is this server's own listen address")
+
+// loopWindow is the interval over which identical queries are counted by loop_detection_threshold.
+const loopWindow = time.Second
+
+// isOwnAddress reports whether a plain DNS nameserver points back at listenAddr.
+// A wildcard listen address matches any loopback or local interface address.
+func isOwnAddress(listenAddr string, ns NameserverConfig, localIPs []net.IP) bool {
+	if ns.Protocol != protocolUDP && ns.Protocol != protocolTCP {
+		return false
+	}
+	host, portStr, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port != ns.Port {
+		return false
+	}
+	nsIP := net.ParseIP(ns.Address)
+	if nsIP == nil {
+		return false
+	}
+
+	listenIP := net.ParseIP(host)
+	if listenIP != nil && !listenIP.IsUnspecified() {
+		return listenIP.Equal(nsIP)
+	}
+	if nsIP.IsLoopback() || nsIP.IsUnspecified() {
+		return true
+	}
+	for _, ip := range localIPs {
+		if ip.Equal(nsIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// localInterfaceIPs returns the addresses of the host's network interfaces.
+func localInterfaceIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// markSelfNameservers flags nameservers that point back at this server. They are skipped,
+// and queries with no other nameserver are answered SERVFAIL instead of looping until they time out.
+func markSelfNameservers(listenAddr string, nameservers []NameserverConfig) {
+	localIPs := localInterfaceIPs()
+	for i := range nameservers {
+		if isOwnAddress(listenAddr, nameservers[i], localIPs) {
+			nameservers[i].self = true
+			log.Printf("Warning: forwarding loop: nameserver %s:%d/%s is this server's own listen address %s, "+
+				"skipping it (queries with no other nameserver are answered SERVFAIL)",
+				nameservers[i].Address, nameservers[i].Port, nameservers[i].Protocol, listenAddr)
+		}
+	}
+}
+
+// loopDetector counts identical cache-missing queries per client to spot forwarding
+// loops between resolvers, which resend the same question many times a second.
+type loopDetector struct {
+	mu        sync.Mutex
+	threshold int
+	start     time.Time
+	counts    map[string]int
+}
+
+// newLoopDetector creates a loop detector (nil when disabled).
+func newLoopDetector(threshold int) *loopDetector {
+	if threshold <= 0 {
+		return nil
+	}
+	return &loopDetector{threshold: threshold, counts: make(map[string]int)}
+}
+
+// record counts a query and reports whether it exceeds the threshold in the current window.
+// The first query over the threshold is logged.
+func (d *loopDetector) record(clientIP net.IP, q dns.Question) bool {
+	key := fmt.Sprintf("%s|%s|%d", clientIP, normalizeDomain(q.Name), q.Qtype)
+	now := time.Now()
+
+	d.mu.Lock()
+	if now.Sub(d.start) >= loopWindow {
+		d.start = now
+		clear(d.counts)
+	}
+	d.counts[key]++
+	count := d.counts[key]
+	d.mu.Unlock()
+
+	if count == d.threshold+1 {
+		log.Printf("Warning: possible forwarding loop: more than %d identical queries for %s %s from %s within %s, answering SERVFAIL",
+			d.threshold, normalizeDomain(q.Name), dns.TypeToString[q.Qtype], clientIP, loopWindow)
+	}
+	return count > d.threshold
+}
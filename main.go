@@ -4,38 +4,42 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
+	"time"
 
-	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
 func main() {
+	profile := flag.String("profile", os.Getenv("GO_DNS_PROFILE"), "config profile to activate (env GO_DNS_PROFILE)")
+	shadowConfig := flag.String("shadow", "", "candidate config to compare against the current one (requires --sample)")
+	shadowSample := flag.String("sample", "", "recorded queries to replay in shadow mode")
+	flag.Parse()
+
 	// Load configuration
 	configFile := "config.yml"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
+	if flag.NArg() > 0 {
+		configFile = flag.Arg(0)
 	}
 
-	configData, err := os.ReadFile(configFile)
+	config, err := loadConfig(configFile, *profile)
 	if err != nil {
-		log.Fatalf("Failed to read config file %s: %v", configFile, err)
-	}
-
-	var config Config
-	if err := yaml.Unmarshal(configData, &config); err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+		log.Fatalf("%v", err)
 	}
 
-	// Set defaults
-	if config.ListenAddr == "" {
-		config.ListenAddr = ":53"
-	}
-	if config.Nameservers == nil {
-		// Default to Google DNS
-		config.Nameservers = []string{"8.8.8.8", "8.8.4.4"}
+	// Shadow mode: compare decisions of a candidate config on recorded queries, then exit
+	if *shadowConfig != "" {
+		if err := shadow(config, *shadowConfig, *profile, *shadowSample); err != nil {
+			log.Fatalf("Shadow evaluation failed: %v", err)
+		}
+		return
 	}
 
 	// Set GOGC if configured (tune garbage collection)
@@ -45,25 +49,212 @@ func main() {
 	}
 
 	// Create and start DNS server
-	server, err := NewDNSServer(&config)
+	server, err := NewDNSServer(config)
 	if err != nil {
 		log.Fatalf("Failed to create DNS server: %v", err)
 	}
 
-	// Start TCP server as well (for larger responses)
+	// Reload hot-reloadable settings on SIGHUP
+	server.startConfigReloader(configFile, *profile)
+
+	// Log a stats summary on SIGUSR1
+	server.startStatsDumper()
+
+	// Shut down cleanly on SIGINT/SIGTERM, e.g. when a container is stopped; a second
+	// signal exits at once
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
 	go func() {
-		tcpServer := &dns.Server{
-			Addr:    config.ListenAddr,
-			Net:     "tcp",
-			Handler: dns.HandlerFunc(server.handleDNSRequest),
-		}
-		if err := tcpServer.ListenAndServe(); err != nil {
-			errorLog("TCP server error: %v", err)
+		sig := <-stop
+		signal.Stop(stop)
+		log.Printf("Received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Warning: shutdown incomplete: %v", err)
 		}
+		close(stopped)
 	}()
 
+	if !config.EnableUDP {
+		// TCP-only deployment
+		if err := server.StartTCP(); err != nil {
+			log.Fatalf("Failed to start DNS server: %v", err)
+		}
+		<-stopped
+		return
+	}
+
+	// Start TCP server as well (for larger responses)
+	if config.EnableTCP {
+		go func() {
+			if err := server.StartTCP(); err != nil {
+				errorLog("TCP server error: %v", err)
+			}
+		}()
+	}
+
 	// Start UDP server (main)
 	if err := server.Start(); err != nil {
 		log.Fatalf("Failed to start DNS server: %v", err)
 	}
+	<-stopped
+}
+
+// shadow builds the current and candidate configurations and replays a query sample against both.
+func shadow(config *Config, candidateFile, profile, sample string) error {
+	if sample == "" {
+		return fmt.Errorf("--shadow requires --sample")
+	}
+	candidateConfig, err := loadConfig(candidateFile, profile)
+	if err != nil {
+		return err
+	}
+
+	current, err := buildDNSServer(config)
+	if err != nil {
+		return fmt.Errorf("current config: %w", err)
+	}
+	candidate, err := buildDNSServer(candidateConfig)
+	if err != nil {
+		return fmt.Errorf("candidate config %s: %w", candidateFile, err)
+	}
+	return runShadow(current, candidate, sample, os.Stdout)
+}
+
+// loadConfig reads and parses the configuration file, applies the selected profile and defaults.
+func loadConfig(configFile, profile string) (*Config, error) {
+	configData, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", configFile, err)
+	}
+
+	// Merge the selected profile over the top-level settings
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(configData, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if _, hasProfiles := raw["profiles"]; hasProfiles || profile != "" {
+		merged, err := applyProfile(raw, profile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply profile: %w", err)
+		}
+		if configData, err = yaml.Marshal(merged); err != nil {
+			return nil, fmt.Errorf("failed to merge profile: %w", err)
+		}
+		if profile != "" {
+			log.Printf("Using config profile %q", profile)
+		}
+	}
+
+	// Defaults for boolean options that are on unless disabled
+	config := Config{
+		EnableUDP: true,
+		EnableTCP: true,
+	}
+	if err := yaml.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if !config.EnableUDP && !config.EnableTCP {
+		return nil, fmt.Errorf("enable_udp and enable_tcp are both false, nothing to serve")
+	}
+
+	applyConfigDefaults(&config)
+
+	return &config, nil
+}
+
+// applyConfigDefaults fills in the defaults of settings left unset. It is applied by
+// loadConfig and again by buildDNSServer, so a Config built in code gets the same defaults
+// as one read from a file.
+func applyConfigDefaults(config *Config) {
+	if config.ListenAddr == "" {
+		config.ListenAddr = ":53"
+	}
+	if config.Nameservers == nil {
+		// Default to Google DNS
+		config.Nameservers = []string{"8.8.8.8", "8.8.4.4"}
+	}
+	if config.MaxCNAMEChain == 0 {
+		config.MaxCNAMEChain = defaultMaxCNAMEChain
+	}
+	if config.MaxAnswers == 0 {
+		config.MaxAnswers = defaultMaxAnswers
+	}
+	if config.MaxAnswersAction == "" {
+		config.MaxAnswersAction = maxAnswersTrim
+	}
+	if config.AllowQueryAction == "" {
+		config.AllowQueryAction = allowQueryRefuse
+	}
+	if config.AnyMode == "" {
+		config.AnyMode = anyModeForward
+	}
+	if config.TunnelThreshold <= 0 {
+		config.TunnelThreshold = defaultTunnelThreshold
+	}
+	if config.TunnelAction == "" {
+		config.TunnelAction = tunnelActionLog
+	}
+	if config.ECSPrefixV4 == 0 {
+		config.ECSPrefixV4 = addECSPrefixV4
+	}
+	if config.ECSPrefixV6 == 0 {
+		config.ECSPrefixV6 = addECSPrefixV6
+	}
+	if config.ValidateDNSSEC && len(config.DNSSECTrustAnchors) == 0 {
+		config.DNSSECTrustAnchors = defaultDNSSECTrustAnchors
+	}
+	if config.UpstreamEDNSBufSize == 0 {
+		config.UpstreamEDNSBufSize = defaultUpstreamEDNSBufSize
+	}
+	if config.EDNSPaddingBlockSize <= 0 {
+		config.EDNSPaddingBlockSize = defaultEDNSPaddingBlockSize
+	}
+	if config.MaxTCPConnections == 0 {
+		config.MaxTCPConnections = defaultMaxTCPConnections
+	}
+	if config.MaxTCPConnectionsPerIP == 0 {
+		config.MaxTCPConnectionsPerIP = defaultMaxTCPConnectionsPerIP
+	}
+	if config.StaleMaxAge <= 0 {
+		config.StaleMaxAge = defaultStaleMaxAge
+	}
+	if config.OverwriteAnswerMode == "" {
+		config.OverwriteAnswerMode = overwriteAnswersAll
+	}
+	if config.OverwriteTTL <= 0 {
+		config.OverwriteTTL = defaultOverwriteTTL
+	}
+	if config.UpstreamMode == "" {
+		config.UpstreamMode = upstreamModeRoundRobin
+	}
+	if config.Mode == "" {
+		config.Mode = modeFull
+	}
+	if config.UpstreamTimeout <= 0 {
+		config.UpstreamTimeout = int(defaultUpstreamTimeout / time.Second)
+	}
+	if config.UpstreamTimeoutInitialMs <= 0 {
+		config.UpstreamTimeoutInitialMs = config.UpstreamTimeout * 1000
+	}
+	if config.UpstreamTimeoutFinalMs <= 0 {
+		config.UpstreamTimeoutFinalMs = config.UpstreamTimeout * 1000
+	}
+	if config.CoalesceTimeout <= 0 {
+		config.CoalesceTimeout = int(defaultCoalesceTimeout / time.Second)
+	}
+	if config.RateLimitBurst <= 0 {
+		config.RateLimitBurst = config.RateLimitPerSecond
+	}
+	if config.CacheShards <= 0 {
+		config.CacheShards = defaultCacheShards
+	}
+	if config.FallbackDNSTimeoutMs <= 0 {
+		config.FallbackDNSTimeoutMs = int(defaultUpstreamTimeout / time.Millisecond)
+	}
+	if config.OnValidationFailure == "" {
+		config.OnValidationFailure = validationFailureNext
+	}
 }
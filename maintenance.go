@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// staleAnswerTTL is the TTL of expired answers served from the cache (RFC 8767 recommendation).
+const staleAnswerTTL = 30
+
+// setMaintenanceMode enters or leaves maintenance mode, logging the change.
+func (s *DNSServer) setMaintenanceMode(enabled bool) {
+	if s.maintenance.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		log.Printf("Entering maintenance mode: answering from cache only (expired entries allowed), SERVFAIL for misses")
+	} else {
+		log.Printf("Leaving maintenance mode: forwarding to upstream nameservers again")
+	}
+}
+
+// answerInMaintenance answers a cache miss in maintenance mode without contacting any upstream:
+// from an expired cache entry if one is left, otherwise with SERVFAIL.
+// Returns false when the server is not in maintenance mode.
+func (s *DNSServer) answerInMaintenance(w dns.ResponseWriter, r *dns.Msg, domain, view string, trace *queryTrace) bool {
+	if !s.maintenance.Load() {
+		return false
+	}
+	if stale := s.getStaleCachedResponse(r, view, "maintenance mode", 0); stale != nil {
+		trace.note("stale answer (maintenance mode)")
+		trace.setAction(queryActionCached)
+		s.debugLog("Maintenance mode: stale answer for %s", domain)
+		s.sendResponse(w, r, stale)
+		return true
+	}
+	trace.note("cache miss in maintenance mode")
+	trace.setAction(queryActionLocal)
+	s.debugLog("Maintenance mode: no cached answer for %s", domain)
+	s.sendResponse(w, r, s.createServerFailureResponse(r, "maintenance mode, answer not cached"))
+	return true
+}
+
+// getStaleCachedResponse returns a cached response even if it has expired, up to maxStale ago
+// (0 = no limit), with expired records served with staleAnswerTTL and an EDE Stale Answer
+// giving the reason.
+func (s *DNSServer) getStaleCachedResponse(r *dns.Msg, view, reason string, maxStale time.Duration) *dns.Msg {
+	key := getCacheKey(r, view)
+	if key == "" {
+		return nil
+	}
+	entry, exists := s.lookupCacheEntry(key)
+	if !exists || (maxStale > 0 && time.Since(entry.ExpiresAt) > maxStale) {
+		return nil
+	}
+
+	msg := entry.Message.Copy()
+	msg.Id = r.Id
+	msg.Question = r.Question
+	msg.RecursionDesired = r.RecursionDesired
+	msg.CheckingDisabled = r.CheckingDisabled
+	matchClientEDNS(msg, r)
+	if remaining := time.Until(entry.ExpiresAt); remaining > 0 {
+		ageTTLs(msg, remaining)
+		return msg
+	}
+	for _, hdr := range recordHeaders(msg) {
+		hdr.Ttl = staleAnswerTTL
+	}
+	s.addExtendedError(msg, r, dns.ExtendedErrorCodeStaleAnswer, reason)
+	return msg
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// errMalformedResponse is wrapped by errors for upstream responses that could not be parsed.
+var errMalformedResponse = errors.New("malformed response")
+
+// isMalformedError reports whether an upstream error means the response itself was malformed,
+// as opposed to a network or protocol failure. The DNS library reports parse failures
+// (e.g. overflows or bad compression pointers) as *dns.Error.
+func isMalformedError(err error) bool {
+	if errors.Is(err, errMalformedResponse) {
+		return true
+	}
+	var dnsErr *dns.Error
+	return errors.As(err, &dnsErr) && !errors.Is(err, dns.ErrId)
+}
+
+// malformedResponse re-packs a parsed response and parses it again, returning a description
+// of the problem if the round trip fails or changes the record counts, or "" if it is sound.
+func malformedResponse(resp *dns.Msg) string {
+	wire, err := resp.Pack()
+	if err != nil {
+		return fmt.Sprintf("does not re-pack: %v", err)
+	}
+	repacked := new(dns.Msg)
+	if err := repacked.Unpack(wire); err != nil {
+		return fmt.Sprintf("re-packed message does not parse: %v", err)
+	}
+	if len(repacked.Answer) != len(resp.Answer) || len(repacked.Ns) != len(resp.Ns) || len(repacked.Extra) != len(resp.Extra) {
+		return fmt.Sprintf("record counts change when re-packed (%d/%d/%d to %d/%d/%d)",
+			len(resp.Answer), len(resp.Ns), len(resp.Extra), len(repacked.Answer), len(repacked.Ns), len(repacked.Extra))
+	}
+	return ""
+}
+
+// recordMalformedResponse counts and logs a malformed upstream response.
+func (s *DNSServer) recordMalformedResponse(domain, address string, nameserver NameserverConfig, problem string) {
+	atomic.AddUint64(&s.stats.malformedResponses, 1)
+	if st := s.upstreamStatsFor(nameserver); st != nil {
+		atomic.AddUint64(&st.malformed, 1)
+	}
+	log.Printf("Warning: malformed response for %s from %s (%s): %s, trying next nameserver",
+		domain, address, nameserver.Protocol, problem)
+}
+
+// upstreamStatsFor returns the counters of a configured nameserver, or nil for
+// nameservers outside the main list (e.g. bypass_upstream).
+func (s *DNSServer) upstreamStatsFor(nameserver NameserverConfig) *upstreamStats {
+	for i, ns := range s.nameservers {
+		if ns.Address == nameserver.Address && ns.Port == nameserver.Port && ns.Protocol == nameserver.Protocol &&
+			i < len(s.stats.upstreams) {
+			return &s.stats.upstreams[i]
+		}
+	}
+	return nil
+}
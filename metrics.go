@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the upstream latency histogram buckets.
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// latencyHistogram counts durations into latencyBuckets. All fields are updated atomically.
+type latencyHistogram struct {
+	counts [len(latencyBuckets) + 1]uint64 // Per bucket, not cumulative; the last one is +Inf
+	sumNs  uint64
+}
+
+// observe adds one duration to the histogram.
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d.Seconds() > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sumNs, uint64(max(d, 0)))
+}
+
+// startMetricsServer serves Prometheus metrics on metrics_addr (disabled by default).
+// It runs on its own listener, so a slow scrape never holds up DNS queries.
+func (s *DNSServer) startMetricsServer() {
+	if s.config.MetricsAddr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", s.config.MetricsAddr)
+	if err != nil {
+		log.Printf("Warning: metrics disabled, failed to listen on %s: %v", s.config.MetricsAddr, err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+	s.metricsServer = server
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errorLog("Metrics server error: %v", err)
+		}
+	}()
+	log.Printf("Prometheus metrics on http://%s/metrics", listener.Addr())
+}
+
+// serveMetrics writes the counters in the Prometheus text exposition format.
+func (s *DNSServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	writeMetric(out, "godns_queries_total", "counter", "DNS queries received.", atomic.LoadUint64(&s.stats.queries))
+	fmt.Fprintf(out, "# HELP godns_blocked_total Queries answered as blocked, by block list category.\n# TYPE godns_blocked_total counter\n")
+	for _, c := range s.blockCategories.snapshot() {
+		fmt.Fprintf(out, "godns_blocked_total{category=\"%s\"} %d\n", labelEscaper.Replace(c.category), c.count)
+	}
+	writeMetric(out, "godns_overwritten_total", "counter", "Queries answered from overwrites.", atomic.LoadUint64(&s.stats.overwritten))
+	writeMetric(out, "godns_cache_hits_total", "counter", "Queries answered from the cache.", atomic.LoadUint64(&s.stats.cacheHits))
+	writeMetric(out, "godns_cache_misses_total", "counter", "Queries not found in the cache.", atomic.LoadUint64(&s.stats.cacheMisses))
+
+	cacheSize, _, cacheBytes := s.cacheCounts()
+	writeMetric(out, "godns_cache_entries", "gauge", "Entries in the cache.", uint64(cacheSize))
+	writeMetric(out, "godns_cache_bytes", "gauge", "Estimated size of the cache in bytes.", uint64(cacheBytes))
+
+	writeMetric(out, "godns_upstream_invalid_responses_total", "counter", "Upstream responses rejected for not matching their query.", atomic.LoadUint64(&s.stats.invalidResponses))
+
+	fmt.Fprintf(out, "# HELP godns_upstream_responses_total Queries sent to each nameserver, by outcome.\n# TYPE godns_upstream_responses_total counter\n")
+	for i, ns := range s.nameservers {
+		labels := upstreamLabels(ns)
+		fmt.Fprintf(out, "godns_upstream_responses_total{%s,result=\"success\"} %d\n", labels, atomic.LoadUint64(&s.stats.upstreams[i].succeeded))
+		fmt.Fprintf(out, "godns_upstream_responses_total{%s,result=\"failure\"} %d\n", labels, atomic.LoadUint64(&s.stats.upstreams[i].failed))
+	}
+
+	fmt.Fprintf(out, "# HELP godns_upstream_tls_errors_total Failures of encrypted nameservers, by category.\n# TYPE godns_upstream_tls_errors_total counter\n")
+	for _, e := range s.tlsErrors.snapshot() {
+		fmt.Fprintf(out, "godns_upstream_tls_errors_total{upstream=\"%s\",category=\"%s\"} %d\n",
+			labelEscaper.Replace(e.address), labelEscaper.Replace(e.category), e.count)
+	}
+
+	fmt.Fprintf(out, "# HELP godns_upstream_latency_seconds Time for each nameserver to answer a forwarded query.\n# TYPE godns_upstream_latency_seconds histogram\n")
+	for i, ns := range s.nameservers {
+		labels := upstreamLabels(ns)
+		h := &s.stats.upstreams[i].latency
+		var cumulative uint64
+		for b, bound := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&h.counts[b])
+			fmt.Fprintf(out, "godns_upstream_latency_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		cumulative += atomic.LoadUint64(&h.counts[len(latencyBuckets)])
+		fmt.Fprintf(out, "godns_upstream_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, cumulative)
+		fmt.Fprintf(out, "godns_upstream_latency_seconds_sum{%s} %g\n", labels, time.Duration(atomic.LoadUint64(&h.sumNs)).Seconds())
+		fmt.Fprintf(out, "godns_upstream_latency_seconds_count{%s} %d\n", labels, cumulative)
+	}
+}
+
+// writeMetric writes a metric without labels with its HELP and TYPE lines.
+func writeMetric(out *bufio.Writer, name, kind, help string, value uint64) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// labelEscaper escapes label values for the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// upstreamLabels returns the labels identifying a nameserver in metrics.
+func upstreamLabels(ns NameserverConfig) string {
+	return fmt.Sprintf(`upstream="%s",protocol="%s"`, labelEscaper.Replace(upstreamAddress(ns)), labelEscaper.Replace(ns.Protocol))
+}
+
+// upstreamAddress returns a nameserver's host and port, or the zone file of a "file" nameserver.
+func upstreamAddress(ns NameserverConfig) string {
+	if ns.Protocol == protocolFile {
+		return ns.Address
+	}
+	return net.JoinHostPort(ns.Address, strconv.Itoa(ns.Port))
+}
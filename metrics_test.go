@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMetricsInvalidResponses(t *testing.T) {
+	// Answers a different name than the one asked for
+	mismatched := func(w dns.ResponseWriter, r *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(r)
+		msg.Question[0].Name = "other.test.lan."
+		_ = w.WriteMsg(msg)
+	}
+	s := newTestServer(t, &Config{Nameservers: startTestUpstream(t, mismatched, mismatched)})
+	testQuery(t, s, "www.test.lan", dns.TypeA)
+
+	rec := httptest.NewRecorder()
+	s.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := "godns_upstream_invalid_responses_total 1\n"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics do not contain %s", want)
+	}
+}
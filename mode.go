@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// applyMode validates the operating mode and clears the configuration of the subsystems
+// it disables, warning about each one that was set anyway.
+func applyMode(config *Config) error {
+	switch config.Mode {
+	case "", modeFull:
+		return nil
+	case modeResolver:
+		if config.BlockLists != nil {
+			log.Printf("Warning: block_lists are ignored in %s mode", modeResolver)
+			config.BlockLists = nil
+		}
+		if len(config.BlockTLDs) > 0 {
+			log.Printf("Warning: block_tlds are ignored in %s mode", modeResolver)
+			config.BlockTLDs = nil
+		}
+		if config.BlockDB != "" {
+			log.Printf("Warning: block_db is ignored in %s mode", modeResolver)
+			config.BlockDB = ""
+		}
+		if len(config.AnswerIPBlocklist) > 0 {
+			log.Printf("Warning: answer_ip_blocklist is ignored in %s mode", modeResolver)
+			config.AnswerIPBlocklist = nil
+		}
+	case modeBlocker:
+	default:
+		return fmt.Errorf("invalid mode %q (valid: %s, %s, %s)", config.Mode, modeFull, modeResolver, modeBlocker)
+	}
+
+	// Neither resolver nor blocker mode answers with overwrites
+	if len(config.Overwrites) > 0 {
+		log.Printf("Warning: overwrites are ignored in %s mode", config.Mode)
+		config.Overwrites = nil
+	}
+	if config.OverwriteDB != "" {
+		log.Printf("Warning: overwrite_db is ignored in %s mode", config.Mode)
+		config.OverwriteDB = ""
+	}
+	return nil
+}
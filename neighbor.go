@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// neighborTableMaxAge is how long a snapshot of the neighbor (ARP) table is reused.
+const neighborTableMaxAge = 10 * time.Second
+
+// neighborTable caches the kernel's IP to MAC address mapping for LAN clients. Queries read
+// an immutable snapshot without locking; one query at a time replaces it once it is stale.
+// Only IPv4 neighbors are known (see readNeighborTable), so MAC rules never match IPv6 clients.
+type neighborTable struct {
+	snapshot   atomic.Pointer[neighborSnapshot]
+	refreshing sync.Mutex // Held by the query rereading the table
+}
+
+// neighborSnapshot is the neighbor table as read at one point in time.
+type neighborSnapshot struct {
+	entries   map[string]net.HardwareAddr
+	refreshed time.Time
+}
+
+// lookup returns the MAC address of a directly connected client, or nil if unknown.
+func (t *neighborTable) lookup(ip net.IP) net.HardwareAddr {
+	if ip == nil {
+		return nil
+	}
+
+	snap := t.snapshot.Load()
+	if snap == nil || time.Since(snap.refreshed) > neighborTableMaxAge {
+		snap = t.refresh(snap)
+	}
+	return snap.entries[ip.String()]
+}
+
+// refresh rereads a stale table. While another query is rereading it, the stale snapshot
+// is used instead of waiting, unless there is none yet.
+func (t *neighborTable) refresh(stale *neighborSnapshot) *neighborSnapshot {
+	if stale != nil && !t.refreshing.TryLock() {
+		return stale
+	}
+	if stale == nil {
+		t.refreshing.Lock()
+	}
+	defer t.refreshing.Unlock()
+
+	// Another query may have refreshed it while this one waited
+	if snap := t.snapshot.Load(); snap != nil && time.Since(snap.refreshed) <= neighborTableMaxAge {
+		return snap
+	}
+	entries, err := readNeighborTable()
+	if err != nil {
+		errorLog("Failed to read neighbor table: %v", err)
+	}
+	snap := &neighborSnapshot{entries: entries, refreshed: time.Now()}
+	t.snapshot.Store(snap)
+	return snap
+}
+
+// getClientMAC returns the client's MAC address if any block or overwrite rule matches on MACs.
+func (s *DNSServer) getClientMAC(clientIP net.IP) net.HardwareAddr {
+	if !s.macRulesEnabled {
+		return nil
+	}
+	return s.neighbors.lookup(clientIP)
+}
+
+// containsMAC checks if a MAC address is in the list.
+func containsMAC(macs []net.HardwareAddr, mac net.HardwareAddr) bool {
+	if mac == nil {
+		return false
+	}
+	for _, m := range macs {
+		if m.String() == mac.String() {
+			return true
+		}
+	}
+	return false
+}
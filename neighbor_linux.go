@@ -0,0 +1,38 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// readNeighborTable reads the IPv4 ARP table from /proc/net/arp.
+func readNeighborTable() (map[string]net.HardwareAddr, error) {
+	file, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	entries := make(map[string]net.HardwareAddr)
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Skip header line
+	for scanner.Scan() {
+		// IP address  HW type  Flags  HW address  Mask  Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue // Incomplete entry
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil || mac.String() == "00:00:00:00:00:00" {
+			continue
+		}
+		entries[fields[0]] = mac
+	}
+	return entries, scanner.Err()
+}
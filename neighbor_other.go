@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// readNeighborTable is not supported on this platform; MAC-based rules never match.
+func readNeighborTable() (map[string]net.HardwareAddr, error) {
+	return nil, nil
+}
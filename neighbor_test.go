@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNeighborTableSnapshot(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	table := &neighborTable{}
+	table.snapshot.Store(&neighborSnapshot{
+		entries:   map[string]net.HardwareAddr{"192.0.2.10": mac},
+		refreshed: time.Now(),
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := table.lookup(net.ParseIP("::ffff:192.0.2.10")); got.String() != mac.String() {
+					t.Errorf("lookup = %v, want %v", got, mac)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A stale snapshot is replaced while queries keep looking up
+	stale := table.snapshot.Load()
+	stale.refreshed = time.Now().Add(-time.Minute)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			table.lookup(net.ParseIP("192.0.2.10"))
+		}()
+	}
+	wg.Wait()
+	if snap := table.snapshot.Load(); snap == stale || time.Since(snap.refreshed) > neighborTableMaxAge {
+		t.Error("stale neighbor table not refreshed")
+	}
+}
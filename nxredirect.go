@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// specialUseDomains are never redirected by nxdomain_redirect_ip: names that must not
+// resolve (RFC 6761, RFC 7686), local-only names (RFC 6762, RFC 8375) and reverse zones.
+var specialUseDomains = []string{
+	"localhost", "invalid", "test", "example", "example.com", "example.net", "example.org",
+	"onion", "local", "home.arpa", "in-addr.arpa", "ip6.arpa",
+}
+
+// parseNXDomainRedirect validates the NXDOMAIN redirect settings and stores them on the server.
+// Redirecting must be scoped to client subnets, since it breaks software relying on NXDOMAIN.
+func (s *DNSServer) parseNXDomainRedirect(config *Config) error {
+	if config.NXDomainRedirectIP == "" {
+		return nil
+	}
+	ip := net.ParseIP(config.NXDomainRedirectIP)
+	if ip == nil {
+		return fmt.Errorf("invalid nxdomain_redirect_ip %q", config.NXDomainRedirectIP)
+	}
+
+	clients, err := parseSubnets(config.NXDomainRedirectClients)
+	if err != nil {
+		return fmt.Errorf("failed to parse nxdomain_redirect_clients: %w", err)
+	}
+	if len(clients) == 0 {
+		return fmt.Errorf("nxdomain_redirect_ip requires at least one nxdomain_redirect_clients subnet")
+	}
+
+	exclude := parseDomainSet(config.NXDomainRedirectExclude)
+	for _, domain := range specialUseDomains {
+		exclude[domain] = struct{}{}
+	}
+
+	s.nxdomainRedirectIP = ip
+	s.nxdomainRedirectClients = clients
+	s.nxdomainRedirectExclude = exclude
+	return nil
+}
+
+// nxdomainRedirectWriter wraps the response writer of an A/AAAA query that is eligible for
+// NXDOMAIN redirection, so it works the same for forwarded and cached answers.
+// Blocked and overwritten queries are answered before it is installed and are never redirected.
+func (s *DNSServer) nxdomainRedirectWriter(w dns.ResponseWriter, r *dns.Msg, clientIP net.IP) dns.ResponseWriter {
+	if s.nxdomainRedirectClients == nil || len(r.Question) == 0 {
+		return w
+	}
+	if qtype := r.Question[0].Qtype; qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return w
+	}
+	if !subnetsContain(s.nxdomainRedirectClients, clientIP) {
+		return w
+	}
+	if _, excluded := lookupDomainSuffix(s.nxdomainRedirectExclude, normalizeDomain(r.Question[0].Name)); excluded {
+		return w
+	}
+	return &redirectWriter{ResponseWriter: w, server: s}
+}
+
+// redirectWriter turns NXDOMAIN answers into the nxdomain_redirect_ip address.
+type redirectWriter struct {
+	dns.ResponseWriter
+	server *DNSServer
+}
+
+// WriteMsg rewrites an NXDOMAIN answer to NOERROR with the redirect address
+// (or no records, if the address family doesn't match the query type).
+func (w *redirectWriter) WriteMsg(msg *dns.Msg) error {
+	if msg.Rcode != dns.RcodeNameError || len(msg.Question) == 0 {
+		return w.ResponseWriter.WriteMsg(msg)
+	}
+
+	q := msg.Question[0]
+	redirected := msg.Copy()
+	redirected.Rcode = dns.RcodeSuccess
+	redirected.Answer = nil
+	redirected.Ns = nil
+	if rr := overwriteRecord(q, w.server.nxdomainRedirectIP, defaultOverwriteTTL); rr != nil {
+		redirected.Answer = append(redirected.Answer, rr)
+	}
+	w.server.debugLog("NXDOMAIN redirect: %s -> %s", normalizeDomain(q.Name), w.server.nxdomainRedirectIP)
+	return w.ResponseWriter.WriteMsg(redirected)
+}
@@ -1,39 +1,168 @@
 package main
 
-import "net"
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
 
-// getOverwrite returns the overwritten IP for a domain if it exists and matches client IP.
-func (s *DNSServer) getOverwrite(domain string, clientIP net.IP) (string, bool) {
+	"github.com/miekg/dns"
+)
+
+// getOverwrite returns the overwrite for a domain if it exists, applies to the query type
+// and matches the client IP or MAC, or nil.
+func (s *DNSServer) getOverwrite(domain string, qtype uint16, clientIP net.IP, clientMAC net.HardwareAddr) *OverwriteEntry {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	// Domain is already normalized in handler
 	entry, exists := s.overwrites[domain]
 	if !exists {
-		return "", false
+		return nil
+	}
+
+	// Other query types are forwarded normally
+	if _, ok := entry.Qtypes[qtype]; !ok {
+		return nil
 	}
 
-	// If no IP/subnet restrictions, apply to all clients
-	if len(entry.Subnets) == 0 && len(entry.IPs) == 0 {
-		return entry.IP, true
+	// If no IP/subnet/MAC restrictions, apply to all clients
+	if len(entry.Subnets) == 0 && len(entry.IPs) == 0 && len(entry.MACs) == 0 {
+		return entry
+	}
+
+	// Check if client MAC matches any specific MAC
+	if containsMAC(entry.MACs, clientMAC) {
+		return entry
 	}
 
 	// Check if client IP matches any specific IP
 	if clientIP != nil {
 		for _, ip := range entry.IPs {
 			if ip.Equal(clientIP) {
-				return entry.IP, true
+				return entry
 			}
 		}
 
 		// Check if client IP matches any subnet
 		for _, subnet := range entry.Subnets {
 			if subnet.Contains(clientIP) {
-				return entry.IP, true
+				return entry
 			}
 		}
 	}
 
 	// Client IP doesn't match restrictions
-	return "", false
+	return nil
+}
+
+// hasOverwrite reports whether any overwrite, for any client or query type, exists for a domain.
+func (s *DNSServer) hasOverwrite(domain string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.overwrites[domain]
+	return exists
+}
+
+// overwriteRecord returns the A or AAAA record answering q with addr, or nil if the query type
+// does not match the address family (the overwrite then answers with no records).
+func overwriteRecord(q dns.Question, addr net.IP, ttl uint32) dns.RR {
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: ttl}
+	switch {
+	case q.Qtype == dns.TypeA && addr.To4() != nil:
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: addr.To4()}
+	case q.Qtype == dns.TypeAAAA && addr.To4() == nil:
+		hdr.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: hdr, AAAA: addr}
+	}
+	return nil
+}
+
+// overwriteRecords returns the records answering q with an overwrite's addresses of the query's
+// address family, none for other query types. With overwrite_answer_mode "round_robin", the
+// records are rotated by one position per query, so each address is first in turn.
+func (s *DNSServer) overwriteRecords(q dns.Question, entry *OverwriteEntry) []dns.RR {
+	ttl := s.overwriteTTL(entry)
+	var records []dns.RR
+	for _, addr := range entry.Addrs {
+		if rr := overwriteRecord(q, addr, ttl); rr != nil {
+			records = append(records, rr)
+		}
+	}
+	if s.config.OverwriteAnswerMode == overwriteAnswersRoundRobin && len(records) > 1 {
+		start := int((entry.next.Add(1) - 1) % uint64(len(records)))
+		records = append(records[start:], records[:start]...)
+	}
+	return records
+}
+
+// answers returns an overwrite's addresses for logs, comma-separated.
+func (e *OverwriteEntry) answers() string {
+	addrs := make([]string, len(e.Addrs))
+	for i, addr := range e.Addrs {
+		addrs[i] = addr.String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// overwriteTTL returns the TTL of an overwrite's records: its own ttl, or overwrite_ttl.
+func (s *DNSServer) overwriteTTL(entry *OverwriteEntry) uint32 {
+	if entry.TTL > 0 {
+		return entry.TTL
+	}
+	return uint32(s.config.OverwriteTTL) // nolint:gosec // validated to 1..maxOverwriteTTL in buildDNSServer
+}
+
+// findBlockEntry returns the block entry for a domain or its closest blocked parent,
+// ignoring client restrictions, and the name it was found under.
+func (s *DNSServer) findBlockEntry(domain string) (*BlockEntry, string) {
+	blocked := s.blockedDomains()
+	if entry, exists := blocked[domain]; exists {
+		return entry, domain
+	}
+	for i := 0; i < len(domain); i++ {
+		if domain[i] == '.' && i+1 < len(domain) {
+			if entry, exists := blocked[domain[i+1:]]; exists && !entry.ExactOnly {
+				return entry, domain[i+1:]
+			}
+		}
+	}
+	return nil, ""
+}
+
+// warnBlockOverwriteConflicts logs each overwritten domain that is also blocked, with the
+// answer it will get. Such overlaps are usually a configuration mistake.
+func (s *DNSServer) warnBlockOverwriteConflicts() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	domains := make([]string, 0, len(s.overwrites))
+	for domain := range s.overwrites {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	conflicts := 0
+	for _, domain := range domains {
+		block, matched := s.findBlockEntry(domain)
+		if block == nil {
+			continue
+		}
+		conflicts++
+
+		overwrite := s.overwrites[domain]
+		resolution := "blocked"
+		if s.config.OverwriteOverBlock {
+			resolution = "overwritten with " + overwrite.IP
+		}
+		log.Printf("Warning: %s is both overwritten (%s) and blocked (%s); resolves as %s",
+			domain,
+			describeMatch(domain, domain, "overwrites", overwrite.Subnets, overwrite.IPs, overwrite.MACs),
+			describeMatch(domain, matched, block.Source, block.Subnets, block.IPs, block.MACs),
+			resolution)
+	}
+	if conflicts > 0 {
+		log.Printf("Warning: %d domains are both blocked and overwritten (set overwrite_over_block to change precedence)", conflicts)
+	}
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache file layout (all integers big-endian):
+//
+//	magic   [4]byte  "GDNS"
+//	version uint8    cacheFileVersion
+//	entries repeated until EOF:
+//	  keyLen    uint16
+//	  key       [keyLen]byte
+//	  expiresAt int64 (unix nanoseconds)
+//	  msgLen    uint16
+//	  msg       [msgLen]byte (packed wire format)
+const (
+	cacheFileMagic   = "GDNS"
+	cacheFileVersion = 1
+)
+
+// cacheSaveInterval is how often the cache is written to cache_file.
+const cacheSaveInterval = 5 * time.Minute
+
+// saveCacheToFile writes all non-expired cache entries to the configured cache file.
+// The file is written to a temporary path first and renamed so a crash never leaves
+// a half-written cache behind.
+func (s *DNSServer) saveCacheToFile() error {
+	path := s.config.CacheFile
+	if path == "" {
+		return nil
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(filepath.Clean(tmpPath))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+
+	count, err := s.writeCache(file)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", tmpPath, err)
+	}
+
+	s.debugLog("Saved %d cache entries to %s", count, path)
+	return nil
+}
+
+// writeCache encodes the cache into w and returns the number of entries written.
+func (s *DNSServer) writeCache(w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(cacheFileMagic); err != nil {
+		return 0, err
+	}
+	if err := bw.WriteByte(cacheFileVersion); err != nil {
+		return 0, err
+	}
+
+	// Each shard's entries are copied out so its lock isn't held while writing
+	type cached struct {
+		key   string
+		entry *CacheEntry
+	}
+	var batch []cached
+	now := time.Now()
+	count := 0
+	var hdr [8]byte
+	for _, shard := range s.cacheShards {
+		batch = batch[:0]
+		shard.mu.RLock()
+		for key, entry := range shard.entries {
+			if now.Before(entry.ExpiresAt) && len(key) <= 0xFFFF {
+				batch = append(batch, cached{key, entry})
+			}
+		}
+		shard.mu.RUnlock()
+
+		for _, c := range batch {
+			wire, err := c.entry.Message.Pack()
+			if err != nil || len(wire) > 0xFFFF {
+				continue
+			}
+
+			binary.BigEndian.PutUint16(hdr[:2], uint16(len(c.key)))
+			if _, err := bw.Write(hdr[:2]); err != nil {
+				return count, err
+			}
+			if _, err := bw.WriteString(c.key); err != nil {
+				return count, err
+			}
+			binary.BigEndian.PutUint64(hdr[:], uint64(c.entry.ExpiresAt.UnixNano()))
+			if _, err := bw.Write(hdr[:]); err != nil {
+				return count, err
+			}
+			binary.BigEndian.PutUint16(hdr[:2], uint16(len(wire)))
+			if _, err := bw.Write(hdr[:2]); err != nil {
+				return count, err
+			}
+			if _, err := bw.Write(wire); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	return count, bw.Flush()
+}
+
+// loadCacheFromFile restores cache entries from the configured cache file.
+// A missing file is not an error. A truncated or corrupt file is discarded
+// entirely so the server starts with a cold cache.
+func (s *DNSServer) loadCacheFromFile() {
+	path := s.config.CacheFile
+	if path == "" {
+		return
+	}
+
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to open cache file %s: %v", path, err)
+		}
+		return
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			s.debugLog("Warning: failed to close %s: %v", path, closeErr)
+		}
+	}()
+
+	now := time.Now()
+	entries, err := readCache(file, now)
+	if err != nil {
+		log.Printf("Warning: discarding cache file %s: %v", path, err)
+		return
+	}
+	if s.config.CacheWarmup > 0 {
+		window := time.Duration(s.config.CacheWarmup) * time.Second
+		if spread := spreadExpiries(entries, now, window); spread > 0 {
+			log.Printf("Spread expiry of %d restored cache entries over the %v warm-up window", spread, window)
+		}
+	}
+
+	// Restored entries count against the cache limits like new ones
+	for key, entry := range entries {
+		s.storeLocalCacheEntry(key, entry)
+		s.markECSScope(key)
+	}
+
+	log.Printf("Restored %d cache entries from %s", len(entries), path)
+}
+
+// spreadExpiries defers the expiry of entries that would expire within the warm-up window
+// to a random point in it, so they are not all refreshed upstream right after startup.
+// Expiries are only ever pushed later. Returns the number of entries changed.
+func spreadExpiries(entries map[string]*CacheEntry, now time.Time, window time.Duration) int {
+	spread := 0
+	for _, entry := range entries {
+		remaining := entry.ExpiresAt.Sub(now)
+		if remaining >= window {
+			continue
+		}
+		// nolint:gosec // Jitter only, not security sensitive
+		entry.ExpiresAt = now.Add(remaining + rand.N(window-remaining))
+		spread++
+	}
+	return spread
+}
+
+// readCache decodes a cache file, skipping entries that have already expired.
+func readCache(r io.Reader, now time.Time) (map[string]*CacheEntry, error) {
+	br := bufio.NewReader(r)
+
+	var header [len(cacheFileMagic) + 1]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if string(header[:len(cacheFileMagic)]) != cacheFileMagic {
+		return nil, fmt.Errorf("bad magic")
+	}
+	if version := header[len(cacheFileMagic)]; version != cacheFileVersion {
+		return nil, fmt.Errorf("unsupported format version %d", version)
+	}
+
+	entries := make(map[string]*CacheEntry)
+	var buf [8]byte
+	for {
+		if _, err := io.ReadFull(br, buf[:2]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return entries, nil
+			}
+			return nil, fmt.Errorf("truncated entry: %w", err)
+		}
+		key := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+		if _, err := io.ReadFull(br, key); err != nil {
+			return nil, fmt.Errorf("truncated key: %w", err)
+		}
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			return nil, fmt.Errorf("truncated expiry: %w", err)
+		}
+		// nolint:gosec // Round-trips the value written by writeCache
+		expiresAt := time.Unix(0, int64(binary.BigEndian.Uint64(buf[:])))
+		if _, err := io.ReadFull(br, buf[:2]); err != nil {
+			return nil, fmt.Errorf("truncated message length: %w", err)
+		}
+		wire := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+		if _, err := io.ReadFull(br, wire); err != nil {
+			return nil, fmt.Errorf("truncated message: %w", err)
+		}
+
+		msg := new(dns.Msg)
+		if err := msg.Unpack(wire); err != nil {
+			return nil, fmt.Errorf("corrupt message for %s: %w", key, err)
+		}
+		if now.After(expiresAt) {
+			continue
+		}
+		entries[string(key)] = &CacheEntry{
+			Message:   msg,
+			ExpiresAt: expiresAt,
+		}
+	}
+}
+
+// startCachePersistence starts a goroutine that periodically saves the cache to disk.
+func (s *DNSServer) startCachePersistence() {
+	if s.config.CacheFile == "" {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(cacheSaveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			if err := s.saveCacheToFile(); err != nil {
+				log.Printf("Warning: failed to save cache: %v", err)
+			}
+		}
+	}()
+}
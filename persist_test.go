@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRestoredCacheRespectsLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.bin")
+	saved := newTestServer(t, &Config{CacheTTL: 300, CacheFile: path})
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("host%d.example.", i)
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.Answer = []dns.RR{mustRR(t, name+" 300 IN A 10.0.0.1")}
+		saved.storeLocalCacheEntry(getCacheKey(msg, ""), &CacheEntry{Message: msg, ExpiresAt: time.Now().Add(5 * time.Minute)})
+	}
+	if err := saved.saveCacheToFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestServer(t, &Config{CacheTTL: 300, CacheFile: path, MaxCacheSize: 10, CacheShards: 1})
+	if entries, _, _ := restored.cacheCounts(); entries != 10 {
+		t.Errorf("restored cache holds %d entries, want max_cache_size 10", entries)
+	}
+}
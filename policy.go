@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Listener names usable as listener_policies keys
+const (
+	listenerUDP = "udp"
+	listenerTCP = "tcp"
+)
+
+// handlerPolicy holds the request handler settings that can differ between listeners.
+type handlerPolicy struct {
+	anyMode          string
+	rejectNonINClass bool
+	stripDNSSEC      bool
+	strictRD         bool
+}
+
+// globalHandlerPolicy returns the policy of the top-level settings, shared by every
+// listener without an entry in listener_policies.
+func globalHandlerPolicy(config *Config) *handlerPolicy {
+	return &handlerPolicy{
+		anyMode:          config.AnyMode,
+		rejectNonINClass: config.RejectNonINClass,
+		stripDNSSEC:      config.StripDNSSEC,
+		strictRD:         config.StrictRD,
+	}
+}
+
+// parseListenerPolicies builds the policy of each listener in listener_policies, with unset
+// settings inherited from the global policy.
+func parseListenerPolicies(configs map[string]ListenerPolicyConfig, global *handlerPolicy) (map[string]*handlerPolicy, error) {
+	policies := make(map[string]*handlerPolicy, len(configs))
+	for name, c := range configs {
+		if name != listenerUDP && name != listenerTCP {
+			return nil, fmt.Errorf("unknown listener %q (valid: %s, %s)", name, listenerUDP, listenerTCP)
+		}
+		policy := *global
+		switch c.AnyMode {
+		case "":
+		case anyModeForward, anyModeRefuse, anyModeMinimal:
+			policy.anyMode = c.AnyMode
+		default:
+			return nil, fmt.Errorf("invalid any_mode %q for listener %s (valid: %s, %s, %s)",
+				c.AnyMode, name, anyModeForward, anyModeRefuse, anyModeMinimal)
+		}
+		if c.RejectNonINClass != nil {
+			policy.rejectNonINClass = *c.RejectNonINClass
+		}
+		if c.StripDNSSEC != nil {
+			policy.stripDNSSEC = *c.StripDNSSEC
+		}
+		if c.StrictRD != nil {
+			policy.strictRD = *c.StrictRD
+		}
+		policies[name] = &policy
+	}
+	return policies, nil
+}
+
+// listenerPolicy returns the policy of a listener, the global policy unless listener_policies overrides it.
+func (s *DNSServer) listenerPolicy(name string) *handlerPolicy {
+	if policy, ok := s.listenerPolicies[name]; ok {
+		return policy
+	}
+	return s.policy
+}
+
+// listenerHandler returns the request handler of a listener, bound to its policy.
+func (s *DNSServer) listenerHandler(name string) dns.Handler {
+	policy := s.listenerPolicy(name)
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		s.handleDNSRequest(w, r, policy)
+	})
+}
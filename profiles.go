@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultProfile is activated when no profile is selected and the config defines it.
+const defaultProfile = "default"
+
+// applyProfile merges the selected profile into the top-level configuration keys.
+//
+// Semantics:
+//   - Keys outside "profiles" are the base configuration shared by all profiles.
+//   - A profile may name a parent with "extends"; ancestors are applied root first.
+//   - Each key a profile sets replaces the inherited value entirely (lists and maps are not merged).
+//   - With no profile selected, "default" is used if it exists, otherwise only the base.
+func applyProfile(raw map[string]interface{}, name string) (map[string]interface{}, error) {
+	profiles, err := profilesFromConfig(raw["profiles"])
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		if key != "profiles" {
+			merged[key] = value
+		}
+	}
+
+	if name == "" {
+		if _, ok := profiles[defaultProfile]; !ok {
+			return merged, nil
+		}
+		name = defaultProfile
+	}
+
+	chain, err := profileChain(profiles, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range chain {
+		for key, value := range profiles[profile] {
+			if key != "extends" {
+				merged[key] = value
+			}
+		}
+	}
+	return merged, nil
+}
+
+// profilesFromConfig converts the "profiles" section into a map of profile name to settings.
+func profilesFromConfig(section interface{}) (map[string]map[string]interface{}, error) {
+	profiles := make(map[string]map[string]interface{})
+	if section == nil {
+		return profiles, nil
+	}
+	entries, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid profiles format: expected a map of profile names")
+	}
+	for name, value := range entries {
+		settings, ok := value.(map[string]interface{})
+		if !ok && value != nil {
+			return nil, fmt.Errorf("invalid profile %q: expected a map of settings", name)
+		}
+		if _, nested := settings["profiles"]; nested {
+			return nil, fmt.Errorf("profile %q cannot define nested profiles", name)
+		}
+		profiles[name] = settings
+	}
+	return profiles, nil
+}
+
+// profileChain returns a profile and its ancestors, root first.
+func profileChain(profiles map[string]map[string]interface{}, name string) ([]string, error) {
+	var chain []string
+	seen := make(map[string]bool)
+	for current := name; current != ""; {
+		settings, ok := profiles[current]
+		if !ok {
+			if current == name {
+				return nil, fmt.Errorf("unknown profile %q (available: %s)", name, profileNames(profiles))
+			}
+			return nil, fmt.Errorf("profile %q extends unknown profile %q", chain[0], current)
+		}
+		if seen[current] {
+			return nil, fmt.Errorf("profile %q has an inheritance cycle through %q", name, current)
+		}
+		seen[current] = true
+		chain = append([]string{current}, chain...)
+
+		parent, _ := settings["extends"].(string)
+		current = parent
+	}
+	return chain, nil
+}
+
+// profileNames returns the sorted profile names for error messages.
+func profileNames(profiles map[string]map[string]interface{}) string {
+	if len(profiles) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
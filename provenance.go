@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// describeMatch explains which rule matched a domain, for debug logs, e.g.
+// "matched parent x.com from adlist.txt, restricted to subnets".
+// Only called with debug enabled, so the string building stays off the hot path.
+func describeMatch(domain, matched, source string, subnets []*net.IPNet, ips []net.IP, macs []net.HardwareAddr) string {
+	kind := "exact"
+	switch {
+	case isRegexMatch(matched):
+		kind = "pattern " + strings.TrimPrefix(matched, regexBlockPrefix)
+	case matched != domain:
+		kind = "parent " + matched
+	}
+
+	var restrictions []string
+	if len(ips) > 0 {
+		restrictions = append(restrictions, "IPs")
+	}
+	if len(subnets) > 0 {
+		restrictions = append(restrictions, "subnets")
+	}
+	if len(macs) > 0 {
+		restrictions = append(restrictions, "MACs")
+	}
+	scope := "all clients"
+	if len(restrictions) > 0 {
+		scope = "restricted to " + strings.Join(restrictions, "/")
+	}
+
+	return fmt.Sprintf("matched %s from %s, %s", kind, source, scope)
+}
+
+// describeOverwriteMatch explains which overwrite rule matched a domain, for debug logs.
+func (s *DNSServer) describeOverwriteMatch(domain string) string {
+	s.mu.RLock()
+	entry, exists := s.overwrites[domain]
+	s.mu.RUnlock()
+	if !exists {
+		return "no matching rule"
+	}
+	return describeMatch(domain, domain, "overwrites", entry.Subnets, entry.IPs, entry.MACs)
+}
+
+// explainDecision describes how the server would handle a query, without forwarding it.
+// Used by the _check diagnostics query.
+func (s *DNSServer) explainDecision(domain string, qtype uint16, clientIP net.IP, clientMAC net.HardwareAddr) string {
+	if s.isBypassDomain(domain) {
+		return "bypass (not filtered)"
+	}
+
+	overwrite := s.getOverwrite(domain, qtype, clientIP, clientMAC)
+	if overwrite == nil || !s.config.OverwriteOverBlock {
+		if entry, matched := s.matchBlock(domain, clientIP, clientMAC); entry != nil {
+			return s.describeBlock(domain, qtype, matched, entry)
+		}
+	}
+	if overwrite != nil {
+		return "overwrite -> " + overwrite.answers()
+	}
+	return s.describeRoute(domain, qtype)
+}
+
+// describeBlock describes the block rule a query matched and how it is answered.
+func (s *DNSServer) describeBlock(domain string, qtype uint16, matched string, entry *BlockEntry) string {
+	return fmt.Sprintf("blocked (%s, category: %s, answer: %s)",
+		describeMatch(domain, matched, entry.Source, entry.Subnets, entry.IPs, entry.MACs),
+		entry.Category, s.blockModes.modeFor(qtype))
+}
+
+// describeRoute describes the nameservers a forwarded query would be sent to.
+func (s *DNSServer) describeRoute(domain string, qtype uint16) string {
+	group := s.upstreamGroupFor(domain)
+	var upstreams []string
+	for _, ns := range group.nameservers {
+		if ns.acceptsQtype(qtype) {
+			upstreams = append(upstreams, fmt.Sprintf("%s:%d/%s", ns.Address, ns.Port, ns.Protocol))
+		}
+	}
+	if len(upstreams) == 0 {
+		return "servfail (no nameserver accepts this query type)"
+	}
+	if group.suffix != "" {
+		return fmt.Sprintf("forward (%s, route %s) to %s", s.config.UpstreamMode, group.suffix, strings.Join(upstreams, ", "))
+	}
+	return fmt.Sprintf("forward (%s) to %s", s.config.UpstreamMode, strings.Join(upstreams, ", "))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PROXY protocol signatures (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt).
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+)
+
+// proxyV1MaxLength is the maximum length of a v1 header including CRLF.
+const proxyV1MaxLength = 107
+
+// errProxyHeaderUntrusted is returned when a PROXY header arrives from an untrusted peer.
+var errProxyHeaderUntrusted = errors.New("PROXY header from untrusted source")
+
+// proxyProtoListener wraps a TCP listener so connections from trusted proxies
+// report the original client address from their PROXY protocol header.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// newProxyProtoListener wraps a listener with PROXY protocol support.
+func newProxyProtoListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtoListener{Listener: l, trusted: trusted}
+}
+
+// Accept waits for the next connection. The PROXY header is parsed lazily on first use,
+// so a slow client cannot block the accept loop.
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	trusted := false
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		trusted = subnetsContain(l.trusted, tcpAddr.IP)
+	}
+	return &proxyProtoConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		trusted: trusted,
+	}, nil
+}
+
+// proxyProtoConn is a connection that may start with a PROXY protocol header.
+type proxyProtoConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	trusted bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// Read reads data following the PROXY header.
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the peer address if there is none.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader consumes the PROXY header. Trusted peers must send one; untrusted peers must not.
+func (c *proxyProtoConn) readHeader() {
+	// A DNS-over-TCP message is always longer than the v2 signature
+	peek, err := c.reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		c.err = err
+		return
+	}
+	isV1 := bytes.HasPrefix(peek, proxyV1Signature)
+	isV2 := bytes.Equal(peek, proxyV2Signature)
+
+	switch {
+	case !c.trusted && (isV1 || isV2):
+		c.err = errProxyHeaderUntrusted
+		errorLog("Rejected PROXY header from untrusted source %s", c.Conn.RemoteAddr())
+	case !c.trusted:
+		// Plain DNS from an untrusted peer
+	case isV1:
+		c.remote, c.err = readProxyV1(c.reader)
+	case isV2:
+		c.remote, c.err = readProxyV2(c.reader)
+	default:
+		c.err = fmt.Errorf("missing PROXY header from trusted proxy %s", c.Conn.RemoteAddr())
+	}
+
+	if c.err != nil {
+		_ = c.Conn.Close()
+	}
+}
+
+// readProxyV1 parses a text (v1) PROXY header, e.g. "PROXY TCP4 1.2.3.4 5.6.7.8 1234 53\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid PROXY v1 header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// Connection proxied without address information - use the peer address
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid PROXY v1 source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses a binary (v2) PROXY header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 header: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 addresses: %w", err)
+	}
+
+	// LOCAL command (health checks from the proxy itself) - use the peer address
+	if verCmd&0x0F == 0 {
+		return nil, nil
+	}
+
+	switch family >> 4 {
+	case 1: // AF_INET
+		if length < 12 {
+			return nil, fmt.Errorf("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 2: // AF_INET6
+		if length < 36 {
+			return nil, fmt.Errorf("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX - no usable client IP
+		return nil, nil
+	}
+}
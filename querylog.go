@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Query log tuning
+const (
+	queryLogQueueSize     = 8192        // Entries buffered while the file is slow to write
+	queryLogBufferSize    = 64 * 1024   // Bytes written to the file at once
+	queryLogFlushInterval = time.Second // Buffered entries reach the file at most this late
+	queryLogSampleBuckets = 1000000     // Resolution of deterministic query_log_sample decisions
+)
+
+// What happened to a query, as recorded in the query log
+const (
+	queryActionBlocked     = "blocked"
+	queryActionOverwritten = "overwritten"
+	queryActionForwarded   = "forwarded"
+	queryActionCached      = "cached"
+	queryActionRateLimited = "ratelimited"
+	queryActionDenied      = "denied"
+	queryActionLocal       = "local" // Answered by the server itself, e.g. refused or synthesized
+)
+
+// queryLogEntry is one query in query_log_file, written as one JSON line.
+type queryLogEntry struct {
+	Time      string  `json:"time"` // When the query arrived
+	Client    string  `json:"client,omitempty"`
+	QName     string  `json:"qname"`
+	QType     string  `json:"qtype"`
+	Action    string  `json:"action"`
+	Upstream  string  `json:"upstream,omitempty"` // Nameserver that answered a forwarded query
+	Rcode     string  `json:"rcode,omitempty"`    // Empty when no answer was sent
+	LatencyMs float64 `json:"latency_ms"`         // From arrival until the query was handled
+}
+
+// queryLogger appends queries to query_log_file as newline-delimited JSON. Logging never
+// blocks: entries are queued for a writer goroutine, and dropped (and counted) when the
+// queue is full.
+type queryLogger struct {
+	path    string
+	file    *os.File
+	lines   chan []byte
+	dropped atomic.Uint64
+	started atomic.Bool
+	stopped chan struct{} // Closed once the writer has flushed and closed the file
+}
+
+// newQueryLogger opens query_log_file for appending (nil when not configured).
+func newQueryLogger(path string) (*queryLogger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &queryLogger{
+		path:    path,
+		file:    file,
+		lines:   make(chan []byte, queryLogQueueSize),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+// record queues an entry for the writer, or counts it as dropped if the queue is full.
+func (q *queryLogger) record(entry queryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		q.dropped.Add(1)
+		return
+	}
+	select {
+	case q.lines <- append(line, '\n'):
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// droppedEntries returns the number of queries that never reached the file.
+func (q *queryLogger) droppedEntries() uint64 {
+	return q.dropped.Load()
+}
+
+// start writes queued entries to the file until done is closed, flushing every
+// queryLogFlushInterval. Entries still queued when done is closed are written before the
+// file is closed.
+func (q *queryLogger) start(done <-chan struct{}) {
+	q.started.Store(true)
+	go func() {
+		defer close(q.stopped)
+		bw := bufio.NewWriterSize(q.file, queryLogBufferSize)
+		ticker := time.NewTicker(queryLogFlushInterval)
+		defer ticker.Stop()
+		failing := false // Only the first failure of a run is logged
+		check := func(err error) {
+			if err != nil && !failing {
+				log.Printf("Warning: failed to write query log %s: %v", q.path, err)
+			}
+			failing = err != nil
+		}
+		for {
+			select {
+			case <-done:
+				for len(q.lines) > 0 {
+					_, _ = bw.Write(<-q.lines)
+				}
+				check(bw.Flush())
+				check(q.file.Close())
+				return
+			case line := <-q.lines:
+				if _, err := bw.Write(line); err != nil {
+					q.dropped.Add(1)
+					check(err)
+				}
+			case <-ticker.C:
+				if bw.Buffered() > 0 {
+					check(bw.Flush())
+				}
+			}
+		}
+	}()
+}
+
+// wait waits until the writer has flushed and closed the file after done was closed.
+func (q *queryLogger) wait(ctx context.Context) error {
+	if !q.started.Load() {
+		return nil
+	}
+	select {
+	case <-q.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// queryLogWriter records the rcode of the answer sent to the client, for query_log_file.
+type queryLogWriter struct {
+	dns.ResponseWriter
+	rcode    int
+	answered bool
+}
+
+// WriteMsg records the answer's rcode and writes it.
+func (w *queryLogWriter) WriteMsg(msg *dns.Msg) error {
+	w.rcode, w.answered = msg.Rcode, true
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// setAction records what happened to the query, for query_log_file.
+func (t *queryTrace) setAction(action string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.action = action
+	t.mu.Unlock()
+}
+
+// setUpstream records the nameserver that answered the query, for query_log_file.
+func (t *queryTrace) setUpstream(ns NameserverConfig) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.upstream = upstreamAddress(ns)
+	t.mu.Unlock()
+}
+
+// logQuery writes a handled query to query_log_file, subject to query_log_sample.
+func (s *DNSServer) logQuery(t *queryTrace, w *queryLogWriter, r *dns.Msg, clientIP net.IP) {
+	t.mu.Lock()
+	action, upstream := t.action, t.upstream
+	t.mu.Unlock()
+	if action == "" {
+		action = queryActionLocal
+	}
+	qname := ""
+	if len(r.Question) > 0 {
+		qname = normalizeDomain(r.Question[0].Name)
+	}
+	if !s.sampleQueryLog(action, qname) {
+		return
+	}
+
+	entry := queryLogEntry{
+		Time:      t.start.UTC().Format(time.RFC3339Nano),
+		Client:    auditClient(clientIP),
+		QName:     qname,
+		Action:    action,
+		Upstream:  upstream,
+		LatencyMs: float64(time.Since(t.start).Microseconds()) / 1000,
+	}
+	if len(r.Question) > 0 {
+		entry.QType = dns.Type(r.Question[0].Qtype).String()
+	}
+	if w.answered {
+		entry.Rcode = getRcodeName(w.rcode)
+	}
+	s.queryLog.record(entry)
+}
+
+// sampleQueryLog reports whether a query is written to the query log. Blocked and overwritten
+// queries always are; others with probability query_log_sample. With
+// query_log_sample_deterministic the decision is a hash of the name instead of random, so
+// repeated queries for a name are either all logged or none.
+func (s *DNSServer) sampleQueryLog(action, qname string) bool {
+	rate := s.config.QueryLogSample
+	if rate <= 0 || rate >= 1 || action == queryActionBlocked || action == queryActionOverwritten {
+		return true
+	}
+	if s.config.QueryLogSampleDeterministic {
+		return fnv1a(fnvOffset64, qname)%queryLogSampleBuckets < uint64(rate*queryLogSampleBuckets)
+	}
+	return rand.Float64() < rate
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSampleQueryLog(t *testing.T) {
+	s := &DNSServer{config: &Config{QueryLogSample: 0.5, QueryLogSampleDeterministic: true}}
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("host%d.example", i)
+		keep := s.sampleQueryLog(queryActionForwarded, name)
+		for j := 0; j < 3; j++ {
+			if s.sampleQueryLog(queryActionCached, name) != keep {
+				t.Fatalf("%s: sampled inconsistently", name)
+			}
+		}
+		if keep {
+			kept++
+		}
+		if !s.sampleQueryLog(queryActionBlocked, name) || !s.sampleQueryLog(queryActionOverwritten, name) {
+			t.Fatalf("%s: blocked or overwritten query not logged", name)
+		}
+	}
+	if kept < 400 || kept > 600 {
+		t.Errorf("deterministic sampling kept %d of 1000 names, want about 500", kept)
+	}
+
+	s.config.QueryLogSampleDeterministic = false
+	kept = 0
+	for i := 0; i < 1000; i++ {
+		if s.sampleQueryLog(queryActionForwarded, "www.example") {
+			kept++
+		}
+	}
+	if kept < 400 || kept > 600 {
+		t.Errorf("random sampling kept %d of 1000 queries, want about 500", kept)
+	}
+}
+
+func TestQueryLogSampleKeepsBlocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	s := newTestServer(t, &Config{
+		QueryLogFile:   path,
+		QueryLogSample: 0.000001,
+		BlockLists:     []interface{}{writeTestFile(t, "hosts.txt", "0.0.0.0 ads.test.lan\n")},
+	})
+	for i := 0; i < 10; i++ {
+		testQuery(t, s, "www.test.lan", dns.TypeA)
+	}
+	testQuery(t, s, "ads.test.lan", dns.TypeA)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"qname":"ads.test.lan"`) {
+		t.Errorf("query log = %q, want only the blocked query", lines)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamQPSMaxWait is how long a cache-miss query may wait for an upstream token
+// before it is answered with SERVFAIL instead of being forwarded.
+const upstreamQPSMaxWait = 100 * time.Millisecond
+
+// Per-client rate limit tuning
+const (
+	clientLimiterShards          = 64          // Independently locked parts of the client bucket map
+	clientLimiterCleanupInterval = time.Minute // How often buckets of idle clients are removed
+	clientLimiterShardBuckets    = 16384       // Buckets per shard (about a million clients in all) before others are evicted
+)
+
+// tokenBucket is a simple token bucket rate limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Maximum number of tokens
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full token bucket with the given rate and burst.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last call. Caller must hold tb.mu.
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// full reports whether the bucket has refilled completely, so dropping it loses nothing.
+func (tb *tokenBucket) full(now time.Time) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
+
+// allow takes a token if one is available.
+func (tb *tokenBucket) allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill(time.Now())
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true
+	}
+	return false
+}
+
+// wait takes a token, sleeping up to maxWait for one to become available.
+// Returns false without consuming a token if none would be available in time.
+func (tb *tokenBucket) wait(maxWait time.Duration) bool {
+	tb.mu.Lock()
+	tb.refill(time.Now())
+	if tb.tokens >= 1 {
+		tb.tokens--
+		tb.mu.Unlock()
+		return true
+	}
+
+	// Reserve the next token if it arrives within maxWait
+	delay := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+	if delay > maxWait {
+		tb.mu.Unlock()
+		return false
+	}
+	tb.tokens--
+	tb.mu.Unlock()
+
+	time.Sleep(delay)
+	return true
+}
+
+// acquireUpstreamToken applies the global max_upstream_qps cap.
+// Returns true if the query may be forwarded upstream.
+func (s *DNSServer) acquireUpstreamToken() bool {
+	if s.upstreamLimiter == nil {
+		return true
+	}
+	if s.upstreamLimiter.wait(upstreamQPSMaxWait) {
+		return true
+	}
+	atomic.AddUint64(&s.upstreamLimitedTotal, 1)
+	atomic.AddUint64(&s.upstreamLimitedRecent, 1)
+	return false
+}
+
+// clientLimiter is the rate_limit_per_second token bucket of each client address. The
+// buckets are spread over shards with their own locks, and a client that already has a
+// bucket only takes its shard's read lock, so well-behaved clients don't allocate.
+type clientLimiter struct {
+	rate         float64
+	burst        int
+	shardBuckets int // Buckets per shard before others are evicted
+	shards       [clientLimiterShards]clientLimiterShard
+	refused      atomic.Uint64 // Queries refused since startup
+}
+
+// clientLimiterShard holds the buckets of the client addresses hashing to it.
+type clientLimiterShard struct {
+	mu      sync.RWMutex
+	buckets map[netip.Addr]*tokenBucket
+}
+
+// newClientLimiter creates the per-client limiter for rate_limit_per_second (nil when disabled).
+func newClientLimiter(config *Config) *clientLimiter {
+	if config.RateLimitPerSecond <= 0 {
+		return nil
+	}
+	l := &clientLimiter{
+		rate:         float64(config.RateLimitPerSecond),
+		burst:        config.RateLimitBurst,
+		shardBuckets: clientLimiterShardBuckets,
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[netip.Addr]*tokenBucket)
+	}
+	return l
+}
+
+// shard returns the shard holding a client address.
+func (l *clientLimiter) shard(addr netip.Addr) *clientLimiterShard {
+	b := addr.As16()
+	h := binary.LittleEndian.Uint64(b[:8]) ^ binary.LittleEndian.Uint64(b[8:])
+	return &l.shards[(h*0x9E3779B97F4A7C15>>32)%clientLimiterShards]
+}
+
+// allow takes a token from a client's bucket, creating the bucket on the client's first query.
+// Queries without a client address are never limited.
+func (l *clientLimiter) allow(clientIP net.IP) bool {
+	addr, ok := netip.AddrFromSlice(clientIP)
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	shard := l.shard(addr)
+
+	shard.mu.RLock()
+	bucket := shard.buckets[addr]
+	shard.mu.RUnlock()
+	if bucket == nil {
+		shard.mu.Lock()
+		if bucket = shard.buckets[addr]; bucket == nil {
+			// Spoofed source addresses must not grow the map without bound
+			if len(shard.buckets) >= l.shardBuckets {
+				shard.evictLocked()
+			}
+			bucket = newTokenBucket(l.rate, l.burst)
+			shard.buckets[addr] = bucket
+		}
+		shard.mu.Unlock()
+	}
+	if bucket.allow() {
+		return true
+	}
+	l.refused.Add(1)
+	return false
+}
+
+// evictLocked removes a bucket to make room for a new client: an idle one that has refilled
+// if one is found among the first few, otherwise a random one. Caller must hold shard.mu.
+func (shard *clientLimiterShard) evictLocked() {
+	now := time.Now()
+	checked := 0
+	var victim netip.Addr
+	for addr, bucket := range shard.buckets {
+		victim = addr
+		if checked++; bucket.full(now) || checked >= 8 {
+			break
+		}
+	}
+	delete(shard.buckets, victim)
+}
+
+// cleanup removes the buckets of clients that have been idle long enough to refill them.
+func (l *clientLimiter) cleanup() {
+	now := time.Now()
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		for addr, bucket := range shard.buckets {
+			if bucket.full(now) {
+				delete(shard.buckets, addr)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// startClientLimiterCleanup periodically removes idle client buckets.
+func (s *DNSServer) startClientLimiterCleanup() {
+	if s.clientLimiter == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(clientLimiterCleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			s.clientLimiter.cleanup()
+		}
+	}()
+}
+
+// startUpstreamLimitReporter periodically logs how often the upstream QPS cap engaged.
+func (s *DNSServer) startUpstreamLimitReporter() {
+	if s.upstreamLimiter == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			if n := atomic.SwapUint64(&s.upstreamLimitedRecent, 0); n > 0 {
+				log.Printf("Upstream QPS cap engaged %d times in the last minute (total: %d)",
+					n, atomic.LoadUint64(&s.upstreamLimitedTotal))
+			}
+		}
+	}()
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientLimiterBucketsBounded(t *testing.T) {
+	l := newClientLimiter(&Config{RateLimitPerSecond: 1, RateLimitBurst: 1})
+	l.shardBuckets = 4
+
+	// A flood from spoofed addresses
+	for i := 0; i < 10000; i++ {
+		if !l.allow(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))) {
+			t.Fatal("first query of a new client refused")
+		}
+	}
+	for i := range l.shards {
+		if n := len(l.shards[i].buckets); n > l.shardBuckets {
+			t.Errorf("shard %d holds %d buckets, want at most %d", i, n, l.shardBuckets)
+		}
+	}
+}
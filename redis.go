@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache backends
+const (
+	cacheBackendMemory = "memory"
+	cacheBackendRedis  = "redis"
+)
+
+const (
+	redisKeyPrefix  = "go-dns:"              // Prefix for all cache keys stored in Redis
+	redisTimeout    = 100 * time.Millisecond // Per-command timeout, keeps a slow Redis off the query path
+	redisRetryAfter = 5 * time.Second        // How long Redis is skipped after a failure
+	redisMaxIdle    = 8                      // Idle connections kept in the pool
+
+	sharedCacheWriters   = 4    // Goroutines writing cache fills to the shared cache
+	sharedCacheQueueSize = 1024 // Writes buffered while the shared cache is slow; later ones are dropped
+)
+
+// sharedCacheBackend is a second-level cache shared between server instances.
+// The in-memory cache always stays in front of it as the first level.
+type sharedCacheBackend interface {
+	// get returns the entry for a key, or nil if it is not cached.
+	get(key string) (*CacheEntry, error)
+	// set stores an entry until it expires.
+	set(key string, entry *CacheEntry) error
+}
+
+// newSharedCacheBackend creates the configured shared cache, or nil for the in-memory cache only.
+func newSharedCacheBackend(config *Config) (sharedCacheBackend, error) {
+	switch config.CacheBackend {
+	case "", cacheBackendMemory:
+		return nil, nil
+	case cacheBackendRedis:
+		if config.RedisAddr == "" {
+			return nil, fmt.Errorf("cache_backend %q requires redis_addr", cacheBackendRedis)
+		}
+		return newRedisCache(config.RedisAddr, config.RedisPassword), nil
+	default:
+		return nil, fmt.Errorf("unknown cache_backend %q (valid: %s, %s)", config.CacheBackend, cacheBackendMemory, cacheBackendRedis)
+	}
+}
+
+// getSharedCacheEntry looks up a key in the shared cache after a local miss.
+// Hits are copied into the local cache. Errors count as misses, so queries are forwarded.
+func (s *DNSServer) getSharedCacheEntry(key string) *CacheEntry {
+	if s.sharedCache == nil {
+		return nil
+	}
+	entry, err := s.sharedCache.get(key)
+	if err != nil || entry == nil {
+		return nil
+	}
+	s.storeLocalCacheEntry(key, entry)
+	return entry
+}
+
+// sharedCacheWrite is a cache fill waiting to be written to the shared cache.
+type sharedCacheWrite struct {
+	key   string
+	entry *CacheEntry
+}
+
+// setSharedCacheEntry queues an entry for the shared cache writers. If the queue is full,
+// for example while Redis is slow, the write is dropped: the entry is still cached locally.
+func (s *DNSServer) setSharedCacheEntry(key string, entry *CacheEntry) {
+	if s.sharedCache == nil {
+		return
+	}
+	select {
+	case s.sharedCacheWrites <- sharedCacheWrite{key: key, entry: entry}:
+	default:
+		s.sharedCacheDropped.Add(1)
+	}
+}
+
+// startSharedCacheWriters starts the goroutines writing queued cache fills to the shared
+// cache until done is closed. A fixed number of writers bounds the connections to Redis.
+func (s *DNSServer) startSharedCacheWriters() {
+	if s.sharedCache == nil {
+		return
+	}
+	for i := 0; i < sharedCacheWriters; i++ {
+		go func() {
+			for {
+				select {
+				case <-s.done:
+					return
+				case w := <-s.sharedCacheWrites:
+					_ = s.sharedCache.set(w.key, w.entry)
+				}
+			}
+		}()
+	}
+}
+
+// redisCache is a minimal Redis client (RESP protocol) implementing sharedCacheBackend.
+type redisCache struct {
+	addr     string
+	password string
+	pool     chan *redisConn
+
+	mu        sync.Mutex
+	downUntil time.Time // Redis is skipped until this time after a failure
+}
+
+// redisConn is a pooled connection with its reply reader.
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// errRedisUnavailable is returned while Redis is being skipped after a failure.
+var errRedisUnavailable = errors.New("redis unavailable")
+
+// newRedisCache creates a Redis cache client. Connections are opened on demand.
+func newRedisCache(addr, password string) *redisCache {
+	return &redisCache{
+		addr:     addr,
+		password: password,
+		pool:     make(chan *redisConn, redisMaxIdle),
+	}
+}
+
+// get implements sharedCacheBackend.
+func (c *redisCache) get(key string) (*CacheEntry, error) {
+	reply, err := c.do("GET", redisKeyPrefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok || len(data) < 8 {
+		return nil, fmt.Errorf("invalid cache value for %s", key)
+	}
+
+	// nolint:gosec // Round-trips the value written by set
+	expiresAt := time.Unix(0, int64(binary.BigEndian.Uint64(data[:8])))
+	if time.Now().After(expiresAt) {
+		return nil, nil
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(data[8:]); err != nil {
+		return nil, fmt.Errorf("corrupt cache value for %s: %w", key, err)
+	}
+	return &CacheEntry{Message: msg, ExpiresAt: expiresAt}, nil
+}
+
+// set implements sharedCacheBackend.
+func (c *redisCache) set(key string, entry *CacheEntry) error {
+	ttl := time.Until(entry.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		return nil
+	}
+	wire, err := entry.Message.Pack()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 8, 8+len(wire))
+	// nolint:gosec // Unix nanoseconds are positive for any realistic expiry
+	binary.BigEndian.PutUint64(data, uint64(entry.ExpiresAt.UnixNano()))
+	data = append(data, wire...)
+
+	_, err = c.do("SET", redisKeyPrefix+key, string(data), "PX", strconv.FormatInt(ttl, 10))
+	return err
+}
+
+// do runs a single command. Failures mark Redis as down for redisRetryAfter.
+func (c *redisCache) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	down := time.Now().Before(c.downUntil)
+	c.mu.Unlock()
+	if down {
+		return nil, errRedisUnavailable
+	}
+
+	conn, err := c.conn()
+	if err != nil {
+		c.markDown(err)
+		return nil, err
+	}
+	reply, err := conn.command(args...)
+	if err != nil {
+		_ = conn.Close()
+		c.markDown(err)
+		return nil, err
+	}
+
+	// Return the connection to the pool, or close it if the pool is full
+	select {
+	case c.pool <- conn:
+	default:
+		_ = conn.Close()
+	}
+	return reply, nil
+}
+
+// conn takes a pooled connection or dials a new one.
+func (c *redisCache) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if c.password != "" {
+		if _, err := conn.command("AUTH", c.password); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("redis AUTH failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// markDown skips Redis for redisRetryAfter, logging when it first becomes unavailable.
+func (c *redisCache) markDown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().After(c.downUntil) {
+		log.Printf("Warning: Redis cache at %s unavailable, forwarding without it for %v: %v", c.addr, redisRetryAfter, err)
+	}
+	c.downUntil = time.Now().Add(redisRetryAfter)
+}
+
+// command sends a RESP command and reads its reply.
+// Replies are nil (missing key), string (status), int64 or []byte (bulk string).
+func (conn *redisConn) command(args ...string) (interface{}, error) {
+	if err := conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return conn.readReply()
+}
+
+// readReply reads a single RESP reply.
+func (conn *redisConn) readReply() (interface{}, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length %q", payload)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(conn.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	default:
+		return nil, fmt.Errorf("unsupported redis reply type %q", line[0])
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingBackend is a shared cache that records written keys, blocking until released.
+type recordingBackend struct {
+	release chan struct{}
+	mu      sync.Mutex
+	keys    []string
+}
+
+func (b *recordingBackend) get(string) (*CacheEntry, error) { return nil, nil }
+
+func (b *recordingBackend) set(key string, _ *CacheEntry) error {
+	<-b.release
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keys = append(b.keys, key)
+	return nil
+}
+
+func TestSharedCacheWritesBounded(t *testing.T) {
+	backend := &recordingBackend{release: make(chan struct{})}
+	s := &DNSServer{
+		sharedCache:       backend,
+		sharedCacheWrites: make(chan sharedCacheWrite, sharedCacheQueueSize),
+		done:              make(chan struct{}),
+	}
+	defer close(s.done)
+	s.startSharedCacheWriters()
+
+	// Each writer takes one entry and blocks; the queue holds the rest
+	total := sharedCacheWriters + sharedCacheQueueSize + 10
+	for i := 0; i < total; i++ {
+		s.setSharedCacheEntry("key", &CacheEntry{})
+		for i < sharedCacheWriters && len(s.sharedCacheWrites) > 0 {
+			time.Sleep(time.Millisecond) // Let a writer pick it up
+		}
+	}
+	if dropped := s.sharedCacheDropped.Load(); dropped != 10 {
+		t.Errorf("dropped = %d, want 10", dropped)
+	}
+
+	close(backend.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		backend.mu.Lock()
+		written := len(backend.keys)
+		backend.mu.Unlock()
+		if written == total-10 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("queued writes were not all written")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// regexBlockPrefix marks a block list line holding a regular expression instead of a domain.
+const regexBlockPrefix = "regex:"
+
+// regexBlock is a block list pattern matched against whole normalized domain names.
+type regexBlock struct {
+	re    *regexp.Regexp
+	entry *BlockEntry
+}
+
+// setRegexBlocks replaces the patterns loaded from a block list source, so reloading a list
+// doesn't accumulate copies of its patterns.
+func (s *DNSServer) setRegexBlocks(source string, blocks []regexBlock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.regexBlocks = slices.DeleteFunc(s.regexBlocks, func(b regexBlock) bool {
+		return b.entry.Source == source
+	})
+	s.regexBlocks = append(s.regexBlocks, blocks...)
+}
+
+// matchRegexBlockLocked returns the entry of the first pattern matching a domain for the given
+// client, and the pattern with its prefix, or nil. The caller must hold s.mu.
+func (s *DNSServer) matchRegexBlockLocked(domain string, clientIP net.IP, clientMAC net.HardwareAddr) (*BlockEntry, string) {
+	for _, block := range s.regexBlocks {
+		if block.re.MatchString(domain) && s.matchesBlockEntry(block.entry, clientIP, clientMAC) {
+			return block.entry, regexBlockPrefix + block.re.String()
+		}
+	}
+	return nil, ""
+}
+
+// isRegexMatch reports whether a matched name returned by matchBlock is a pattern.
+func isRegexMatch(matched string) bool {
+	return strings.HasPrefix(matched, regexBlockPrefix)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadConfig applies the hot-reloadable settings from a freshly loaded configuration.
+// Settings that require restarting listeners or background services are not reloaded.
+func (s *DNSServer) reloadConfig(config *Config) {
+	noCache := parseDomainSet(config.NoCache)
+	forceCache, err := parseForceCache(config.ForceCache)
+	if err != nil {
+		log.Printf("Warning: keeping previous force_cache: %v", err)
+	}
+
+	s.mu.Lock()
+	s.noCache = noCache
+	if err == nil {
+		s.forceCache = forceCache
+	}
+	forceCacheCount := len(s.forceCache)
+	s.mu.Unlock()
+
+	s.reloadBlockTLDs(config)
+	s.setMaintenanceMode(config.MaintenanceMode)
+
+	log.Printf("Reloaded configuration (%d no_cache domains, %d force_cache domains)", len(noCache), forceCacheCount)
+}
+
+// startConfigReloader reloads the configuration file (with the same profile) whenever SIGHUP is received.
+func (s *DNSServer) startConfigReloader(configFile, profile string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sighup)
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-sighup:
+			}
+			log.Printf("Received SIGHUP, reloading %s", configFile)
+			config, err := loadConfig(configFile, profile)
+			if err != nil {
+				log.Printf("Warning: failed to reload configuration: %v", err)
+				continue
+			}
+			s.reloadConfig(config)
+		}
+	}()
+}
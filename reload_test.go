@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReloadKeepsForceCacheOnError(t *testing.T) {
+	s := newTestServer(t, &Config{ForceCache: map[string]int{"a.example": 60, "b.example": 60}})
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	s.reloadConfig(&Config{ForceCache: map[string]int{"c.example": 0}})
+
+	if _, ok := s.forcedCacheTTL("a.example"); !ok {
+		t.Error("previous force_cache not kept")
+	}
+	for _, want := range []string{"Warning: keeping previous force_cache: invalid force_cache TTL 0", "2 force_cache domains"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log misses %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// upstreamGroup is a set of nameservers queries are forwarded to: the default nameservers,
+// or those of an upstream_routes suffix.
+type upstreamGroup struct {
+	suffix      string             // Route suffix ("" for the default nameservers)
+	members     []int              // Indices into DNSServer.nameservers
+	nameservers []NameserverConfig // The members' configurations, in the same order
+	next        atomic.Uint64      // Round-robin counter
+}
+
+// newUpstreamGroup creates a group of the nameservers at the given indices.
+func newUpstreamGroup(suffix string, members []int, nameservers []NameserverConfig) *upstreamGroup {
+	group := &upstreamGroup{suffix: suffix, members: members}
+	for _, idx := range members {
+		group.nameservers = append(group.nameservers, nameservers[idx])
+	}
+	return group
+}
+
+// parseUpstreamRoutes parses upstream_routes into a group per domain suffix. The routes'
+// nameservers are appended to nameservers, so they get circuit breakers and stats like
+// the default ones; a nameserver configured identically more than once is shared.
+// Returns the routes and the extended nameserver list.
+func parseUpstreamRoutes(routes map[string]interface{}, nameservers []NameserverConfig, listenAddr string) (map[string]*upstreamGroup, []NameserverConfig, error) {
+	if len(routes) == 0 {
+		return nil, nameservers, nil
+	}
+	parsed := make(map[string]*upstreamGroup, len(routes))
+	for suffix, value := range routes {
+		domain := normalizeDomain(strings.TrimPrefix(strings.TrimSpace(suffix), "*."))
+		if domain == "" {
+			return nil, nil, fmt.Errorf("empty domain suffix")
+		}
+		if _, exists := parsed[domain]; exists {
+			return nil, nil, fmt.Errorf("duplicate domain suffix %q", domain)
+		}
+		routeNameservers, err := parseNameservers(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", domain, err)
+		}
+		if len(routeNameservers) == 0 {
+			return nil, nil, fmt.Errorf("%s: no nameservers", domain)
+		}
+		markSelfNameservers(listenAddr, routeNameservers)
+
+		members := make([]int, 0, len(routeNameservers))
+		for _, ns := range routeNameservers {
+			idx := slices.IndexFunc(nameservers, func(existing NameserverConfig) bool {
+				return sameNameserver(existing, ns)
+			})
+			if idx < 0 {
+				idx = len(nameservers)
+				nameservers = append(nameservers, ns)
+			}
+			members = append(members, idx)
+		}
+		parsed[domain] = newUpstreamGroup(domain, members, nameservers)
+	}
+	return parsed, nameservers, nil
+}
+
+// sameNameserver reports whether two nameserver configurations are interchangeable.
+func sameNameserver(a, b NameserverConfig) bool {
+	return nameserverKey(a) == nameserverKey(b) && a.ZoneFile == b.ZoneFile &&
+		slices.Equal(a.OnlyQtypes, b.OnlyQtypes) && slices.Equal(a.ExceptQtypes, b.ExceptQtypes)
+}
+
+// upstreamGroupFor returns the nameservers to forward a domain to: those of the most
+// specific upstream_routes suffix matching it, otherwise the default nameservers.
+func (s *DNSServer) upstreamGroupFor(domain string) *upstreamGroup {
+	if len(s.upstreamRoutes) > 0 {
+		if group, ok := lookupDomainSuffix(s.upstreamRoutes, domain); ok {
+			return group
+		}
+	}
+	return s.defaultUpstreams
+}
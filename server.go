@@ -7,19 +7,59 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-// NewDNSServer creates a new DNS server instance.
+// NewDNSServer creates a new DNS server instance and starts its background services.
 func NewDNSServer(config *Config) (*DNSServer, error) {
+	server, err := buildDNSServer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restore persisted cache entries (if configured)
+	server.loadCacheFromFile()
+
+	// Start background goroutines
+	server.startBackgroundServices()
+
+	// Pre-populate the cache without delaying startup
+	server.startCacheWarming()
+
+	return server, nil
+}
+
+// buildDNSServer parses the configuration and loads block lists and zones,
+// without starting any background services.
+func buildDNSServer(config *Config) (*DNSServer, error) {
+	applyConfigDefaults(config)
+
+	// Drop the configuration of subsystems disabled by the operating mode
+	if err := applyMode(config); err != nil {
+		return nil, err
+	}
+
 	// Parse nameservers
 	nameservers, err := parseNameservers(config.Nameservers)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse nameservers: %w", err)
 	}
+	markSelfNameservers(config.ListenAddr, nameservers)
+	defaultNameservers := make([]int, len(nameservers))
+	for i := range defaultNameservers {
+		defaultNameservers[i] = i
+	}
+
+	// Parse per-domain nameservers; they are appended to nameservers
+	upstreamRoutes, nameservers, err := parseUpstreamRoutes(config.UpstreamRoutes, nameservers, config.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream_routes: %w", err)
+	}
 
 	// Parse overwrites
 	overwrites, err := parseOverwrites(config.Overwrites)
@@ -27,42 +67,343 @@ func NewDNSServer(config *Config) (*DNSServer, error) {
 		return nil, fmt.Errorf("failed to parse overwrites: %w", err)
 	}
 
+	// Validate upstream selection mode
+	switch config.UpstreamMode {
+	case "", upstreamModeRoundRobin, upstreamModeFixed, upstreamModeConsistentHash:
+	default:
+		return nil, fmt.Errorf("invalid upstream_mode %q (valid: %s, %s, %s)",
+			config.UpstreamMode, upstreamModeRoundRobin, upstreamModeFixed, upstreamModeConsistentHash)
+	}
+
+	// Validate the policy for responses that fail validation
+	switch config.OnValidationFailure {
+	case "", validationFailureNext, validationFailureServfail:
+	default:
+		return nil, fmt.Errorf("invalid on_validation_failure %q (valid: %s, %s)",
+			config.OnValidationFailure, validationFailureNext, validationFailureServfail)
+	}
+
+	// Validate the action for oversized answers
+	switch config.MaxAnswersAction {
+	case "", maxAnswersTrim, maxAnswersReject:
+	default:
+		return nil, fmt.Errorf("invalid max_answers_action %q (valid: %s, %s)",
+			config.MaxAnswersAction, maxAnswersTrim, maxAnswersReject)
+	}
+
+	// Validate how queries from clients outside allow_query are answered
+	switch config.AllowQueryAction {
+	case "", allowQueryRefuse, allowQueryDrop:
+	default:
+		return nil, fmt.Errorf("invalid allow_query_action %q (valid: %s, %s)",
+			config.AllowQueryAction, allowQueryRefuse, allowQueryDrop)
+	}
+
+	// Validate how ANY queries are answered
+	switch config.AnyMode {
+	case "", anyModeForward, anyModeRefuse, anyModeMinimal:
+	default:
+		return nil, fmt.Errorf("invalid any_mode %q (valid: %s, %s, %s)",
+			config.AnyMode, anyModeForward, anyModeRefuse, anyModeMinimal)
+	}
+
+	switch config.OverwriteAnswerMode {
+	case "", overwriteAnswersAll, overwriteAnswersRoundRobin:
+	default:
+		return nil, fmt.Errorf("invalid overwrite_answer_mode %q (valid: %s, %s)",
+			config.OverwriteAnswerMode, overwriteAnswersAll, overwriteAnswersRoundRobin)
+	}
+
+	if config.StaleRaceTimeoutMs < 0 {
+		return nil, fmt.Errorf("invalid stale_race_timeout_ms %d (must not be negative)", config.StaleRaceTimeoutMs)
+	}
+	if config.StaleRaceTimeoutMs > 0 && !config.ServeStale {
+		log.Printf("Warning: stale_race_timeout_ms has no effect without serve_stale")
+	}
+
+	if config.OverwriteTTL > maxOverwriteTTL {
+		return nil, fmt.Errorf("invalid overwrite_ttl %d (max: %d)", config.OverwriteTTL, maxOverwriteTTL)
+	}
+
+	// Attempts are cut short when the shared coalesce_timeout deadline passes
+	if config.UpstreamTimeoutFinalMs > config.CoalesceTimeout*1000 {
+		log.Printf("Warning: upstream_timeout_final_ms (%d) is longer than coalesce_timeout (%ds), attempts end at coalesce_timeout",
+			config.UpstreamTimeoutFinalMs, config.CoalesceTimeout)
+	}
+
+	// Jitter may at most halve TTLs
+	if config.AnswerTTLJitter < 0 || config.AnswerTTLJitter > maxAnswerTTLJitter {
+		return nil, fmt.Errorf("invalid answer_ttl_jitter %d (valid: 0-%d)", config.AnswerTTLJitter, maxAnswerTTLJitter)
+	}
+
+	// Padding blocks must leave room for the rest of the message
+	if config.EDNSPaddingBlockSize > maxEDNSPaddingBlockSize {
+		return nil, fmt.Errorf("invalid edns_padding_block_size %d (max: %d)", config.EDNSPaddingBlockSize, maxEDNSPaddingBlockSize)
+	}
+
+	// Parse forced cache TTLs
+	forceCache, err := parseForceCache(config.ForceCache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse force_cache: %w", err)
+	}
+
+	// Parse trusted upstreams for bypass domains
+	var bypassNameservers []NameserverConfig
+	if config.BypassUpstream != nil {
+		bypassNameservers, err = parseNameservers(config.BypassUpstream)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bypass_upstream: %w", err)
+		}
+		markSelfNameservers(config.ListenAddr, bypassNameservers)
+	}
+
+	// Configure the resolver used for block list hosts when system DNS is down
+	fallback, err := newFallbackResolver(config)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create server instance
-	server := createDNSServerInstance(config, nameservers, overwrites)
+	server := createDNSServerInstance(config, nameservers, overwrites, fallback)
+	server.forceCache = forceCache
+	server.bypassDomains = parseDomainSet(config.BypassDomains)
+	server.bypassNameservers = bypassNameservers
+	server.defaultUpstreams = newUpstreamGroup("", defaultNameservers, nameservers)
+	server.upstreamRoutes = upstreamRoutes
+	server.diagnosticsSuffix = normalizeDomain(config.DiagnosticsSuffix)
+	server.loopDetector = newLoopDetector(config.LoopDetectionThreshold)
+	server.tunnelDetector, err = newTunnelDetector(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load zone files for "file" nameservers
+	if err := server.loadFileZones(); err != nil {
+		return nil, fmt.Errorf("failed to load zone files: %w", err)
+	}
+
+	// Connect the shared cache backend
+	server.sharedCache, err = newSharedCacheBackend(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure cache backend: %w", err)
+	}
+	if server.sharedCache != nil {
+		server.sharedCacheWrites = make(chan sharedCacheWrite, sharedCacheQueueSize)
+	}
+
+	// Bound the domain name interning cache
+	if config.DomainCacheSize != 0 {
+		setDomainCacheSize(config.DomainCacheSize)
+	}
+
+	// Parse how blocked queries are answered
+	server.blockModes, err = parseBlockModes(config.BlockMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse block_mode: %w", err)
+	}
+
+	// Compile answer address ranges to block
+	server.answerIPBlocklist, err = parseAnswerIPBlocklist(config.AnswerIPBlocklist)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse answer_ip_blocklist: %w", err)
+	}
+
+	// Parse the clients allowed to query
+	server.allowQuery, err = parseSubnets(config.AllowQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse allow_query: %w", err)
+	}
+
+	// Parse clients that are forced to TCP
+	server.forceTCPFor, err = parseSubnets(config.ForceTCPFor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse force_tcp_for: %w", err)
+	}
+
+	// Parse the DNSSEC trust anchors
+	if config.ValidateDNSSEC {
+		server.dnssecValidator, err = newDNSSECValidator(config.DNSSECTrustAnchors, server.lookupDNSSECRecords)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dnssec_trust_anchors: %w", err)
+		}
+	}
+
+	// Resolve the query hook chain
+	server.hooks, err = parseHooks(config.Hooks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hooks: %w", err)
+	}
+
+	// Parse the NXDOMAIN redirect scope
+	if err := server.parseNXDomainRedirect(config); err != nil {
+		return nil, err
+	}
+
+	// Start in maintenance mode if configured
+	server.setMaintenanceMode(config.MaintenanceMode)
+
+	// Set up the decision audit stream
+	server.auditSink, err = newAuditSink(config.AuditSink)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse audit_sink: %w", err)
+	}
+
+	// Open the query log
+	if config.QueryLogSample < 0 || config.QueryLogSample > 1 {
+		return nil, fmt.Errorf("invalid query_log_sample %v (must be between 0 and 1)", config.QueryLogSample)
+	}
+	server.queryLog, err = newQueryLogger(config.QueryLogFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open query_log_file: %w", err)
+	}
+
+	// Per-listener handler settings, falling back to the global ones
+	server.policy = globalHandlerPolicy(config)
+	server.listenerPolicies, err = parseListenerPolicies(config.ListenerPolicies, server.policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse listener_policies: %w", err)
+	}
+
+	// Parse client views for cache partitioning
+	server.views, err = parseViews(config.Views)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse views: %w", err)
+	}
+
+	// Parse clients with broken IPv6
+	server.suppressAAAAFor, err = parseSubnets(config.SuppressAAAAFor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse suppress_aaaa_for: %w", err)
+	}
+
+	// Parse trusted PROXY protocol sources
+	if config.ProxyProtocol {
+		server.proxyTrusted, err = parseSubnets(config.ProxyProtocolTrusted)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy_protocol_trusted: %w", err)
+		}
+		if len(server.proxyTrusted) == 0 {
+			return nil, fmt.Errorf("proxy_protocol requires at least one proxy_protocol_trusted subnet")
+		}
+	}
+
+	// Parse forwarders whose EDNS Client Subnet is trusted
+	server.trustECSFrom, err = parseSubnets(config.TrustECSFrom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trust_ecs_from: %w", err)
+	}
+
+	// Validate the client subnet sent with enable_ecs
+	if config.EnableECS {
+		if config.ECSPrivacy {
+			return nil, fmt.Errorf("enable_ecs and ecs_privacy cannot both be set")
+		}
+		if config.ECSPrefixV4 < 1 || config.ECSPrefixV4 > 32 {
+			return nil, fmt.Errorf("invalid ecs_prefix_v4 %d (must be 1-32)", config.ECSPrefixV4)
+		}
+		if config.ECSPrefixV6 < 1 || config.ECSPrefixV6 > 128 {
+			return nil, fmt.Errorf("invalid ecs_prefix_v6 %d (must be 1-128)", config.ECSPrefixV6)
+		}
+	}
+
+	// Parse query types that skip the UDP attempt
+	server.preferTCPQtypes, err = parseQtypes(config.PreferTCPForQtypes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prefer_tcp_for_qtypes: %w", err)
+	}
+
+	// Constrain upstream UDP source ports (if configured)
+	if config.UpstreamSourcePortRange != "" {
+		low, high, err := parsePortRange(config.UpstreamSourcePortRange)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse upstream_source_port_range: %w", err)
+		}
+		if high-low+1 < minSafeSourcePorts {
+			log.Printf("Warning: upstream_source_port_range %s allows only %d source ports, which weakens protection against DNS spoofing",
+				config.UpstreamSourcePortRange, high-low+1)
+		}
+		server.sourcePortMin, server.sourcePortMax = low, high
+	}
 
 	// Load block lists into memory (supports both file paths and conditional blocks)
 	if err := server.loadBlockLists(); err != nil {
 		return nil, fmt.Errorf("failed to load block lists: %w", err)
 	}
 
-	// Start background goroutines
-	server.startBackgroundServices()
+	// Parse TLD and suffix block rules
+	var tldMACs bool
+	server.blockTLDs, tldMACs, err = server.parseBlockTLDs(config.BlockTLDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse block_tlds: %w", err)
+	}
+	server.macRulesEnabled = server.macRulesEnabled || tldMACs
+	if len(server.blockTLDs) > 0 {
+		log.Printf("Loaded %d block_tlds rules", len(server.blockTLDs))
+	}
+
+	// Merge overwrites and blocks from SQLite databases
+	if err := server.loadDatabases(); err != nil {
+		return nil, err
+	}
+
+	// Flag domains that are both blocked and overwritten
+	server.warnBlockOverwriteConflicts()
+
+	// Enable MAC lookups if any overwrite matches on MACs (block lists set this while loading)
+	for _, entry := range overwrites {
+		if len(entry.MACs) > 0 {
+			server.macRulesEnabled = true
+		}
+	}
+	if server.macRulesEnabled && runtime.GOOS != "linux" {
+		log.Printf("Warning: MAC-based rules are only supported on Linux and will not match on %s", runtime.GOOS)
+	}
 
 	return server, nil
 }
 
 // createDNSServerInstance creates and initializes a DNS server instance.
-func createDNSServerInstance(config *Config, nameservers []NameserverConfig, overwrites map[string]*OverwriteEntry) *DNSServer {
+func createDNSServerInstance(config *Config, nameservers []NameserverConfig, overwrites map[string]*OverwriteEntry, fallback *fallbackResolver) *DNSServer {
 	// Create HTTP client with DNS fallback support
-	httpClient := createHTTPClientWithDNSFallback(config.FallbackDNS, config.DNSCheckDomain)
-
-	return &DNSServer{
-		config:          config,
-		blocked:         make(map[string]*BlockEntry),
-		overwrites:      overwrites,
-		nameservers:     nameservers,
-		cache:           make(map[string]*CacheEntry),
-		maxCacheSize:    config.MaxCacheSize,
-		pendingRequests: make(map[string]*PendingRequest),
-		urlBlockLists:   make([]URLBlockList, 0),
-		client:     &dns.Client{Timeout: 5 * time.Second},
-		httpClient: httpClient,
+	httpClient := createHTTPClientWithDNSFallback(fallback, config.DNSCheckDomain)
+
+	maxDownloads := config.MaxConcurrentDownloads
+	if maxDownloads <= 0 {
+		maxDownloads = defaultMaxConcurrentDownloads
+	}
+
+	server := &DNSServer{
+		config:           config,
+		overwrites:       overwrites,
+		configOverwrites: overwrites,
+		noCache:          parseDomainSet(config.NoCache),
+		nameservers:      nameservers,
+		breakers:         newCircuitBreakers(config, nameservers),
+		stats:            serverStats{upstreams: make([]upstreamStats, len(nameservers))},
+		fileZones:        make(map[string]*fileZone),
+		neighbors:        &neighborTable{},
+		cacheShards:      newCacheShards(config),
+		pendingRequests:  make(map[string]*PendingRequest),
+		done:             make(chan struct{}),
+		urlBlockLists:    make([]URLBlockList, 0),
+		downloadSlots:    make(chan struct{}, maxDownloads),
+		httpClient:       httpClient,
 		msgPool: &sync.Pool{
 			New: func() interface{} {
 				return new(dns.Msg)
 			},
 		},
 	}
+
+	// Global upstream QPS cap (burst of one second's worth of queries)
+	if config.MaxUpstreamQPS > 0 {
+		server.upstreamLimiter = newTokenBucket(float64(config.MaxUpstreamQPS), config.MaxUpstreamQPS)
+	}
+
+	// Per-client query rate limit
+	server.clientLimiter = newClientLimiter(config)
+
+	return server
 }
 
 // startBackgroundServices starts all background goroutines for the DNS server.
@@ -73,6 +414,35 @@ func (s *DNSServer) startBackgroundServices() {
 	// Start pending request cleanup goroutine
 	s.startPendingRequestCleanup()
 
+	// Report blocks per category
+	s.startBlockCategoryReporter()
+
+	// Write cache fills to the shared cache (if configured)
+	s.startSharedCacheWriters()
+
+	// Start periodic cache persistence (if configured)
+	s.startCachePersistence()
+
+	// Start upstream QPS cap reporter (if configured)
+	s.startUpstreamLimitReporter()
+	s.startClientLimiterCleanup()
+
+	// Reload overwrite_db and block_db on change (if configured)
+	s.startDBWatcher()
+
+	// Serve Prometheus metrics (if configured)
+	s.startMetricsServer()
+
+	// Stream block/overwrite decisions to the collector (if configured)
+	if s.auditSink != nil {
+		s.auditSink.start(s.done)
+	}
+
+	// Write queries to query_log_file (if configured)
+	if s.queryLog != nil {
+		s.queryLog.start(s.done)
+	}
+
 	// Start block list reloader if there are URL-based lists
 	reloadInterval := s.config.ReloadInterval
 	if len(s.urlBlockLists) > 0 && reloadInterval > 0 {
@@ -80,10 +450,22 @@ func (s *DNSServer) startBackgroundServices() {
 		log.Printf("URL-based block list reloader started (interval: %d minutes)", reloadInterval)
 	}
 
-	log.Printf("Loaded %d blocked hosts and %d DNS overwrites", len(s.blocked), len(s.overwrites))
-	log.Printf("Configured %d nameservers", len(s.nameservers))
+	log.Printf("Loaded %d blocked hosts and %d DNS overwrites", len(s.blockedDomains()), len(s.overwrites))
+	log.Printf("Configured %d nameservers (%s)", len(s.defaultUpstreams.members), s.config.UpstreamMode)
+	for suffix, group := range s.upstreamRoutes {
+		log.Printf("Upstream route: %s -> %d nameservers", suffix, len(group.members))
+	}
+	if s.config.MaxUpstreamQPS > 0 {
+		log.Printf("Upstream QPS cap enabled (%d queries/s)", s.config.MaxUpstreamQPS)
+	}
+	if s.dnssecValidator != nil {
+		log.Printf("DNSSEC validation enabled (%d trust anchors)", len(s.config.DNSSECTrustAnchors))
+	}
+	if s.clientLimiter != nil {
+		log.Printf("Per-client rate limit enabled (%d queries/s, burst %d)", s.config.RateLimitPerSecond, s.config.RateLimitBurst)
+	}
 	if s.config.CacheTTL > 0 {
-		log.Printf("DNS caching enabled (TTL: %ds)", s.config.CacheTTL)
+		log.Printf("DNS caching enabled (TTL: %ds, %d shards)", s.config.CacheTTL, len(s.cacheShards))
 	}
 }
 
@@ -93,8 +475,9 @@ func (s *DNSServer) Start() error {
 	dnsServer := &dns.Server{
 		Addr:    s.config.ListenAddr,
 		Net:     "udp",
-		Handler: dns.HandlerFunc(s.handleDNSRequest),
+		Handler: s.listenerHandler(listenerUDP),
 	}
+	dnsServer.NotifyStartedFunc = func() { s.addListener(dnsServer) }
 
 	s.debugLog("Starting DNS server on %s", s.config.ListenAddr)
 	for i, ns := range s.nameservers {
@@ -110,13 +493,36 @@ func (s *DNSServer) Start() error {
 	return nil
 }
 
-// createHTTPClientWithDNSFallback creates an HTTP client with DNS fallback support.
-func createHTTPClientWithDNSFallback(fallbackDNS string, dnsCheckDomain string) *http.Client {
-	// Set default fallback DNS if not configured
-	if fallbackDNS == "" {
-		fallbackDNS = "8.8.8.8" // Default to Google DNS
+// StartTCP starts the DNS server's TCP listener (for larger responses).
+func (s *DNSServer) StartTCP() error {
+	listener, err := net.Listen("tcp", s.config.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.config.ListenAddr, err)
+	}
+	// Limits apply to the directly connected peers, so they wrap the raw listener
+	if s.config.MaxTCPConnections > 0 || s.config.MaxTCPConnectionsPerIP > 0 {
+		listener = newConnLimitListener(listener, max(s.config.MaxTCPConnections, 0), max(s.config.MaxTCPConnectionsPerIP, 0))
+	}
+	if s.config.ProxyProtocol {
+		listener = newProxyProtoListener(listener, s.proxyTrusted)
+		log.Printf("PROXY protocol enabled on TCP listener (trusted: %v)", s.config.ProxyProtocolTrusted)
+	}
+
+	tcpServer := &dns.Server{
+		Listener: listener,
+		Net:      "tcp",
+		Handler:  s.listenerHandler(listenerTCP),
+	}
+	tcpServer.NotifyStartedFunc = func() { s.addListener(tcpServer) }
+	if err := tcpServer.ActivateAndServe(); err != nil {
+		return fmt.Errorf("failed to start TCP server: %w", err)
 	}
 
+	return nil
+}
+
+// createHTTPClientWithDNSFallback creates an HTTP client with DNS fallback support.
+func createHTTPClientWithDNSFallback(fallback *fallbackResolver, dnsCheckDomain string) *http.Client {
 	// Check if DNS is working
 	dnsWorking := checkDNSWorking(dnsCheckDomain)
 
@@ -128,8 +534,8 @@ func createHTTPClientWithDNSFallback(fallbackDNS string, dnsCheckDomain string)
 
 	// If DNS is not working, use custom dialer with fallback DNS
 	if !dnsWorking {
-		log.Printf("System DNS not working, using fallback DNS server: %s", fallbackDNS)
-		transport.DialContext = createDialContextWithFallback(fallbackDNS)
+		log.Printf("System DNS not working, using fallback DNS servers: %s", strings.Join(fallback.servers, ", "))
+		transport.DialContext = createDialContextWithFallback(fallback)
 	}
 
 	return &http.Client{
@@ -139,7 +545,7 @@ func createHTTPClientWithDNSFallback(fallbackDNS string, dnsCheckDomain string)
 }
 
 // createDialContextWithFallback creates a DialContext function that uses fallback DNS.
-func createDialContextWithFallback(fallbackDNS string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+func createDialContextWithFallback(fallback *fallbackResolver) func(ctx context.Context, network, addr string) (net.Conn, error) {
 	return func(_ context.Context, network, addr string) (net.Conn, error) {
 		host, port, err := net.SplitHostPort(addr)
 		if err != nil {
@@ -147,7 +553,7 @@ func createDialContextWithFallback(fallbackDNS string) func(ctx context.Context,
 		}
 
 		// Try to resolve using fallback DNS
-		addrs, err := resolveHostWithFallback(host, fallbackDNS)
+		addrs, err := fallback.resolve(host)
 		if err != nil {
 			return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
 		}
@@ -172,7 +578,12 @@ func (s *DNSServer) startPendingRequestCleanup() {
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
 
-		for range ticker.C {
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
 			s.cleanupStalePendingRequests()
 		}
 	}()
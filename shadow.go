@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// shadowQuery is a recorded query replayed in shadow mode.
+type shadowQuery struct {
+	clientIP net.IP
+	domain   string
+	qtype    uint16
+}
+
+// readShadowSample reads recorded queries, one per line: "[client-ip] domain [qtype]", or
+// a query_log_file JSON line. The query type defaults to A; blank lines and # comments are skipped.
+func readShadowSample(r io.Reader) ([]shadowQuery, error) {
+	var queries []shadowQuery
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "{") {
+			query, err := parseShadowLogLine(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			queries = append(queries, query)
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		query := shadowQuery{qtype: dns.TypeA}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			query.clientIP = ip
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected \"[client-ip] domain [qtype]\"", lineNum)
+		}
+		query.domain = normalizeDomain(fields[0])
+		if len(fields) == 2 {
+			qtype, ok := dns.StringToType[strings.ToUpper(fields[1])]
+			if !ok {
+				return nil, fmt.Errorf("line %d: unknown query type %q", lineNum, fields[1])
+			}
+			query.qtype = qtype
+		}
+		queries = append(queries, query)
+	}
+	return queries, scanner.Err()
+}
+
+// parseShadowLogLine reads the client, name and type of a query_log_file entry.
+func parseShadowLogLine(line string) (shadowQuery, error) {
+	var entry queryLogEntry
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		return shadowQuery{}, fmt.Errorf("invalid query log entry: %w", err)
+	}
+	if entry.QName == "" {
+		return shadowQuery{}, fmt.Errorf("query log entry without qname")
+	}
+	query := shadowQuery{domain: normalizeDomain(entry.QName), qtype: dns.TypeA}
+	if entry.Client != "" {
+		if query.clientIP = net.ParseIP(entry.Client); query.clientIP == nil {
+			return shadowQuery{}, fmt.Errorf("invalid client %q", entry.Client)
+		}
+	}
+	if entry.QType != "" {
+		qtype, ok := dns.StringToType[strings.ToUpper(entry.QType)]
+		if !ok {
+			return shadowQuery{}, fmt.Errorf("unknown query type %q", entry.QType)
+		}
+		query.qtype = qtype
+	}
+	return query, nil
+}
+
+// prepareShadow turns a server into a shadow copy: queries still run through the request
+// handler, but nothing is forwarded, logged, audited or shared, and checks that depend on
+// live traffic (rate limits, tunnel and loop detection) are off.
+func (s *DNSServer) prepareShadow() {
+	s.shadow = true
+	s.queryLog = nil
+	s.auditSink = nil
+	s.sharedCache = nil
+	s.clientLimiter = nil
+	s.tunnelDetector = nil
+	s.loopDetector = nil
+}
+
+// answerInShadow answers a query that would be forwarded with SERVFAIL when the server is
+// a shadow copy, so replaying a sample never reaches an upstream.
+func (s *DNSServer) answerInShadow(w dns.ResponseWriter, r *dns.Msg) bool {
+	if !s.shadow {
+		return false
+	}
+	s.sendResponse(w, r, s.createServerFailureResponse(r, "shadow mode, not forwarded"))
+	return true
+}
+
+// shadowDecision runs a recorded query through the request handler and describes what
+// happened to it.
+func (s *DNSServer) shadowDecision(q shadowQuery) string {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(q.domain), q.qtype)
+	w := NewResponseRecorder(q.clientIP)
+	trace := &queryTrace{start: time.Now()}
+	s.handleTracedRequest(w, r, s.listenerPolicy(listenerUDP), trace)
+
+	switch {
+	case trace.action == queryActionForwarded && s.isBypassDomain(q.domain):
+		return "bypass (not filtered)"
+	case trace.action == queryActionForwarded:
+		return s.describeRoute(q.domain, q.qtype)
+	case trace.action == queryActionBlocked:
+		if entry, matched := s.matchBlock(q.domain, q.clientIP, nil); entry != nil {
+			return s.describeBlock(q.domain, q.qtype, matched, entry)
+		}
+	case w.Msg == nil:
+		return "dropped"
+	}
+
+	action := trace.action
+	if action == "" {
+		action = queryActionLocal
+	}
+	var answers []string
+	for _, rr := range w.Msg.Answer {
+		answers = append(answers, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	if len(answers) == 0 {
+		return fmt.Sprintf("%s (%s)", action, dns.RcodeToString[w.Msg.Rcode])
+	}
+	return fmt.Sprintf("%s (%s) -> %s", action, dns.RcodeToString[w.Msg.Rcode], strings.Join(answers, ", "))
+}
+
+// runShadow replays a query sample against the current and a candidate configuration
+// and writes every query whose decision would change, followed by a summary.
+func runShadow(current, candidate *DNSServer, samplePath string, out io.Writer) error {
+	file, err := os.Open(filepath.Clean(samplePath))
+	if err != nil {
+		return fmt.Errorf("failed to open sample %s: %w", samplePath, err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	queries, err := readShadowSample(file)
+	if err != nil {
+		return fmt.Errorf("failed to read sample %s: %w", samplePath, err)
+	}
+	current.prepareShadow()
+	candidate.prepareShadow()
+
+	changed, newlyBlocked, unblocked := 0, 0, 0
+	for _, q := range queries {
+		before := current.shadowDecision(q)
+		after := candidate.shadowDecision(q)
+		if before == after {
+			continue
+		}
+		changed++
+		wasBlocked := strings.HasPrefix(before, "blocked")
+		isBlocked := strings.HasPrefix(after, "blocked")
+		switch {
+		case isBlocked && !wasBlocked:
+			newlyBlocked++
+		case wasBlocked && !isBlocked:
+			unblocked++
+		}
+
+		client := "-"
+		if q.clientIP != nil {
+			client = q.clientIP.String()
+		}
+		_, _ = fmt.Fprintf(out, "%s %s from %s\n  - %s\n  + %s\n", q.domain, dns.TypeToString[q.qtype], client, before, after)
+	}
+
+	_, _ = fmt.Fprintf(out, "\n%d queries replayed, %d decisions changed (%d newly blocked, %d unblocked, %d other)\n",
+		len(queries), changed, newlyBlocked, unblocked, changed-newlyBlocked-unblocked)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRunShadow(t *testing.T) {
+	var forwarded atomic.Int64
+	upstream := func(w dns.ResponseWriter, r *dns.Msg) {
+		forwarded.Add(1)
+		replyWith(r.Question[0].Name+" 60 IN A 10.9.9.9")(w, r)
+	}
+	nameservers := startTestUpstream(t, upstream, upstream)
+	current := newTestServer(t, &Config{Nameservers: nameservers})
+	candidate := newTestServer(t, &Config{
+		Nameservers: nameservers,
+		BlockLists:  []interface{}{writeTestFile(t, "hosts.txt", "0.0.0.0 ads.test.lan\n")},
+		AllowQuery:  []string{"192.0.2.0/24"},
+	})
+
+	sample := writeTestFile(t, "sample.txt", strings.Join([]string{
+		"# text and query_log_file lines can be mixed",
+		"192.0.2.10 ads.test.lan",
+		"192.0.2.11 www.test.lan AAAA",
+		`{"time":"2026-01-02T03:04:05Z","client":"198.51.100.7","qname":"www.test.lan.","qtype":"TXT","action":"forwarded","rcode":"NOERROR","latency_ms":1.5}`,
+	}, "\n"))
+	var out strings.Builder
+	if err := runShadow(current, candidate, sample, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"ads.test.lan A from 192.0.2.10\n  - forward (round_robin) to ",
+		"  + blocked (",
+		"www.test.lan TXT from 198.51.100.7\n  - forward (round_robin) to ",
+		"  + denied (REFUSED)",
+		"3 queries replayed, 2 decisions changed (1 newly blocked, 0 unblocked, 1 other)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output misses %q:\n%s", want, out.String())
+		}
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("%d queries reached the upstream, want none", n)
+	}
+}
+
+func TestReadShadowSampleErrors(t *testing.T) {
+	for _, line := range []string{
+		"192.0.2.1 a.example b.example c.example",
+		"a.example BOGUS",
+		`{"qname":"a.example","qtype":"BOGUS"}`,
+		`{"client":"not-an-ip","qname":"a.example"}`,
+		`{"qtype":"A"}`,
+		`{"qname":`,
+	} {
+		if _, err := readShadowSample(strings.NewReader("ok.example\n" + line)); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Errorf("%s: error %v, want one for line 2", line, err)
+		}
+	}
+}
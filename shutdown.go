@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// addListener registers a DNS listener that has started, so Shutdown stops it. A listener
+// that only starts after Shutdown is stopped right away.
+func (s *DNSServer) addListener(srv *dns.Server) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if s.isShuttingDown() {
+		go func() { _ = srv.Shutdown() }()
+		return
+	}
+	s.listeners = append(s.listeners, srv)
+}
+
+// isShuttingDown reports whether Shutdown has been called.
+func (s *DNSServer) isShuttingDown() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the server: the DNS listeners and the metrics listener stop accepting
+// queries and finish the ones in flight until ctx is done, background goroutines exit,
+// the query log is flushed, and the cache is saved when cache_file is set. Start and StartTCP then return nil.
+func (s *DNSServer) Shutdown(ctx context.Context) error {
+	s.listenersMu.Lock()
+	s.shutdownOnce.Do(func() { close(s.done) })
+	listeners := s.listeners
+	s.listeners = nil
+	s.listenersMu.Unlock()
+
+	var errs []error
+	for _, srv := range listeners {
+		if err := srv.ShutdownContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s listener: %w", srv.Net, err))
+		}
+	}
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("metrics listener: %w", err))
+		}
+	}
+
+	// Write out the queries logged so far
+	if s.queryLog != nil {
+		if err := s.queryLog.wait(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("query log: %w", err))
+		}
+	}
+
+	// Keep what was cached for the next start
+	if err := s.saveCacheToFile(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to save cache: %w", err))
+	}
+	if len(errs) == 0 {
+		log.Printf("Shut down cleanly")
+	}
+	return errors.Join(errs...)
+}
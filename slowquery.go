@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryTrace collects what happened while a query was handled, for slow_query_threshold_ms
+// and query_log_file. A nil trace records nothing, so callers don't need to check whether
+// either is on.
+type queryTrace struct {
+	start     time.Time
+	keepSteps bool       // Steps are only formatted for slow query logging
+	mu        sync.Mutex // Coalesced waiters and upstream attempts may record concurrently
+	steps     []string
+	action    string // One of the queryAction constants ("" = answered locally)
+	upstream  string // Nameserver that answered
+}
+
+// queryTraceKey is the context key under which a query's trace travels to the upstream code.
+type queryTraceKey struct{}
+
+// newQueryTrace starts timing a query (nil when slow query logging and the query log are disabled).
+func (s *DNSServer) newQueryTrace() *queryTrace {
+	if s.config.SlowQueryThresholdMs <= 0 && s.queryLog == nil {
+		return nil
+	}
+	return &queryTrace{start: time.Now(), keepSteps: s.config.SlowQueryThresholdMs > 0}
+}
+
+// note records a step of the query's handling, with the time since the query arrived.
+func (t *queryTrace) note(format string, v ...interface{}) {
+	if t == nil || !t.keepSteps {
+		return
+	}
+	step := fmt.Sprintf("%s (+%dms)", fmt.Sprintf(format, v...), time.Since(t.start).Milliseconds())
+	t.mu.Lock()
+	t.steps = append(t.steps, step)
+	t.mu.Unlock()
+}
+
+// withQueryTrace returns a context carrying a query trace.
+func withQueryTrace(ctx context.Context, t *queryTrace) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, queryTraceKey{}, t)
+}
+
+// queryTraceFrom returns the query trace of a context, or nil.
+func queryTraceFrom(ctx context.Context) *queryTrace {
+	t, _ := ctx.Value(queryTraceKey{}).(*queryTrace)
+	return t
+}
+
+// logSlowQuery logs a query whose handling took longer than slow_query_threshold_ms,
+// with the steps that explain where the time went.
+func (s *DNSServer) logSlowQuery(t *queryTrace, r *dns.Msg, clientIP net.IP) {
+	if t == nil || !t.keepSteps || len(r.Question) == 0 {
+		return
+	}
+	elapsed := time.Since(t.start)
+	if elapsed < time.Duration(s.config.SlowQueryThresholdMs)*time.Millisecond {
+		return
+	}
+
+	t.mu.Lock()
+	steps := strings.Join(t.steps, ", ")
+	t.mu.Unlock()
+	if steps == "" {
+		steps = "answered locally"
+	}
+	log.Printf("Slow query: %s %s from %s took %dms: %s", normalizeDomain(r.Question[0].Name),
+		dns.TypeToString[r.Question[0].Qtype], clientIP, elapsed.Milliseconds(), steps)
+}
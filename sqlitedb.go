@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Registers the "sqlite" database/sql driver
+)
+
+// dbWatchInterval is how often overwrite_db and block_db are checked for changes with db_watch.
+const dbWatchInterval = 5 * time.Second
+
+// dbBlockSource is the source recorded on block entries loaded from a block database.
+func dbBlockSource(path string) string {
+	return "sqlite:" + path
+}
+
+// openDB opens a SQLite database read-only. The management UI writing it may hold
+// locks briefly, so reads wait for them instead of failing.
+func openDB(path string) (*sql.DB, error) {
+	return sql.Open("sqlite", "file:"+filepath.Clean(path)+"?mode=ro&_pragma=busy_timeout(5000)")
+}
+
+// splitDBList splits a comma or whitespace separated column value.
+func splitDBList(value sql.NullString) []string {
+	return strings.FieldsFunc(value.String, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// parseDBRestrictions parses the clients (IPs or subnets) and macs columns of a database row.
+func parseDBRestrictions(clients, macs sql.NullString) ([]*net.IPNet, []net.HardwareAddr, error) {
+	subnets, err := parseSubnets(splitDBList(clients))
+	if err != nil {
+		return nil, nil, err
+	}
+	var macList []net.HardwareAddr
+	for _, macStr := range splitDBList(macs) {
+		mac, err := net.ParseMAC(macStr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid MAC %s: %w", macStr, err)
+		}
+		macList = append(macList, mac)
+	}
+	return subnets, macList, nil
+}
+
+// readDBOverwrites reads the overwrites table of an overwrite database.
+func readDBOverwrites(path string) (map[string]*OverwriteEntry, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	rows, err := db.Query("SELECT domain, ip, clients, macs, qtypes FROM overwrites")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query overwrites in %s: %w", path, err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	result := make(map[string]*OverwriteEntry)
+	for rows.Next() {
+		var domain, ip string
+		var clients, macs, qtypes sql.NullString
+		if err := rows.Scan(&domain, &ip, &clients, &macs, &qtypes); err != nil {
+			return nil, fmt.Errorf("failed to read overwrite from %s: %w", path, err)
+		}
+
+		entry := &OverwriteEntry{IP: ip, Answers: splitDBList(sql.NullString{String: ip, Valid: true})}
+		if entry.Subnets, entry.MACs, err = parseDBRestrictions(clients, macs); err != nil {
+			return nil, fmt.Errorf("invalid overwrite %s in %s: %w", domain, path, err)
+		}
+		if entry.Qtypes, err = parseQtypes(splitDBList(qtypes)); err != nil {
+			return nil, fmt.Errorf("invalid overwrite %s in %s: %w", domain, path, err)
+		}
+		if err := finishOverwriteEntry(entry, domain); err != nil {
+			return nil, fmt.Errorf("%w in %s", err, path)
+		}
+		result[normalizeDomain(domain)] = entry
+	}
+	return result, rows.Err()
+}
+
+// readDBBlocks reads the blocks table of a block database.
+func (s *DNSServer) readDBBlocks(path string) (map[string]*BlockEntry, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	rows, err := db.Query("SELECT domain, category, clients, macs FROM blocks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blocks in %s: %w", path, err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	source := dbBlockSource(path)
+	result := make(map[string]*BlockEntry)
+	for rows.Next() {
+		var domain string
+		var category, clients, macs sql.NullString
+		if err := rows.Scan(&domain, &category, &clients, &macs); err != nil {
+			return nil, fmt.Errorf("failed to read block from %s: %w", path, err)
+		}
+
+		entry := &BlockEntry{Category: s.blockCategories.intern(category.String), Source: source}
+		if entry.Subnets, entry.MACs, err = parseDBRestrictions(clients, macs); err != nil {
+			return nil, fmt.Errorf("invalid block %s in %s: %w", domain, path, err)
+		}
+		if normalized := normalizeDomain(domain); normalized != "" {
+			result[normalized] = entry
+		}
+	}
+	return result, rows.Err()
+}
+
+// loadOverwriteDB loads overwrite_db and merges it with the configured overwrites.
+// Configured overwrites win over database rows for the same domain.
+// Returns true if any loaded overwrite matches on MACs.
+func (s *DNSServer) loadOverwriteDB() (bool, error) {
+	entries, err := readDBOverwrites(s.config.OverwriteDB)
+	if err != nil {
+		return false, err
+	}
+
+	hasMACs := false
+	merged := make(map[string]*OverwriteEntry, len(entries)+len(s.configOverwrites))
+	for domain, entry := range entries {
+		merged[domain] = entry
+		hasMACs = hasMACs || len(entry.MACs) > 0
+	}
+	for domain, entry := range s.configOverwrites {
+		merged[domain] = entry
+	}
+
+	s.mu.Lock()
+	s.overwrites = merged
+	s.mu.Unlock()
+
+	log.Printf("Loaded %d overwrites from %s", len(entries), s.config.OverwriteDB)
+	return hasMACs, nil
+}
+
+// loadBlockDB replaces the entries previously loaded from block_db with its current rows.
+// Entries loaded from block_lists win over database rows for the same domain.
+// Returns true if any loaded block matches on MACs.
+func (s *DNSServer) loadBlockDB() (bool, error) {
+	entries, err := s.readDBBlocks(s.config.BlockDB)
+	if err != nil {
+		return false, err
+	}
+
+	source := dbBlockSource(s.config.BlockDB)
+	hasMACs := false
+
+	s.updateBlocked(len(entries), func(blocked map[string]*BlockEntry) {
+		for domain, entry := range blocked {
+			if entry.Source == source {
+				delete(blocked, domain)
+			}
+		}
+		for domain, entry := range entries {
+			if _, exists := blocked[domain]; !exists {
+				blocked[domain] = entry
+			}
+			hasMACs = hasMACs || len(entry.MACs) > 0
+		}
+	})
+
+	log.Printf("Loaded %d domains from %s", len(entries), s.config.BlockDB)
+	return hasMACs, nil
+}
+
+// loadDatabases loads overwrite_db and block_db (if configured) at startup.
+func (s *DNSServer) loadDatabases() error {
+	if s.config.OverwriteDB != "" {
+		hasMACs, err := s.loadOverwriteDB()
+		if err != nil {
+			return fmt.Errorf("failed to load overwrite_db: %w", err)
+		}
+		s.macRulesEnabled = s.macRulesEnabled || hasMACs
+	}
+	if s.config.BlockDB != "" {
+		hasMACs, err := s.loadBlockDB()
+		if err != nil {
+			return fmt.Errorf("failed to load block_db: %w", err)
+		}
+		s.macRulesEnabled = s.macRulesEnabled || hasMACs
+	}
+	return nil
+}
+
+// dbModTime returns the latest modification time of a SQLite database and its write-ahead log.
+func dbModTime(path string) time.Time {
+	var latest time.Time
+	for _, name := range []string{path, path + "-wal"} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// startDBWatcher reloads overwrite_db and block_db whenever they change (with db_watch).
+func (s *DNSServer) startDBWatcher() {
+	if !s.config.DBWatch || (s.config.OverwriteDB == "" && s.config.BlockDB == "") {
+		return
+	}
+
+	watch := func(path string, load func() (bool, error)) {
+		if path == "" {
+			return
+		}
+		go func() {
+			ticker := time.NewTicker(dbWatchInterval)
+			defer ticker.Stop()
+
+			last := dbModTime(path)
+			for {
+				select {
+				case <-s.done:
+					return
+				case <-ticker.C:
+				}
+				modTime := dbModTime(path)
+				if modTime.Equal(last) {
+					continue
+				}
+				last = modTime
+				hasMACs, err := load()
+				if err != nil {
+					log.Printf("Warning: failed to reload %s: %v", path, err)
+					continue
+				}
+				if hasMACs && !s.macRulesEnabled {
+					log.Printf("Warning: MAC-based rules in %s take effect after a restart", path)
+				}
+			}
+		}()
+	}
+	watch(s.config.OverwriteDB, s.loadOverwriteDB)
+	watch(s.config.BlockDB, s.loadBlockDB)
+	log.Printf("Watching databases for changes (interval: %s)", dbWatchInterval)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultStaleMaxAge is how long after expiry an entry may be served with serve_stale by default.
+const defaultStaleMaxAge = 3600
+
+// staleMaxAge returns how long after expiry entries are kept and served with serve_stale (0 when disabled).
+func (s *DNSServer) staleMaxAge() time.Duration {
+	if !s.config.ServeStale {
+		return 0
+	}
+	return time.Duration(s.config.StaleMaxAge) * time.Second
+}
+
+// answerStale answers a cache miss from an entry that expired less than stale_max_age ago,
+// and refreshes the entry in the background (RFC 8767). With stale_race_timeout_ms, the
+// refresh is given that long to answer first. Returns false when serve_stale is disabled or
+// no such entry is cached.
+func (s *DNSServer) answerStale(w dns.ResponseWriter, r *dns.Msg, domain, view string, trace *queryTrace) bool {
+	maxAge := s.staleMaxAge()
+	if maxAge <= 0 {
+		return false
+	}
+	stale := s.getStaleCachedResponse(r, view, "refreshing", maxAge)
+	if stale == nil {
+		return false
+	}
+	refreshed := s.refreshStale(r.Copy(), domain, view)
+
+	// A refresh that finishes in time has cached the fresh answer
+	if timeout := time.Duration(s.config.StaleRaceTimeoutMs) * time.Millisecond; timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-refreshed:
+			if fresh := s.getCachedResponse(r, nil, view); fresh != nil {
+				trace.note("refreshed within stale_race_timeout_ms")
+				trace.setAction(queryActionForwarded)
+				s.sendResponse(w, r, fresh)
+				return true
+			}
+		case <-timer.C:
+		}
+	}
+
+	trace.note("stale answer, refreshing")
+	trace.setAction(queryActionCached)
+	s.debugLog("Stale answer for %s, refreshing in the background", domain)
+	s.sendResponse(w, r, stale)
+	return true
+}
+
+// refreshStale forwards a query whose stale answer is served and caches the new answer.
+// The refresh registers as the pending request for its key, so concurrent stale hits and
+// cache misses don't start another upstream query. A failed refresh or SERVFAIL leaves the
+// stale entry in place, to be served until stale_max_age, and answers the waiting queries with it.
+// The returned channel is signalled when the refresh, or the query for the same key already
+// in flight, has finished.
+func (s *DNSServer) refreshStale(r *dns.Msg, domain, view string) <-chan *dns.Msg {
+	done := make(chan *dns.Msg, 1)
+	key := s.getCoalescingKey(r, view)
+	if key == "" {
+		close(done)
+		return done
+	}
+	s.pendingMu.Lock()
+	if pending, exists := s.pendingRequests[key]; exists {
+		s.pendingMu.Unlock()
+		pending.mu.Lock()
+		pending.waiters = append(pending.waiters, done)
+		pending.mu.Unlock()
+		return done
+	}
+	pending := &PendingRequest{waiters: []chan *dns.Msg{done}}
+	s.pendingRequests[key] = pending
+	s.pendingMu.Unlock()
+
+	go func() {
+		resp, err := s.forwardDirectInternal(r, domain, nil)
+		if err != nil || resp.Rcode == dns.RcodeServerFailure {
+			s.debugLog("Refreshing stale %s failed, keeping the stale answer", domain)
+			resp = s.getStaleCachedResponse(r, view, "refresh failed", s.staleMaxAge())
+		} else {
+			s.setCachedResponse(r, resp, view)
+		}
+
+		pending.mu.Lock()
+		waiters := pending.waiters
+		pending.waiters = nil
+		pending.mu.Unlock()
+		s.notifyWaiters(waiters, resp, r)
+
+		s.pendingMu.Lock()
+		delete(s.pendingRequests, key)
+		s.pendingMu.Unlock()
+	}()
+	return done
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFailedStaleRefreshAnswersWaiters(t *testing.T) {
+	release := make(chan struct{})
+	var answered atomic.Bool
+	upstream := func(w dns.ResponseWriter, r *dns.Msg) {
+		if answered.CompareAndSwap(false, true) {
+			replyWith("www.example. 60 IN A 10.9.9.9")(w, r)
+			return
+		}
+		<-release
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeServerFailure)
+		_ = w.WriteMsg(msg)
+	}
+	s := newTestServer(t, &Config{CacheTTL: 60, ServeStale: true, Nameservers: startTestUpstream(t, upstream, upstream)})
+	testQuery(t, s, "www.example", dns.TypeA)
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	view := s.clientViewName(testClient)
+	entry, ok := s.lookupCacheEntry(getCacheKey(query, view))
+	if !ok {
+		t.Fatal("answer not cached")
+	}
+	entry.ExpiresAt = time.Now().Add(-time.Minute)
+
+	// The stale answer is served and its refresh hangs upstream
+	if resp := testQuery(t, s, "www.example", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Fatalf("answer = %v, want the stale record", resp)
+	}
+	s.pendingMu.Lock()
+	pending := s.pendingRequests[s.getCoalescingKey(query, view)]
+	s.pendingMu.Unlock()
+	if pending == nil {
+		t.Fatal("refresh not pending")
+	}
+	waiter := make(chan *dns.Msg, 1)
+	pending.mu.Lock()
+	pending.waiters = append(pending.waiters, waiter)
+	pending.mu.Unlock()
+	close(release)
+
+	select {
+	case resp, ok := <-waiter:
+		if !ok || len(resp.Answer) != 1 {
+			t.Errorf("waiter got %v, want the stale answer", resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not notified")
+	}
+}
+
+// slowRefreshServer serves www.example from an upstream that answers 10.9.9.9 at once, then
+// 10.9.9.10 after delay, with the first answer already expired in the cache.
+func slowRefreshServer(t *testing.T, delay time.Duration, raceTimeoutMs int) *DNSServer {
+	t.Helper()
+	var answered atomic.Bool
+	upstream := func(w dns.ResponseWriter, r *dns.Msg) {
+		if answered.CompareAndSwap(false, true) {
+			replyWith("www.example. 60 IN A 10.9.9.9")(w, r)
+			return
+		}
+		time.Sleep(delay)
+		replyWith("www.example. 60 IN A 10.9.9.10")(w, r)
+	}
+	s := newTestServer(t, &Config{
+		CacheTTL:           60,
+		ServeStale:         true,
+		StaleRaceTimeoutMs: raceTimeoutMs,
+		ExtendedErrors:     true,
+		Nameservers:        startTestUpstream(t, upstream, upstream),
+	})
+	testQuery(t, s, "www.example", dns.TypeA)
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	entry, ok := s.lookupCacheEntry(getCacheKey(query, s.clientViewName(testClient)))
+	if !ok {
+		t.Fatal("answer not cached")
+	}
+	entry.ExpiresAt = time.Now().Add(-time.Minute)
+	return s
+}
+
+func TestStaleRaceRefreshInTime(t *testing.T) {
+	s := slowRefreshServer(t, 20*time.Millisecond, 2000)
+	resp := testQuery(t, s, "www.example", dns.TypeA)
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "10.9.9.10" || resp.Answer[0].Header().Ttl == staleAnswerTTL {
+		t.Errorf("answer = %v, want the refreshed record", resp)
+	}
+}
+
+func TestStaleRaceTimeout(t *testing.T) {
+	s := slowRefreshServer(t, 300*time.Millisecond, 20)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	start := time.Now()
+	resp, err := s.Query(testClient, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("stale answer took %v, want about stale_race_timeout_ms", elapsed)
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "10.9.9.9" || resp.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Fatalf("answer = %v, want the stale record", resp)
+	}
+	hasStaleEDE := false
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == dns.ExtendedErrorCodeStaleAnswer {
+				hasStaleEDE = true
+			}
+		}
+	}
+	if !hasStaleEDE {
+		t.Errorf("answer = %v, want EDE 3 (Stale Answer)", resp)
+	}
+
+	// The late refresh still answers queries waiting on it and updates the cache
+	s.pendingMu.Lock()
+	pending := s.pendingRequests[s.getCoalescingKey(msg, s.clientViewName(testClient))]
+	s.pendingMu.Unlock()
+	if pending == nil {
+		t.Fatal("refresh not pending")
+	}
+	waiter := make(chan *dns.Msg, 1)
+	pending.mu.Lock()
+	pending.waiters = append(pending.waiters, waiter)
+	pending.mu.Unlock()
+	select {
+	case late := <-waiter:
+		if ips := answerIPs(late); len(ips) != 1 || ips[0] != "10.9.9.10" {
+			t.Errorf("waiter got %v, want the refreshed record", late)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter not notified")
+	}
+	if ips := answerIPs(testQuery(t, s, "www.example", dns.TypeA)); len(ips) != 1 || ips[0] != "10.9.9.10" {
+		t.Errorf("cached answer %v after the refresh, want 10.9.9.10", ips)
+	}
+}
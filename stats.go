@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serverStats holds cumulative query counters. All fields are updated atomically.
+type serverStats struct {
+	queries            uint64
+	cacheHits          uint64
+	cacheMisses        uint64
+	blocked            uint64
+	overwritten        uint64
+	invalidResponses   uint64          // Upstream responses that did not match their query
+	malformedResponses uint64          // Upstream responses that could not be parsed or re-packed
+	upstreams          []upstreamStats // Parallel to DNSServer.nameservers
+}
+
+// upstreamStats counts query outcomes for one nameserver.
+type upstreamStats struct {
+	succeeded uint64
+	failed    uint64
+	malformed uint64 // Included in failed
+	latency   latencyHistogram
+}
+
+// recordUpstream counts the outcome of a query sent to the nameserver at idx and how long it took.
+func (st *serverStats) recordUpstream(idx int, success bool, elapsed time.Duration) {
+	if idx >= len(st.upstreams) {
+		return
+	}
+	st.upstreams[idx].latency.observe(elapsed)
+	if success {
+		atomic.AddUint64(&st.upstreams[idx].succeeded, 1)
+	} else {
+		atomic.AddUint64(&st.upstreams[idx].failed, 1)
+	}
+}
+
+// logStats writes a one-off summary of cache, block and upstream statistics to the log.
+func (s *DNSServer) logStats() {
+	for _, line := range s.statsSummary() {
+		log.Printf("Stats: %s", line)
+	}
+}
+
+// statsSummary returns a summary of cache, block and upstream statistics, one line per topic.
+// It only reads counters and takes the cache read lock briefly, so live traffic is not disturbed.
+func (s *DNSServer) statsSummary() []string {
+	queries := atomic.LoadUint64(&s.stats.queries)
+	hits := atomic.LoadUint64(&s.stats.cacheHits)
+	hitRatio := 0.0
+	if queries > 0 {
+		hitRatio = float64(hits) / float64(queries) * 100
+	}
+
+	cacheSize, dnssecEntries, cacheBytes := s.cacheCounts()
+
+	blockedDomains := len(s.blockedDomains())
+	s.mu.RLock()
+	overwriteRules := len(s.overwrites)
+	s.mu.RUnlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	lines := []string{
+		fmt.Sprintf("%d queries, cache %d entries (%d plain, %d DNSSEC, %d KB), %d hits (%.1f%%)",
+			queries, cacheSize, cacheSize-dnssecEntries, dnssecEntries, cacheBytes/1024, hits, hitRatio),
+		fmt.Sprintf("%d blocked (%d domains listed), %d overwritten (%d rules)",
+			atomic.LoadUint64(&s.stats.blocked), blockedDomains, atomic.LoadUint64(&s.stats.overwritten), overwriteRules),
+	}
+
+	if categories := s.blockCategories.summary(); categories != "" {
+		lines = append(lines, "blocks by category: "+categories)
+	}
+
+	upstreams := make([]string, 0, len(s.nameservers))
+	usable := 0
+	for i, ns := range s.nameservers {
+		if !ns.self && s.breaker(i).available() {
+			usable++
+		}
+		entry := fmt.Sprintf("%s %d ok/%d failed", ns.Address,
+			atomic.LoadUint64(&s.stats.upstreams[i].succeeded), atomic.LoadUint64(&s.stats.upstreams[i].failed))
+		if malformed := atomic.LoadUint64(&s.stats.upstreams[i].malformed); malformed > 0 {
+			entry += fmt.Sprintf(" (%d malformed)", malformed)
+		}
+		if breaker := s.breaker(i); breaker != nil && !breaker.allowsWithoutProbe() {
+			entry += " (circuit open)"
+		}
+		upstreams = append(upstreams, entry)
+	}
+	lines = append(lines,
+		fmt.Sprintf("upstreams (%d of %d usable): %s; %d invalid responses, %d malformed", usable, len(s.nameservers), strings.Join(upstreams, ", "),
+			atomic.LoadUint64(&s.stats.invalidResponses), atomic.LoadUint64(&s.stats.malformedResponses)))
+	if tlsErrors := s.tlsErrors.snapshot(); len(tlsErrors) > 0 {
+		entries := make([]string, 0, len(tlsErrors))
+		for _, e := range tlsErrors {
+			entries = append(entries, fmt.Sprintf("%s %s %d", e.address, e.category, e.count))
+		}
+		lines = append(lines, "TLS upstream errors: "+strings.Join(entries, ", "))
+	}
+	if s.tunnelDetector != nil {
+		flagged, refused := s.tunnelDetector.counts()
+		lines = append(lines, fmt.Sprintf("tunnel detection: %d domains flagged, %d queries stopped", flagged, refused))
+	}
+	if s.auditSink != nil {
+		lines = append(lines, fmt.Sprintf("audit sink: %d events dropped", s.auditSink.droppedEvents()))
+	}
+	if s.sharedCache != nil {
+		lines = append(lines, fmt.Sprintf("shared cache: %d writes dropped", s.sharedCacheDropped.Load()))
+	}
+	if s.clientLimiter != nil {
+		lines = append(lines, fmt.Sprintf("client rate limit: %d queries refused", s.clientLimiter.refused.Load()))
+	}
+	if v := s.dnssecValidator; v != nil {
+		lines = append(lines, fmt.Sprintf("dnssec: %d secure, %d insecure, %d bogus answers", v.secure.Load(), v.insecure.Load(), v.bogus.Load()))
+	}
+	if s.queryLog != nil {
+		lines = append(lines, fmt.Sprintf("query log: %d queries dropped", s.queryLog.droppedEntries()))
+	}
+	return append(lines,
+		fmt.Sprintf("%d goroutines, %d MiB heap in use, %d MiB from OS", runtime.NumGoroutine(), mem.HeapInuse>>20, mem.Sys>>20))
+}
+
+// startStatsDumper logs a stats summary whenever SIGUSR1 is received.
+func (s *DNSServer) startStatsDumper() {
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sigusr1)
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-sigusr1:
+			}
+			s.logStats()
+		}
+	}()
+}
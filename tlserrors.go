@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TLS upstream failure categories.
+const (
+	tlsErrorCertificate       = "certificate verification failed"
+	tlsErrorTimeout           = "handshake timeout"
+	tlsErrorConnectionRefused = "connection refused"
+	tlsErrorProtocolMismatch  = "protocol mismatch"
+	tlsErrorOther             = "other"
+)
+
+// tlsErrorLogInterval limits how often certificate failures are logged per nameserver.
+const tlsErrorLogInterval = 30 * time.Second
+
+// upstreamTLSErrors counts failures of encrypted upstreams by nameserver and category.
+type upstreamTLSErrors struct {
+	counts     sync.Map // "address|category" -> *uint64
+	lastLogged sync.Map // address -> time.Time
+}
+
+// record increments the counter for an upstream and failure category.
+func (e *upstreamTLSErrors) record(address, category string) {
+	key := address + "|" + category
+	counter, ok := e.counts.Load(key)
+	if !ok {
+		counter, _ = e.counts.LoadOrStore(key, new(uint64))
+	}
+	atomic.AddUint64(counter.(*uint64), 1)
+}
+
+// tlsErrorCount is the failure count of one upstream and category.
+type tlsErrorCount struct {
+	address  string
+	category string
+	count    uint64
+}
+
+// snapshot returns the failure counts, sorted by upstream and category.
+func (e *upstreamTLSErrors) snapshot() []tlsErrorCount {
+	var counts []tlsErrorCount
+	e.counts.Range(func(key, counter interface{}) bool {
+		address, category, _ := strings.Cut(key.(string), "|")
+		counts = append(counts, tlsErrorCount{address: address, category: category, count: atomic.LoadUint64(counter.(*uint64))})
+		return true
+	})
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].address != counts[j].address {
+			return counts[i].address < counts[j].address
+		}
+		return counts[i].category < counts[j].category
+	})
+	return counts
+}
+
+// shouldLog reports whether a loud log for this upstream is due.
+func (e *upstreamTLSErrors) shouldLog(address string) bool {
+	now := time.Now()
+	if last, ok := e.lastLogged.Load(address); ok && now.Sub(last.(time.Time)) < tlsErrorLogInterval {
+		return false
+	}
+	e.lastLogged.Store(address, now)
+	return true
+}
+
+// classifyTLSError categorizes an error from an encrypted (DoT/DoH) upstream.
+func classifyTLSError(err error) string {
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return tlsErrorCertificate
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return tlsErrorConnectionRefused
+	case errors.As(err, &recordErr):
+		return tlsErrorProtocolMismatch
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return tlsErrorTimeout
+	default:
+		return tlsErrorOther
+	}
+}
+
+// isEncryptedProtocol checks if a protocol runs over TLS.
+func isEncryptedProtocol(protocol string) bool {
+	return protocol == protocolDOT || protocol == protocolDOH || protocol == protocolDOHJSON
+}
+
+// logUpstreamError logs a forwarding error, classifying and counting failures of encrypted upstreams.
+// Certificate failures are always logged (rate-limited) since they usually mean a misconfiguration.
+func (s *DNSServer) logUpstreamError(address string, nameserver NameserverConfig, err error) {
+	if !isEncryptedProtocol(nameserver.Protocol) {
+		s.debugLog("Error forwarding to %s (%s): %v", address, nameserver.Protocol, err)
+		return
+	}
+
+	category := classifyTLSError(err)
+	s.tlsErrors.record(address, category)
+	if category == tlsErrorCertificate && s.tlsErrors.shouldLog(address) {
+		errorLog("TLS error from upstream %s (%s): %s: %v", address, nameserver.Protocol, category, err)
+		return
+	}
+	s.debugLog("TLS error from upstream %s (%s): %s: %v", address, nameserver.Protocol, category, err)
+}
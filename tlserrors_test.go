@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTLSErrorCountsReported(t *testing.T) {
+	s := newTestServer(t, &Config{})
+	s.tlsErrors.record("192.0.2.1:853", tlsErrorCertificate)
+	s.tlsErrors.record("192.0.2.1:853", tlsErrorCertificate)
+	s.tlsErrors.record("192.0.2.2:853", tlsErrorTimeout)
+
+	summary := strings.Join(s.statsSummary(), "\n")
+	if !strings.Contains(summary, "192.0.2.1:853 certificate verification failed 2, 192.0.2.2:853 handshake timeout 1") {
+		t.Errorf("stats summary does not list the TLS errors:\n%s", summary)
+	}
+
+	rec := httptest.NewRecorder()
+	s.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := `godns_upstream_tls_errors_total{upstream="192.0.2.1:853",category="certificate verification failed"} 2`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics do not contain %s", want)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math/rand/v2"
+
+	"github.com/miekg/dns"
+)
+
+// ttlJitterWriter lowers the record TTLs of each response by a random 0 to percent percent,
+// for answer_ttl_jitter. Clients that fetched an answer at the same time then re-query at
+// different times instead of all at once when it expires.
+type ttlJitterWriter struct {
+	dns.ResponseWriter
+	percent int
+}
+
+// WriteMsg writes a copy of the response with jittered TTLs. One factor is used for the whole
+// message, so records of an RRset (and their RRSIGs) keep equal TTLs.
+func (w *ttlJitterWriter) WriteMsg(msg *dns.Msg) error {
+	if len(recordHeaders(msg)) == 0 {
+		return w.ResponseWriter.WriteMsg(msg)
+	}
+	msg = msg.Copy()
+	jitterTTLs(msg, rand.Float64()*float64(w.percent)/100)
+	return w.ResponseWriter.WriteMsg(msg)
+}
+
+// jitterTTLs lowers every record TTL in a message by the given fraction. TTLs never drop
+// below 1, and TTL 0 records stay uncacheable.
+func jitterTTLs(msg *dns.Msg, fraction float64) {
+	for _, hdr := range recordHeaders(msg) {
+		if hdr.Ttl > 1 {
+			hdr.Ttl = max(hdr.Ttl-uint32(float64(hdr.Ttl)*fraction), 1) // nolint:gosec // at most hdr.Ttl/2
+		}
+	}
+}
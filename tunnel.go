@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS tunnel detection tuning
+const (
+	tunnelWindow           = time.Minute      // Interval over which suspicious queries are counted per domain
+	tunnelBlockDuration    = 10 * time.Minute // How long a suspected tunnel stays blocked with tunnel_action "block"
+	tunnelMinLabelLength   = 24               // Labels at least this long are checked for randomness
+	tunnelMinLabelEntropy  = 3.5              // Shannon entropy in bits per character of an encoded-data label
+	tunnelMaxTrackedDomain = 10000            // Domains tracked per window; more are ignored until the next window
+	defaultTunnelThreshold = 100              // Default suspicious queries per domain per window
+)
+
+// Actions for suspected DNS tunnels
+const (
+	tunnelActionLog       = "log"       // Only log suspected tunnels
+	tunnelActionBlock     = "block"     // Block every query to a suspected tunnel for tunnelBlockDuration
+	tunnelActionRateLimit = "ratelimit" // Refuse suspicious queries over the threshold
+)
+
+// tunnelStats counts the suspicious queries for one domain in the current window.
+type tunnelStats struct {
+	suspicious int
+	txtNull    int // TXT and NULL queries
+	longLabels int // Queries with a long, random-looking label
+	clients    map[string]struct{}
+}
+
+// tunnelDetector spots DNS tunnels: many queries under one domain carrying encoded data in
+// long random labels, or asking for TXT/NULL records that can carry data back.
+type tunnelDetector struct {
+	threshold int
+	action    string
+
+	mu      sync.Mutex
+	start   time.Time
+	domains map[string]*tunnelStats
+	blocked map[string]time.Time // Suspected tunnels blocked until the given time
+	flagged uint64               // Domains flagged since startup
+	refused uint64               // Queries blocked or refused
+}
+
+// newTunnelDetector creates the detector for tunnel_detection (nil when disabled).
+func newTunnelDetector(config *Config) (*tunnelDetector, error) {
+	if !config.TunnelDetection {
+		return nil, nil
+	}
+	switch config.TunnelAction {
+	case tunnelActionLog, tunnelActionBlock, tunnelActionRateLimit:
+	default:
+		return nil, fmt.Errorf("invalid tunnel_action %q (valid: %s, %s, %s)",
+			config.TunnelAction, tunnelActionLog, tunnelActionBlock, tunnelActionRateLimit)
+	}
+	return &tunnelDetector{
+		threshold: config.TunnelThreshold,
+		action:    config.TunnelAction,
+		domains:   make(map[string]*tunnelStats),
+		blocked:   make(map[string]time.Time),
+	}, nil
+}
+
+// tunnelDomain returns the domain a query would tunnel through: the last two labels, or three
+// under a country code second-level domain like co.uk.
+func tunnelDomain(domain string) string {
+	labels := dns.SplitDomainName(domain)
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		n = 3
+	}
+	if len(labels) <= n {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// labelEntropy returns the Shannon entropy of a label in bits per character.
+func labelEntropy(label string) float64 {
+	var counts [256]int
+	for i := 0; i < len(label); i++ {
+		counts[label[i]]++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(label))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// hasRandomLabel reports whether a domain below its tunnel domain has a long label that
+// looks like encoded data.
+func hasRandomLabel(domain, parent string) bool {
+	prefix := strings.TrimSuffix(strings.TrimSuffix(domain, parent), ".")
+	for label := range strings.SplitSeq(prefix, ".") {
+		if len(label) >= tunnelMinLabelLength && labelEntropy(label) >= tunnelMinLabelEntropy {
+			return true
+		}
+	}
+	return false
+}
+
+// check counts a query and reports whether it must not be answered: its domain is a blocked
+// tunnel, or with tunnel_action "ratelimit" it is a suspicious query over the threshold.
+// A domain is logged the first time it crosses the threshold in a window.
+func (d *tunnelDetector) check(domain string, qtype uint16, clientIP net.IP) bool {
+	parent := tunnelDomain(domain)
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if until, ok := d.blocked[parent]; ok {
+		if now.Before(until) {
+			d.refused++
+			return true
+		}
+		delete(d.blocked, parent)
+	}
+
+	txtNull := qtype == dns.TypeTXT || qtype == dns.TypeNULL
+	longLabel := hasRandomLabel(domain, parent)
+	if !txtNull && !longLabel {
+		return false
+	}
+
+	if now.Sub(d.start) >= tunnelWindow {
+		d.start = now
+		clear(d.domains)
+	}
+	stats := d.domains[parent]
+	if stats == nil {
+		if len(d.domains) >= tunnelMaxTrackedDomain {
+			return false
+		}
+		stats = &tunnelStats{clients: make(map[string]struct{})}
+		d.domains[parent] = stats
+	}
+	stats.suspicious++
+	if txtNull {
+		stats.txtNull++
+	}
+	if longLabel {
+		stats.longLabels++
+	}
+	if len(stats.clients) < 10 {
+		stats.clients[clientIP.String()] = struct{}{}
+	}
+	if stats.suspicious <= d.threshold {
+		return false
+	}
+
+	if stats.suspicious == d.threshold+1 {
+		d.flagged++
+		clients := make([]string, 0, len(stats.clients))
+		for client := range stats.clients {
+			clients = append(clients, client)
+		}
+		log.Printf("Warning: possible DNS tunnel via %s: %d suspicious queries within %s (%d TXT/NULL, %d with long random labels) from %s, action: %s",
+			parent, stats.suspicious, tunnelWindow, stats.txtNull, stats.longLabels, strings.Join(clients, ", "), d.action)
+	}
+	switch d.action {
+	case tunnelActionBlock:
+		d.blocked[parent] = now.Add(tunnelBlockDuration)
+		d.refused++
+		return true
+	case tunnelActionRateLimit:
+		d.refused++
+		return true
+	}
+	return false
+}
+
+// counts returns the number of domains flagged and queries refused since startup.
+func (d *tunnelDetector) counts() (flagged, refused uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.flagged, d.refused
+}
+
+// tunnelResponse answers a query that tunnel detection stopped: like a blocked domain with
+// tunnel_action "block", REFUSED with "ratelimit".
+func (s *DNSServer) tunnelResponse(r *dns.Msg) *dns.Msg {
+	if s.tunnelDetector.action == tunnelActionBlock {
+		return s.createBlockedResponse(r, "suspected DNS tunnel")
+	}
+	msg := new(dns.Msg)
+	msg.SetRcode(r, dns.RcodeRefused)
+	msg.RecursionAvailable = true
+	s.addExtendedError(msg, r, dns.ExtendedErrorCodeOther, "suspected DNS tunnel, rate limited")
+	return msg
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"container/list"
 	"net"
 	"net/http"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -12,8 +15,16 @@ import (
 // NameserverConfig represents a nameserver with protocol.
 type NameserverConfig struct {
 	Address  string `yaml:"address"`
-	Protocol string `yaml:"protocol"` // udp, tcp, dot, doh
-	Port     int    `yaml:"port"`     // Optional, defaults based on protocol
+	Protocol string `yaml:"protocol"`  // udp, tcp, dot, doh, doh-json, file
+	Port     int    `yaml:"port"`      // Optional, defaults based on protocol
+	ZoneFile string `yaml:"zone_file"` // Zone file to answer from (protocol "file" only)
+	Enabled  bool   `yaml:"enabled"`   // Set to false to skip this nameserver (default: true)
+
+	OnlyQtypes   []string `yaml:"only_qtypes"`   // Only forward these query types to this nameserver
+	ExceptQtypes []string `yaml:"except_qtypes"` // Never forward these query types to this nameserver
+	onlyQtypes   map[uint16]struct{}
+	exceptQtypes map[uint16]struct{}
+	self         bool // Points back at this server; never forwarded to
 }
 
 // OverwriteConfig represents a DNS overwrite with optional IP/subnet conditions.
@@ -23,35 +34,148 @@ type OverwriteConfig struct {
 	IPs     []string `yaml:"ips"`     // Optional: only apply to these specific IPs
 }
 
+// ListenerPolicyConfig overrides handler settings for one listener in listener_policies.
+// Unset fields inherit the top-level setting.
+type ListenerPolicyConfig struct {
+	AnyMode          string `yaml:"any_mode"`
+	RejectNonINClass *bool  `yaml:"reject_non_in_class"`
+	StripDNSSEC      *bool  `yaml:"strip_dnssec"`
+	StrictRD         *bool  `yaml:"strict_rd"`
+}
+
 // Config represents the DNS server configuration.
 type Config struct {
 	ListenAddr        string                 `yaml:"listen_addr"`
+	Mode              string                 `yaml:"mode"`              // Operating mode: "full", "resolver" or "blocker" (default: "full")
+	EnableUDP         bool                   `yaml:"enable_udp"`        // Serve DNS over UDP (default: true)
+	EnableTCP         bool                   `yaml:"enable_tcp"`        // Serve DNS over TCP (default: true)
 	Nameservers       interface{}            `yaml:"nameservers"`        // Can be []string or []NameserverConfig
 	Overwrites        map[string]interface{} `yaml:"overwrites"`        // Can be string or OverwriteConfig
 	BlockLists        interface{}            `yaml:"block_lists"`        // Can be []string or []interface{} with conditional blocks
+	BlockTLDs         []interface{}          `yaml:"block_tlds"`        // TLDs/suffixes blocked with all their domains, e.g. [zip, co.cc] (strings or maps with restrictions)
 	CacheTTL          int                    `yaml:"cache_ttl"`         // Cache TTL in seconds (default: 60)
 	NegativeCacheTTL  int                    `yaml:"negative_cache_ttl"` // Negative cache TTL for NXDOMAIN in seconds (default: 300, set to 0 to disable)
 	MaxCacheSize      int                    `yaml:"max_cache_size"`    // Maximum cache entries (default: 0 = unlimited)
+	MaxCacheBytes     int                    `yaml:"max_cache_bytes"`   // Maximum approximate cache size in bytes (default: 0 = unlimited)
+	MaxDNSSECCacheSize int                   `yaml:"max_dnssec_cache_size"` // Maximum cache entries holding RRSIGs, within max_cache_size (default: 0 = no separate limit)
+	CacheShards       int                    `yaml:"cache_shards"`      // Number of independently locked parts of the cache, limits are divided between them (default: 256)
+	DomainCacheSize   int                    `yaml:"domain_cache_size"` // Maximum interned domain names (default: 100000, -1 = unlimited)
+	CacheBackend      string                 `yaml:"cache_backend"`     // Shared second-level cache: "memory" (none) or "redis" (default: "memory")
+	RedisAddr         string                 `yaml:"redis_addr"`        // Redis address for cache_backend "redis", e.g. "10.0.0.2:6379"
+	RedisPassword     string                 `yaml:"redis_password"`    // Optional Redis AUTH password
+	WarmCache         []string               `yaml:"warm_cache"`        // Domains resolved in the background at startup to pre-populate the cache
+	WarmCacheFile     string                 `yaml:"warm_cache_file"`   // File with one domain per line to warm the cache with
+	CacheFile         string                 `yaml:"cache_file"`        // Path to persist the cache across restarts (default: "" = disabled)
+	CacheWarmup       int                    `yaml:"cache_warmup"`      // Seconds over which restored entries near expiry are spread out (default: 0 = disabled)
+	NoCache           []string               `yaml:"no_cache"`          // Domains (and their subdomains) that are never cached
+	ForceCache        map[string]int         `yaml:"force_cache"`       // Domains (and their subdomains) cached with a forced TTL in seconds
+	MaxConcurrentDownloads int               `yaml:"max_concurrent_downloads"` // Block lists downloaded at once, on startup and reload (default: 4)
 	ReloadInterval    int                    `yaml:"reload_interval"`   // Reload interval for URL-based block lists in minutes (default: 60)
-	FallbackDNS       string                 `yaml:"fallback_dns"`      // Fallback DNS server for downloading block lists (default: "8.8.8.8")
+	FallbackDNS       interface{}            `yaml:"fallback_dns"`      // Fallback DNS server(s) for downloading block lists, a string or list (default: "8.8.8.8")
+	FallbackDNSTimeoutMs int                 `yaml:"fallback_dns_timeout_ms"` // Timeout of each fallback DNS query in ms (default: 5000)
+	FallbackDNSParallelism int               `yaml:"fallback_dns_parallelism"` // Fallback DNS servers queried at the same time (default: 1 = one after another)
+	UpstreamRoutes    map[string]interface{} `yaml:"upstream_routes"`   // Nameservers for domain suffixes (and their subdomains) instead of the default ones, e.g. {corp.internal: ["10.0.0.1"]}
+	UpstreamMode      string                 `yaml:"upstream_mode"`     // Nameserver selection: "round_robin" or "fixed" (default: "round_robin")
+	LoopDetectionThreshold int               `yaml:"loop_detection_threshold"` // Identical uncached queries per second from one client before answering SERVFAIL (default: 0 = disabled)
+	TunnelDetection   bool                   `yaml:"tunnel_detection"`  // Detect DNS tunnels by long random labels and TXT/NULL query volume per domain (default: false)
+	TunnelThreshold   int                    `yaml:"tunnel_threshold"`  // Suspicious queries per domain per minute before it is flagged (default: 100)
+	TunnelAction      string                 `yaml:"tunnel_action"`     // Suspected tunnels: "log", "block" or "ratelimit" (default: "log")
+	MaxUpstreamQPS    int                    `yaml:"max_upstream_qps"`  // Global cap on upstream queries per second (default: 0 = unlimited)
+	RateLimitPerSecond int                   `yaml:"rate_limit_per_second"` // Queries per second each client address may send before being refused (default: 0 = unlimited)
+	RateLimitBurst    int                    `yaml:"rate_limit_burst"`  // Queries a client may send at once before rate_limit_per_second applies (default: rate_limit_per_second)
+	CircuitBreakerThreshold int              `yaml:"circuit_breaker_threshold"` // Consecutive failures/SERVFAILs before a nameserver is skipped (default: 0 = disabled)
+	CircuitBreakerCooldown  int              `yaml:"circuit_breaker_cooldown"`  // Seconds a tripped nameserver is skipped before a probe (default: 30)
+	UpstreamFastFail  bool                   `yaml:"upstream_fast_fail"` // Answer SERVFAIL (or an expired cache entry) at once when every circuit breaker is open
+	AnswerTTLJitter   int                    `yaml:"answer_ttl_jitter"` // Lower answer TTLs by a random 0-N percent per response, up to 50 (default: 0 = disabled)
+	StripDNSSEC       bool                   `yaml:"strip_dnssec"`      // Remove RRSIG/NSEC/NSEC3/DNSKEY/DS from answers to clients without the DO bit
+	ValidateDNSSEC    bool                   `yaml:"validate_dnssec"`   // Ask upstreams for signatures and answer SERVFAIL when they don't validate (default: false)
+	DNSSECTrustAnchors []string              `yaml:"dnssec_trust_anchors"` // DS or DNSKEY records validation starts from (default: the root zone's KSKs)
+	RevalidateResponses bool                 `yaml:"revalidate_responses"` // Re-pack upstream responses and reject those that don't round-trip (default: false)
+	OnValidationFailure string               `yaml:"on_validation_failure"` // Upstream response not matching the query: "next" or "servfail" (default: "next")
+	UpstreamTimeout   int                    `yaml:"upstream_timeout"`  // Upstream query timeout in seconds, the default of the two settings below (default: 5)
+	UpstreamTimeoutInitialMs int              `yaml:"upstream_timeout_initial_ms"` // Timeout of the first of several upstream attempts in ms (default: upstream_timeout)
+	UpstreamTimeoutFinalMs   int              `yaml:"upstream_timeout_final_ms"`   // Timeout of later attempts and of a single upstream in ms (default: upstream_timeout)
+	CoalesceTimeout   int                    `yaml:"coalesce_timeout"`  // Seconds clients wait for an identical in-flight query, also the deadline of all attempts of a query (default: 10)
+	MaxCNAMEChain     int                    `yaml:"max_cname_chain"`   // Reject forwarded answers with more CNAMEs than this (default: 16)
+	MaxAnswers        int                    `yaml:"max_answers"`       // Maximum records in a forwarded answer section (default: 100, -1 = unlimited)
+	RejectNonINClass  bool                   `yaml:"reject_non_in_class"` // Answer REFUSED to query classes other than IN and CHAOS instead of forwarding (default: false)
+	AnyMode           string                 `yaml:"any_mode"`          // ANY queries: "forward", "refuse" or "minimal" (RFC 8482 HINFO) (default: "forward")
+	MaxAnswersAction  string                 `yaml:"max_answers_action"` // Answers over max_answers: "trim" or "reject" (default: "trim")
+	UpstreamEDNSBufSize int                  `yaml:"upstream_edns_bufsize"` // EDNS UDP payload size advertised to upstreams (default: 1232, -1 = disabled)
+	EDNSPadding       bool                   `yaml:"edns_padding"`      // Pad DoT/DoH upstream queries (RFC 7830) to hide their size
+	EDNSPaddingBlockSize int                 `yaml:"edns_padding_block_size"` // Padded queries are a multiple of this many bytes (default: 128)
+	PreferTCPForQtypes []string              `yaml:"prefer_tcp_for_qtypes"` // Query types sent to UDP upstreams over TCP directly, e.g. [DNSKEY, ANY]
+	UpstreamSourcePortRange string           `yaml:"upstream_source_port_range"` // Local port range for upstream UDP queries, e.g. "40000-49999" (default: "" = fully random)
 	GOGC              int                    `yaml:"gogc"`             // GOGC value for GC tuning (default: 100, set to 0 to use Go default)
 	Debug             bool                   `yaml:"debug"`             // Enable debug logging (default: false)
+	AnswerIPBlocklist []string               `yaml:"answer_ip_blocklist"` // Block answers resolving into these ranges, e.g. ["203.0.113.0/24"]
+	BlockMode         interface{}            `yaml:"block_mode"`        // Blocked answer: "nxdomain", "nodata", "refused", "zeroip" or a sinkhole IP, or a map by query type with "*" fallback (default: "nxdomain")
+	ServeStale        bool                   `yaml:"serve_stale"`       // Answer from recently expired cache entries while refreshing them in the background (default: false)
+	StaleMaxAge       int                    `yaml:"stale_max_age"`     // Seconds after expiry an entry may still be served with serve_stale (default: 3600)
+	StaleRaceTimeoutMs int                   `yaml:"stale_race_timeout_ms"` // Wait this long for the refresh of an expired entry before serving it stale (default: 0 = serve stale at once)
+	MaintenanceMode   bool                   `yaml:"maintenance_mode"`  // Answer from cache only (expired entries allowed) and never contact upstreams; reloaded on SIGHUP (default: false)
+	AuditSink         string                 `yaml:"audit_sink"`        // Stream block/overwrite decisions as JSON lines to tcp://host:port or unix:///path (default: disabled)
+	MetricsAddr       string                 `yaml:"metrics_addr"`      // Serve Prometheus metrics at http://<addr>/metrics, e.g. ":9153" (default: "" = disabled)
+	SlowQueryThresholdMs int                 `yaml:"slow_query_threshold_ms"` // Log queries taking longer than this, with where the time went (default: 0 = disabled)
+	QueryLogFile      string                 `yaml:"query_log_file"`    // Append every query as a JSON line to this file (default: disabled)
+	QueryLogSample    float64                `yaml:"query_log_sample"`  // Fraction of queries written to query_log_file, e.g. 0.01; blocked and overwritten ones are always written (default: 0 = all)
+	QueryLogSampleDeterministic bool         `yaml:"query_log_sample_deterministic"` // Sample by a hash of the name, so all queries for a name are logged or none (default: false)
 	LogBlocks         bool                   `yaml:"log_blocks"`        // Log blocked requests (default: false)
+	BypassDomains     []string               `yaml:"bypass_domains"`    // Domains (and their subdomains) never filtered, resolved via bypass_upstream
+	BypassUpstream    interface{}            `yaml:"bypass_upstream"`   // Trusted nameservers for bypass_domains, tried in order (default: regular nameservers)
+	DiagnosticsSuffix string                 `yaml:"diagnostics_suffix"` // Zone for _status and <domain>._check TXT queries, e.g. "sdploy." (default: "" = disabled)
+	OverwriteDB       string                 `yaml:"overwrite_db"`      // SQLite database with an overwrites table, merged with overwrites
+	BlockDB           string                 `yaml:"block_db"`          // SQLite database with a blocks table, merged with block_lists
+	DBWatch           bool                   `yaml:"db_watch"`          // Reload overwrite_db and block_db when they change (default: false)
+	OverwriteTTL      int                    `yaml:"overwrite_ttl"`     // TTL of overwrite answers in seconds, unless an overwrite sets ttl (default: 300)
+	OverwriteAnswerMode string               `yaml:"overwrite_answer_mode"` // Overwrites with several addresses: "all" (in configured order) or "round_robin" (first one rotates) (default: "all")
+	OverwriteOverBlock bool                  `yaml:"overwrite_over_block"` // Overwrites take precedence over block lists for the same domain (default: false)
 	LogOverwrites     bool                   `yaml:"log_overwrites"`    // Log overwritten requests (default: false)
 	DNSCheckDomain    string                 `yaml:"dns_check_domain"`  // Domain to check for DNS availability (default: "dns.google")
+	StrictRD          bool                   `yaml:"strict_rd"`         // Answer RD=0 queries from cache only instead of forwarding (default: false)
+	ExtendedErrors    bool                   `yaml:"extended_errors"`   // Attach Extended DNS Errors (RFC 8914) to policy responses (default: false)
+	Hooks             []string               `yaml:"hooks"`             // Compiled-in query hooks run in order, e.g. [lowercase_qname, add_ecs]
+	NXDomainRedirectIP string                `yaml:"nxdomain_redirect_ip"` // Answer forwarded NXDOMAINs for A/AAAA with this address (default: "" = disabled)
+	NXDomainRedirectClients []string         `yaml:"nxdomain_redirect_clients"` // Client subnets whose NXDOMAINs are redirected (required with nxdomain_redirect_ip)
+	NXDomainRedirectExclude []string         `yaml:"nxdomain_redirect_exclude"` // Domains (and subdomains) never redirected, besides special-use names
+	Views             map[string][]string    `yaml:"views"`             // View name -> client subnets; each view has its own cache (default: one global view)
+	ListenerPolicies  map[string]ListenerPolicyConfig `yaml:"listener_policies"` // Handler settings overridden for the "udp" or "tcp" listener (default: top-level settings)
+	SuppressAAAAFor   []string               `yaml:"suppress_aaaa_for"` // Client subnets whose AAAA queries are answered NODATA (broken IPv6)
+	ForceTCPFor       []string               `yaml:"force_tcp_for"`     // Client subnets whose UDP queries are always answered truncated (TC=1)
+	AllowQuery        []string               `yaml:"allow_query"`       // Client subnets allowed to query the server (default: empty = everyone)
+	AllowQueryAction  string                 `yaml:"allow_query_action"` // Queries from other clients: "refuse" or "drop" (default: "refuse")
+	MaxTCPConnections int                    `yaml:"max_tcp_connections"` // Open TCP connections allowed in total (default: 1000, -1 = unlimited)
+	MaxTCPConnectionsPerIP int               `yaml:"max_tcp_connections_per_ip"` // Open TCP connections allowed per client IP (default: 100, -1 = unlimited)
+	ProxyProtocol     bool                   `yaml:"proxy_protocol"`    // Accept PROXY protocol (v1/v2) headers on the TCP listener (default: false)
+	ProxyProtocolTrusted []string            `yaml:"proxy_protocol_trusted"` // Proxy subnets allowed to send PROXY headers
+	ECSPrivacy        bool                   `yaml:"ecs_privacy"`       // Strip EDNS Client Subnet from upstream queries and answer with scope /0 (default: false)
+	EnableECS         bool                   `yaml:"enable_ecs"`        // Add the client's network as EDNS Client Subnet to queries without one (default: false)
+	ECSPrefixV4       int                    `yaml:"ecs_prefix_v4"`     // Source prefix length sent with enable_ecs for IPv4 clients (default: 24)
+	ECSPrefixV6       int                    `yaml:"ecs_prefix_v6"`     // Source prefix length sent with enable_ecs for IPv6 clients (default: 56)
+	TrustECSFrom      []string               `yaml:"trust_ecs_from"`    // Peers whose EDNS Client Subnet is used for block/overwrite matching
 }
 
 // OverwriteEntry represents a parsed overwrite entry.
 type OverwriteEntry struct {
 	IP      string     // IP address to return (from first element of ips if conditional)
+	Answers []string   // Addresses to return instead of IP, from answers or a list of addresses
+	Addrs   []net.IP   // Returned addresses in configured order, 4 bytes for IPv4 (set by finishOverwriteEntry)
+	TTL     uint32     // TTL of the answer records (0 = overwrite_ttl)
 	Subnets []*net.IPNet
 	IPs     []net.IP   // Client IPs to match (first IP is also used as return IP if no simple IP set)
+	MACs    []net.HardwareAddr // Client MAC addresses to match (LAN clients only)
+	Qtypes  map[uint16]struct{} // Query types answered by the overwrite (default: A and/or AAAA, per returned address)
+	next    atomic.Uint64 // Rotation counter for overwrite_answer_mode "round_robin"
 }
 
 // BlockEntry represents a parsed block entry with optional IP/subnet restrictions.
 type BlockEntry struct {
 	Subnets []*net.IPNet // Optional: only block for these subnets
 	IPs     []net.IP     // Optional: only block for these specific IPs
+	MACs    []net.HardwareAddr // Optional: only block for these client MAC addresses
+	Category string            // Block list category, e.g. "ads" or "malware" (interned)
+	Source   string            // Block list file or URL the entry was loaded from
+	ExactOnly bool             // Block only the domain itself, not its subdomains
 }
 
 // URLBlockList represents a URL-based block list with its restrictions.
@@ -64,6 +188,12 @@ type URLBlockList struct {
 type CacheEntry struct {
 	Message   *dns.Msg
 	ExpiresAt time.Time
+	DNSSEC    bool // Message carries RRSIGs (counted against max_dnssec_cache_size)
+	Size      int  // Approximate size in bytes (counted against max_cache_bytes)
+
+	lastAccessed atomic.Int64  // Unix nanoseconds of the last store or cache hit
+	shard        *cacheShard   // Shard holding the entry
+	lruElem      *list.Element // Position in the shard's LRU list (guarded by its mu)
 }
 
 // PendingRequest represents a pending DNS request waiting for a response.
@@ -75,23 +205,75 @@ type PendingRequest struct {
 // DNSServer represents the DNS server instance.
 //
 // Lock ordering: To prevent deadlock, locks must be acquired in this order:
-//  1. pendingMu (always released before acquiring cacheMu)
-//  2. cacheMu (never held while acquiring pendingMu)
+//  1. pendingMu (always released before acquiring a cache shard's mu)
+//  2. cacheShard.mu (never held while acquiring pendingMu, one shard at a time)
 // The locks are never held simultaneously.
 type DNSServer struct {
 	config        *Config
-	blocked       map[string]*BlockEntry // Changed to support conditional blocking
+	blocked       atomic.Pointer[map[string]*BlockEntry] // Blocked domains, replaced as a whole on every change (see blockedDomains)
+	blockedMu     sync.Mutex             // Serializes changes to blocked
+	blockTLDs     map[string]*BlockEntry // block_tlds rules keyed by suffix, checked after domain entries
+	regexBlocks   []regexBlock           // "regex:" block list patterns, checked last
+	blockModes    blockModes             // Response mode for blocked queries by query type
+	answerIPBlocklist []netip.Prefix     // Answer address ranges that get a query blocked
 	overwrites    map[string]*OverwriteEntry
-	nameservers   []NameserverConfig
-	cache         map[string]*CacheEntry // DNS response cache
-	cacheMu       sync.RWMutex           // Cache mutex - see lock ordering above
-	maxCacheSize  int                    // Maximum cache entries (0 = unlimited)
+	configOverwrites map[string]*OverwriteEntry // Overwrites from the configuration file, merged with overwrite_db
+	noCache       map[string]struct{}    // Domains never cached (guarded by mu)
+	bypassDomains map[string]struct{}    // Domains that skip all filtering
+	diagnosticsSuffix string             // Normalized diagnostics_suffix ("" = disabled)
+	bypassNameservers []NameserverConfig // Trusted upstreams for bypass domains (empty = regular nameservers)
+	forceCache    map[string]int         // Forced cache TTLs by domain (guarded by mu)
+	hooks         []namedHook            // Query hook chain (configured hooks, then AddHook ones)
+	nxdomainRedirectIP      net.IP           // Address NXDOMAIN answers are redirected to
+	nxdomainRedirectClients []*net.IPNet     // Clients whose NXDOMAIN answers are redirected
+	nxdomainRedirectExclude map[string]struct{} // Domains never redirected, including special-use names
+	maintenance   atomic.Bool            // maintenance_mode, toggled on SIGHUP
+	shadow        bool                   // Shadow copy replaying a sample (--shadow): nothing is forwarded
+	auditSink     *auditSink             // Collector of block/overwrite decisions (nil = disabled)
+	queryLog      *queryLogger           // Writer of query_log_file (nil = disabled)
+	views         []clientView           // Client views with separate caches, sorted by name
+	policy        *handlerPolicy         // Handler settings of listeners without their own policy
+	listenerPolicies map[string]*handlerPolicy // Handler settings by listener name, from listener_policies
+	suppressAAAAFor []*net.IPNet         // Clients whose AAAA queries get NODATA
+	forceTCPFor   []*net.IPNet           // Clients always told to retry over TCP
+	allowQuery    []*net.IPNet           // Clients allowed to query (empty = everyone)
+	fileZones     map[string]*fileZone   // Zones for "file" nameservers, keyed by zone file path
+	proxyTrusted  []*net.IPNet           // Proxies allowed to send PROXY protocol headers
+	trustECSFrom  []*net.IPNet           // Forwarders whose EDNS Client Subnet identifies the client
+	neighbors     *neighborTable         // IP to MAC lookups for MAC-based rules
+	preferTCPQtypes map[uint16]struct{}  // Query types forwarded over TCP instead of UDP
+	tlsErrors     upstreamTLSErrors      // Failure counts for encrypted upstreams
+	blockCategories blockCategories      // Interned block list categories and per-category block counts
+	macRulesEnabled bool                 // Set when any block or overwrite matches on MACs
+	nameservers   []NameserverConfig     // Default nameservers, then those only used by upstream_routes
+	defaultUpstreams *upstreamGroup      // The nameservers configured in nameservers
+	upstreamRoutes map[string]*upstreamGroup // Nameservers by domain suffix, from upstream_routes
+	breakers      []*circuitBreaker      // Per-nameserver circuit breakers, parallel to nameservers (nil = disabled)
+	stats         serverStats            // Query counters reported on SIGUSR1
+	cacheShards   []*cacheShard          // DNS response cache, split by key hash - see lock ordering above
+	sharedCache   sharedCacheBackend     // Optional second-level cache shared between instances
+	sharedCacheWrites chan sharedCacheWrite // Cache fills queued for the shared cache writers
+	sharedCacheDropped atomic.Uint64     // Shared cache writes dropped because the queue was full
+	ecsScopeLens  [2][129]atomic.Bool    // ECS scope lengths of cached answers by family, IPv4 then IPv6
 	mu            sync.RWMutex
 	pendingRequests map[string]*PendingRequest // Track pending requests for coalescing
 	pendingMu     sync.Mutex                   // Pending requests mutex - see lock ordering above
 	urlBlockLists []URLBlockList // Track URL-based block lists for reloading
-	client        *dns.Client
+	downloadSlots chan struct{}  // Semaphore bounding concurrent block list downloads
 	httpClient    *http.Client
 	msgPool       *sync.Pool // Pool for dns.Msg objects
-	nameserverIdx uint64      // Atomic counter for round-robin nameserver selection
+	done          chan struct{}   // Closed by Shutdown to stop background goroutines
+	shutdownOnce  sync.Once
+	listenersMu   sync.Mutex
+	listeners     []*dns.Server   // Started DNS listeners, stopped by Shutdown
+	metricsServer *http.Server    // Prometheus metrics listener (nil = disabled)
+	sourcePortMin         int          // Lowest local port for upstream UDP queries (0 = OS-assigned)
+	sourcePortMax         int          // Highest local port for upstream UDP queries
+	loopDetector          *loopDetector // Identical repeated query detection (nil = disabled)
+	tunnelDetector        *tunnelDetector // DNS tunnel detection (nil = disabled)
+	upstreamLimiter       *tokenBucket // Global upstream QPS cap (nil = unlimited)
+	clientLimiter         *clientLimiter // Per-client rate_limit_per_second buckets (nil = unlimited)
+	dnssecValidator       *dnssecValidator // validate_dnssec signature checks (nil = disabled)
+	upstreamLimitedTotal  uint64       // Atomic count of queries refused by the upstream QPS cap
+	upstreamLimitedRecent uint64       // Atomic count since the last periodic report
 }
@@ -7,7 +7,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
@@ -36,6 +36,31 @@ func parseSubnet(subnetStr string) (*net.IPNet, error) {
 // Uses string interning to reduce allocations.
 var domainCache sync.Map
 
+// domainCacheEntries approximately counts domainCache entries; domainCacheLimit bounds them
+// (0 = unlimited). When the limit is reached the cache is cleared, so a random-subdomain
+// flood cannot grow it without bound while hot domains are quickly re-interned.
+var (
+	domainCacheEntries int64
+	domainCacheLimit   int64 = defaultDomainCacheSize
+)
+
+// setDomainCacheSize sets the normalizeDomain cache bound (negative = unlimited).
+func setDomainCacheSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	atomic.StoreInt64(&domainCacheLimit, int64(size))
+}
+
+// storeDomainCache adds an entry to domainCache, clearing it first if it is full.
+func storeDomainCache(key, normalized string) {
+	if limit := atomic.LoadInt64(&domainCacheLimit); limit > 0 && atomic.AddInt64(&domainCacheEntries, 1) > limit {
+		domainCache.Clear()
+		atomic.StoreInt64(&domainCacheEntries, 1)
+	}
+	domainCache.Store(key, normalized)
+}
+
 func normalizeDomain(domain string) string {
 	// Fast path: check cache first
 	if cached, ok := domainCache.Load(domain); ok {
@@ -50,16 +75,33 @@ func normalizeDomain(domain string) string {
 
 	// Store in cache (only if reasonable size to avoid memory bloat)
 	if len(normalized) < 256 {
-		domainCache.Store(domain, normalized)
+		storeDomainCache(domain, normalized)
 		// Also store normalized->normalized for direct lookups
 		if normalized != domain {
-			domainCache.Store(normalized, normalized)
+			storeDomainCache(normalized, normalized)
 		}
 	}
 
 	return normalized
 }
 
+// lookupDomainSuffix finds the entry for a domain or its closest parent domain.
+// The domain must already be normalized.
+func lookupDomainSuffix[V any](entries map[string]V, domain string) (V, bool) {
+	if value, ok := entries[domain]; ok {
+		return value, true
+	}
+	for i := 0; i < len(domain); i++ {
+		if domain[i] == '.' && i+1 < len(domain) {
+			if value, ok := entries[domain[i+1:]]; ok {
+				return value, true
+			}
+		}
+	}
+	var zero V
+	return zero, false
+}
+
 // getClientIP extracts the client IP from the DNS request.
 func getClientIP(w dns.ResponseWriter) net.IP {
 	remoteAddr := w.RemoteAddr()
@@ -78,6 +120,25 @@ func getClientIP(w dns.ResponseWriter) net.IP {
 	return net.ParseIP(host)
 }
 
+// subnetsContain checks if an IP is contained in any of the subnets.
+func subnetsContain(subnets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUDPRequest checks if the request arrived over UDP.
+func isUDPRequest(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
 // isURL checks if a string is a valid HTTP or HTTPS URL.
 func isURL(path string) bool {
 	u, err := url.Parse(path)
@@ -112,44 +173,3 @@ func checkDNSWorking(domain string) bool {
 	_, err := resolver.LookupHost(ctx, domain)
 	return err == nil
 }
-
-// resolveHostWithFallback resolves a hostname using system DNS, or falls back to a specified DNS server.
-func resolveHostWithFallback(host string, fallbackDNS string) ([]string, error) {
-	// First try system DNS
-	addrs, err := net.LookupHost(host)
-	if err == nil {
-		return addrs, nil
-	}
-
-	// If system DNS fails, use fallback DNS server
-	if fallbackDNS == "" {
-		return nil, err
-	}
-
-	// Use miekg/dns to query the fallback DNS server
-	client := &dns.Client{Timeout: 5 * time.Second}
-	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
-
-	resp, _, err := client.Exchange(msg, net.JoinHostPort(fallbackDNS, "53"))
-	if err != nil {
-		return nil, fmt.Errorf("fallback DNS resolution failed: %w", err)
-	}
-
-	if resp.Rcode != dns.RcodeSuccess {
-		return nil, fmt.Errorf("DNS query failed with Rcode %d", resp.Rcode)
-	}
-
-	var addrsFromDNS []string
-	for _, answer := range resp.Answer {
-		if a, ok := answer.(*dns.A); ok {
-			addrsFromDNS = append(addrsFromDNS, a.A.String())
-		}
-	}
-
-	if len(addrsFromDNS) == 0 {
-		return nil, fmt.Errorf("no A records found for %s", host)
-	}
-
-	return addrsFromDNS, nil
-}
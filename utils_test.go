@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseSubnetIPv6(t *testing.T) {
+	tests := map[string]string{
+		"2001:db8::1":   "2001:db8::1/128",
+		"2001:db8::/32": "2001:db8::/32",
+		"192.0.2.1":     "192.0.2.1/32",
+	}
+	for in, want := range tests {
+		ipNet, err := parseSubnet(in)
+		if err != nil {
+			t.Errorf("parseSubnet(%q): %v", in, err)
+			continue
+		}
+		if ipNet.String() != want {
+			t.Errorf("parseSubnet(%q) = %s, want %s", in, ipNet, want)
+		}
+	}
+}
+
+func TestIPv6ClientRestrictions(t *testing.T) {
+	s := newTestServer(t, &Config{
+		Overwrites: map[string]interface{}{"www.test.lan": map[string]interface{}{
+			"ips":     []interface{}{"10.9.9.9"},
+			"subnets": []interface{}{"2001:db8::1"},
+		}},
+		BlockLists: []interface{}{map[string]interface{}{
+			"file":    writeTestFile(t, "hosts.txt", "0.0.0.0 ads.test.lan\n"),
+			"subnets": []interface{}{"2001:db8::/32"},
+		}},
+	})
+	query := func(client, name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		resp, err := s.Query(net.ParseIP(client), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if ips := answerIPs(query("2001:db8::1", "www.test.lan")); len(ips) != 1 || ips[0] != "10.9.9.9" {
+		t.Errorf("2001:db8::1: answer = %v, want the overwrite", ips)
+	}
+	if ips := answerIPs(query("2001:db8::2", "www.test.lan")); len(ips) != 1 || ips[0] != "10.1.1.1" {
+		t.Errorf("2001:db8::2: answer = %v, want the upstream answer", ips)
+	}
+	if resp := query("2001:db8:1::5", "ads.test.lan"); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("2001:db8:1::5: rcode = %s, want blocked", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := query("2001:db9::1", "ads.test.lan"); resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("2001:db9::1: rcode = %s, want not blocked", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func BenchmarkNormalizeDomain(b *testing.B) {
+	names := make([]string, 100000)
+	for i := range names {
+		names[i] = fmt.Sprintf("Host%d.Example.COM.", i)
+	}
+	defer setDomainCacheSize(defaultDomainCacheSize)
+
+	for _, bm := range []struct {
+		name  string
+		size  int
+		names []string
+	}{
+		{"unbounded", -1, names[:1000]}, // Every lookup after the first round is a hit
+		{"full", 1000, names},           // Unique names keep filling and clearing the cache
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			setDomainCacheSize(bm.size)
+			domainCache.Clear()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				normalizeDomain(bm.names[i%len(bm.names)])
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// clientView is a named group of client subnets whose answers are cached separately.
+type clientView struct {
+	name    string
+	subnets []*net.IPNet
+}
+
+// parseViews parses the views setting, mapping view names to client subnets.
+// Views are sorted by name so overlapping subnets resolve the same way on every start.
+func parseViews(config map[string][]string) ([]clientView, error) {
+	views := make([]clientView, 0, len(config))
+	for name, subnets := range config {
+		if name == "" {
+			return nil, fmt.Errorf("view name must not be empty")
+		}
+		parsed, err := parseSubnets(subnets)
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", name, err)
+		}
+		if len(parsed) == 0 {
+			return nil, fmt.Errorf("view %s has no subnets", name)
+		}
+		views = append(views, clientView{name: name, subnets: parsed})
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].name < views[j].name })
+	return views, nil
+}
+
+// clientViewName returns the view of a client: the view with the most specific subnet
+// containing the address, or "" (the global view) if none does.
+func (s *DNSServer) clientViewName(clientIP net.IP) string {
+	if len(s.views) == 0 || clientIP == nil {
+		return ""
+	}
+	name, bestBits := "", -1
+	for _, view := range s.views {
+		for _, subnet := range view.subnets {
+			if bits, _ := subnet.Mask.Size(); bits > bestBits && subnet.Contains(clientIP) {
+				name, bestBits = view.name, bits
+			}
+		}
+	}
+	return name
+}
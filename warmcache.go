@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	warmCacheQPS           = 20  // Upstream queries per second while warming the cache
+	warmCacheProgressEvery = 100 // Log progress after this many domains
+)
+
+// warmCacheDomains collects the domains from warm_cache and warm_cache_file.
+func (s *DNSServer) warmCacheDomains() []string {
+	domains := append([]string(nil), s.config.WarmCache...)
+	if s.config.WarmCacheFile == "" {
+		return domains
+	}
+
+	file, err := os.Open(filepath.Clean(s.config.WarmCacheFile))
+	if err != nil {
+		log.Printf("Warning: failed to open warm_cache_file %s: %v", s.config.WarmCacheFile, err)
+		return domains
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			s.debugLog("Warning: failed to close %s: %v", s.config.WarmCacheFile, closeErr)
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Warning: failed to read warm_cache_file %s: %v", s.config.WarmCacheFile, err)
+	}
+	return domains
+}
+
+// startCacheWarming resolves the warm_cache domains (A and AAAA) in the background,
+// rate-limited, so the first client queries for them are cache hits.
+func (s *DNSServer) startCacheWarming() {
+	if s.config.CacheTTL <= 0 || (len(s.config.WarmCache) == 0 && s.config.WarmCacheFile == "") {
+		return
+	}
+
+	go func() {
+		domains := s.warmCacheDomains()
+		if len(domains) == 0 {
+			return
+		}
+		log.Printf("Warming cache with %d domains", len(domains))
+
+		limiter := newTokenBucket(warmCacheQPS, 1)
+		warmed := 0
+		for i, domain := range domains {
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if s.warmCacheQuery(domain, qtype, limiter) {
+					warmed++
+				}
+			}
+			if (i+1)%warmCacheProgressEvery == 0 {
+				log.Printf("Cache warming: %d/%d domains", i+1, len(domains))
+			}
+		}
+		log.Printf("Cache warming finished: %d queries resolved for %d domains", warmed, len(domains))
+	}()
+}
+
+// warmCacheQuery resolves and caches a single query through the normal forwarding path.
+// Queries that are already cached, blocked for all clients or overwritten for any client are
+// skipped, so warming never caches an upstream answer for a domain clients get a local answer for.
+func (s *DNSServer) warmCacheQuery(domain string, qtype uint16, limiter *tokenBucket) bool {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(domain), qtype)
+	normalized := normalizeDomain(domain)
+
+	if s.maintenance.Load() || s.getCachedResponse(r, nil, "") != nil {
+		return false
+	}
+	if entry, _ := s.matchBlock(normalized, nil, nil); entry != nil {
+		return false
+	}
+	if s.hasOverwrite(normalized) {
+		return false
+	}
+
+	// A token is always available within a second at warmCacheQPS
+	limiter.wait(time.Second)
+	resp, err := s.forwardDirectInternal(r, normalized, nil)
+	if err != nil {
+		s.debugLog("Cache warming: failed to resolve %s: %v", domain, err)
+		return false
+	}
+	s.setCachedResponse(r, resp, "")
+	return true
+}
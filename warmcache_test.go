@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestWarmCacheSkipsOverwrites(t *testing.T) {
+	s := newTestServer(t, &Config{
+		CacheTTL: 60,
+		Overwrites: map[string]interface{}{"www.test.lan": map[string]interface{}{
+			"ips":     []interface{}{"10.9.9.9"},
+			"subnets": []interface{}{"10.0.0.0/8"},
+		}},
+	})
+	limiter := newTokenBucket(warmCacheQPS, 1)
+	if s.warmCacheQuery("www.test.lan", dns.TypeA, limiter) {
+		t.Error("warmed www.test.lan, want overwritten domains skipped")
+	}
+	if !s.warmCacheQuery("many.test.lan", dns.TypeA, limiter) {
+		t.Error("did not warm many.test.lan")
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.test.lan.", dns.TypeA)
+	if s.getCachedResponse(r, nil, "") != nil {
+		t.Error("www.test.lan is cached")
+	}
+}
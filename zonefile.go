@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxZoneCNAMEChain bounds CNAME chasing inside a file zone.
+const maxZoneCNAMEChain = 8
+
+// fileZone is a static zone loaded from a zone file, used by the "file" pseudo-upstream.
+type fileZone struct {
+	origin  string              // Zone apex taken from the SOA record ("" if the file has no SOA)
+	soa     *dns.SOA            // SOA record used in negative answers
+	records map[string][]dns.RR // Records keyed by lowercased owner name
+	parents map[string]bool     // Names without records of their own but with names below them
+}
+
+// loadFileZone parses a zone file in standard master file format.
+func loadFileZone(path string) (*fileZone, error) {
+	cleanPath := filepath.Clean(path)
+	file, err := os.Open(cleanPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	zone := &fileZone{records: make(map[string][]dns.RR)}
+	parser := dns.NewZoneParser(file, "", cleanPath)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		zone.records[name] = append(zone.records[name], rr)
+		if soa, isSOA := rr.(*dns.SOA); isSOA && zone.soa == nil {
+			zone.soa = soa
+			zone.origin = name
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file %s: %w", cleanPath, err)
+	}
+	zone.findParents()
+	return zone, nil
+}
+
+// findParents records the empty non-terminals of the zone (e.g. b.example when only
+// a.b.example has records), which exist and are answered NODATA instead of NXDOMAIN.
+func (z *fileZone) findParents() {
+	z.parents = make(map[string]bool)
+	for name := range z.records {
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			parent := name[off:]
+			if z.origin != "" && !dns.IsSubDomain(z.origin, parent) {
+				break
+			}
+			if _, hasRecords := z.records[parent]; !hasRecords {
+				z.parents[parent] = true
+			}
+		}
+	}
+}
+
+// exchange answers a query from the zone, mirroring the response an authoritative server would give.
+func (z *fileZone) exchange(r *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	if len(r.Question) == 0 {
+		msg.Rcode = dns.RcodeFormatError
+		return msg
+	}
+
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if z.origin != "" && !dns.IsSubDomain(z.origin, name) {
+		msg.Rcode = dns.RcodeRefused
+		return msg
+	}
+	msg.Authoritative = true
+
+	// Follow CNAMEs inside the zone
+	for i := 0; i < maxZoneCNAMEChain; i++ {
+		rrs, exists := z.records[name]
+		if !exists {
+			if len(msg.Answer) == 0 {
+				// A name with only names below it exists, with no records (NODATA)
+				if !z.parents[name] {
+					msg.Rcode = dns.RcodeNameError
+				}
+				z.addSOA(msg)
+			}
+			return msg
+		}
+
+		var cname *dns.CNAME
+		matched := false
+		for _, rr := range rrs {
+			rrType := rr.Header().Rrtype
+			if rrType == q.Qtype || q.Qtype == dns.TypeANY {
+				msg.Answer = append(msg.Answer, dns.Copy(rr))
+				matched = true
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if matched || cname == nil {
+			if !matched && len(msg.Answer) == 0 {
+				// Name exists but has no records of this type (NODATA)
+				z.addSOA(msg)
+			}
+			return msg
+		}
+
+		msg.Answer = append(msg.Answer, dns.Copy(cname))
+		name = strings.ToLower(cname.Target)
+		if z.origin != "" && !dns.IsSubDomain(z.origin, name) {
+			// Target is outside this zone
+			return msg
+		}
+	}
+	return msg
+}
+
+// addSOA adds the zone's SOA record to the authority section of a negative answer.
+func (z *fileZone) addSOA(msg *dns.Msg) {
+	if z.soa != nil {
+		msg.Ns = append(msg.Ns, dns.Copy(z.soa))
+	}
+}
+
+// loadFileZones loads the zone files of all "file" nameservers, including bypass upstreams.
+func (s *DNSServer) loadFileZones() error {
+	for _, ns := range append(s.bypassNameservers, s.nameservers...) {
+		if ns.Protocol != protocolFile {
+			continue
+		}
+		if ns.ZoneFile == "" {
+			return fmt.Errorf("nameserver with protocol %q requires zone_file", protocolFile)
+		}
+		if _, loaded := s.fileZones[ns.ZoneFile]; loaded {
+			continue
+		}
+		zone, err := loadFileZone(ns.ZoneFile)
+		if err != nil {
+			return err
+		}
+		s.fileZones[ns.ZoneFile] = zone
+	}
+	return nil
+}
+
+// forwardFile answers a DNS request from a file zone.
+func (s *DNSServer) forwardFile(r *dns.Msg, nameserver NameserverConfig) (*dns.Msg, error) {
+	zone, ok := s.fileZones[nameserver.ZoneFile]
+	if !ok {
+		return nil, fmt.Errorf("zone file %s not loaded", nameserver.ZoneFile)
+	}
+	return zone.exchange(r), nil
+}
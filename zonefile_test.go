@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFileZoneEmptyNonTerminal(t *testing.T) {
+	zone, err := loadFileZone(writeTestFile(t, "example.zone", `$ORIGIN example.
+@ 300 IN SOA ns. host. 1 3600 600 86400 60
+a.b 300 IN A 10.0.0.1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		rcode  int
+		answer bool
+	}{
+		{"a.b.example.", dns.RcodeSuccess, true},
+		{"b.example.", dns.RcodeSuccess, false}, // Empty non-terminal: NODATA
+		{"c.b.example.", dns.RcodeNameError, false},
+		{"b.c.example.", dns.RcodeNameError, false},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, dns.TypeA)
+		resp := zone.exchange(q)
+		if resp.Rcode != tt.rcode || (len(resp.Answer) > 0) != tt.answer {
+			t.Errorf("%s: rcode %s with %d answers, want %s", tt.name, dns.RcodeToString[resp.Rcode], len(resp.Answer), dns.RcodeToString[tt.rcode])
+		}
+		if !tt.answer {
+			if len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+				t.Errorf("%s: authority %v, want the SOA", tt.name, resp.Ns)
+			}
+		}
+	}
+}